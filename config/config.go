@@ -4,27 +4,71 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds all configuration values for the application
 type Config struct {
-	PasteTTL                int64  // TTL in seconds for pastes
-	PasteDynamoDBCutoffSize int    // Size threshold for DynamoDB vs S3 storage (bytes)
-	PasteMaxSize            int    // Maximum paste size (bytes)
-	CacheMaxItems           int    // LRU cache maximum number of items
-	SessionsKey             string // Secret key for signing session cookies (required)
-	SessionsKeyPrev         string // Previous secret key for key rotation (optional)
-	SessionMaxAge           int64  // Maximum session age in seconds (default: 30 days)
+	PasteTTL                int64    // TTL in seconds for pastes
+	PasteMinTTL             int64    // Shortest TTL in seconds a caller may request
+	PasteMaxTTL             int64    // Longest TTL in seconds a caller may request
+	PasteMaxViews           int64    // Largest view limit a caller may set
+	PasswordMaxGuesses      int      // Wrong passwords allowed per protected paste in each window
+	PasswordGuessWindow     int64    // Length in seconds of the wrong-password window
+	VanityQuota             int64    // Vanity codes each client IP may claim per window (0 for unlimited)
+	VanityQuotaWindow       int64    // Length in seconds of the vanity quota window
+	RedirectSchemes         []string // URL schemes a shortened link may point at
+	PasteMaxRevisions       int64    // Revisions a paste may have, the original included (0 for unlimited)
+	PasteDynamoDBCutoffSize int      // Size threshold for DynamoDB vs S3 storage (bytes)
+	PasteMaxSize            int      // Maximum paste size (bytes)
+	CacheMaxItems           int      // LRU cache maximum number of items
+	RenderCacheMaxItems     int      // Highlighted pages kept in the render cache
+	SessionsKey             string   // Secret key for signing session cookies (required)
+	SessionsKeyPrev         string   // Previous secret key for key rotation (optional)
+	SessionMaxAge           int64    // Maximum session age in seconds (default: 30 days)
+	DBBackend               string   // Metadata backend: "dynamodb" (default), "local" or "sqlite"
+	BlobBackend             string   // Blob backend for large pastes: "s3" (default) or "local"
+	DataDir                 string   // Root directory for local storage backends
+	SQLitePath              string   // SQLite database file (default: <DataDir>/xipe.db)
+	SweepInterval           int64    // Seconds between expired-record sweeps for non-DynamoDB backends
+	AWSRegion               string   // AWS region for DynamoDB and S3
+	DynamoDBTable           string   // DynamoDB table name
+	DynamoDBEndpoint        string   // Custom DynamoDB endpoint (e.g. DynamoDB Local)
+	S3Bucket                string   // S3 bucket for large pastes
+	S3KeyPrefix             string   // Prefix prepended to every S3 object key
+	S3Endpoint              string   // Custom S3 endpoint (e.g. MinIO, LocalStack)
+	S3UsePathStyle          bool     // Use path-style S3 addressing (required by most S3-compatible stores)
+	AWSVerifyResources      bool     // Check at startup that the table and bucket exist
+	AWSCreateResources      bool     // Create the table and bucket at startup if they are missing
+	GCInterval              int64    // Seconds between background blob GC runs (0 disables)
+	GCGracePeriod           int64    // Blobs younger than this many seconds are never collected
 }
 
 // LoadConfig loads configuration from environment variables with defaults
 func LoadConfig() *Config {
 	cfg := &Config{
 		PasteTTL:                86400 * 7,  // 7 days default
+		PasteMinTTL:             60,         // 1 minute default
+		PasteMaxTTL:             86400 * 30, // 30 days default
+		PasteMaxViews:           1000,
+		PasswordMaxGuesses:      5,
+		PasswordGuessWindow:     300,   // 5 minutes default
+		VanityQuotaWindow:       86400, // 1 day default
+		RedirectSchemes:         []string{"http", "https"},
+		PasteMaxRevisions:       100,
 		PasteDynamoDBCutoffSize: 10240,      // 10KB default
 		PasteMaxSize:            2097152,    // 2MB default
 		CacheMaxItems:           10000,      // 10K items default
+		RenderCacheMaxItems:     1000,       // 1K pages default
 		SessionMaxAge:           86400 * 30, // 30 days default
+		DBBackend:               "dynamodb",
+		BlobBackend:             "s3",
+		DataDir:                 "./data",
+		SweepInterval:           300, // 5 minutes default
+		AWSRegion:               "us-east-1",
+		DynamoDBTable:           "xipe_redirects",
+		S3Bucket:                "xipe-data",
+		GCGracePeriod:           3600, // 1 hour default
 	}
 
 	// Load from environment variables if present
@@ -36,6 +80,84 @@ func LoadConfig() *Config {
 		}
 	}
 
+	if val := os.Getenv("PASTE_MIN_TTL"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.PasteMinTTL = parsed
+		} else {
+			log.Printf("Warning: Invalid PASTE_MIN_TTL value '%s', using default %d", val, cfg.PasteMinTTL)
+		}
+	}
+
+	if val := os.Getenv("PASTE_MAX_TTL"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.PasteMaxTTL = parsed
+		} else {
+			log.Printf("Warning: Invalid PASTE_MAX_TTL value '%s', using default %d", val, cfg.PasteMaxTTL)
+		}
+	}
+
+	if val := os.Getenv("PASTE_MAX_VIEWS"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.PasteMaxViews = parsed
+		} else {
+			log.Printf("Warning: Invalid PASTE_MAX_VIEWS value '%s', using default %d", val, cfg.PasteMaxViews)
+		}
+	}
+
+	if val := os.Getenv("PASSWORD_MAX_GUESSES"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			cfg.PasswordMaxGuesses = parsed
+		} else {
+			log.Printf("Warning: Invalid PASSWORD_MAX_GUESSES value '%s', using default %d", val, cfg.PasswordMaxGuesses)
+		}
+	}
+
+	if val := os.Getenv("PASSWORD_GUESS_WINDOW"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.PasswordGuessWindow = parsed
+		} else {
+			log.Printf("Warning: Invalid PASSWORD_GUESS_WINDOW value '%s', using default %d", val, cfg.PasswordGuessWindow)
+		}
+	}
+
+	if val := os.Getenv("PASTE_MAX_REVISIONS"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.PasteMaxRevisions = parsed
+		} else {
+			log.Printf("Warning: Invalid PASTE_MAX_REVISIONS value '%s', using default %d", val, cfg.PasteMaxRevisions)
+		}
+	}
+
+	if val := os.Getenv("VANITY_QUOTA"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.VanityQuota = parsed
+		} else {
+			log.Printf("Warning: Invalid VANITY_QUOTA value '%s', using default %d", val, cfg.VanityQuota)
+		}
+	}
+
+	if val := os.Getenv("VANITY_QUOTA_WINDOW"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.VanityQuotaWindow = parsed
+		} else {
+			log.Printf("Warning: Invalid VANITY_QUOTA_WINDOW value '%s', using default %d", val, cfg.VanityQuotaWindow)
+		}
+	}
+
+	if val := os.Getenv("REDIRECT_SCHEMES"); val != "" {
+		var schemes []string
+		for _, scheme := range strings.Split(val, ",") {
+			if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+				schemes = append(schemes, scheme)
+			}
+		}
+		if len(schemes) > 0 {
+			cfg.RedirectSchemes = schemes
+		} else {
+			log.Printf("Warning: Invalid REDIRECT_SCHEMES value '%s', using default %s", val, strings.Join(cfg.RedirectSchemes, ","))
+		}
+	}
+
 	if val := os.Getenv("PASTE_DYNAMODB_CUTOFF_SIZE"); val != "" {
 		if parsed, err := strconv.Atoi(val); err == nil {
 			cfg.PasteDynamoDBCutoffSize = parsed
@@ -60,6 +182,14 @@ func LoadConfig() *Config {
 		}
 	}
 
+	if val := os.Getenv("RENDER_CACHE_MAX_ITEMS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			cfg.RenderCacheMaxItems = parsed
+		} else {
+			log.Printf("Warning: Invalid RENDER_CACHE_MAX_ITEMS value '%s', using default %d", val, cfg.RenderCacheMaxItems)
+		}
+	}
+
 	// Load SESSIONS_KEY (required)
 	cfg.SessionsKey = os.Getenv("SESSIONS_KEY")
 	if cfg.SessionsKey == "" {
@@ -78,8 +208,107 @@ func LoadConfig() *Config {
 		}
 	}
 
-	log.Printf("Config loaded - TTL: %ds, DynamoDB cutoff: %d bytes, Max size: %d bytes, Cache max items: %d, Session max age: %ds",
-		cfg.PasteTTL, cfg.PasteDynamoDBCutoffSize, cfg.PasteMaxSize, cfg.CacheMaxItems, cfg.SessionMaxAge)
+	// Storage backend selection
+	if val := os.Getenv("DB_BACKEND"); val != "" {
+		switch val {
+		case "dynamodb", "local", "sqlite":
+			cfg.DBBackend = val
+		default:
+			log.Printf("Warning: Invalid DB_BACKEND value '%s', using default %s", val, cfg.DBBackend)
+		}
+	}
+
+	if val := os.Getenv("BLOB_BACKEND"); val != "" {
+		switch val {
+		case "s3", "local":
+			cfg.BlobBackend = val
+		default:
+			log.Printf("Warning: Invalid BLOB_BACKEND value '%s', using default %s", val, cfg.BlobBackend)
+		}
+	}
+
+	if val := os.Getenv("DATA_DIR"); val != "" {
+		cfg.DataDir = val
+	}
+
+	cfg.SQLitePath = os.Getenv("SQLITE_PATH")
+
+	if val := os.Getenv("SWEEP_INTERVAL"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.SweepInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid SWEEP_INTERVAL value '%s', using default %d", val, cfg.SweepInterval)
+		}
+	}
+
+	// AWS resource configuration
+	if val := os.Getenv("AWS_REGION"); val != "" {
+		cfg.AWSRegion = val
+	}
+
+	if val := os.Getenv("DYNAMODB_TABLE"); val != "" {
+		cfg.DynamoDBTable = val
+	}
+
+	if val := os.Getenv("S3_BUCKET"); val != "" {
+		cfg.S3Bucket = val
+	}
+
+	cfg.S3KeyPrefix = os.Getenv("S3_KEY_PREFIX")
+
+	// AWS_ENDPOINT_URL applies to both services unless a service-specific endpoint is set
+	cfg.DynamoDBEndpoint = os.Getenv("AWS_ENDPOINT_URL")
+	cfg.S3Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	if val := os.Getenv("DYNAMODB_ENDPOINT_URL"); val != "" {
+		cfg.DynamoDBEndpoint = val
+	}
+	if val := os.Getenv("S3_ENDPOINT_URL"); val != "" {
+		cfg.S3Endpoint = val
+	}
+
+	if val := os.Getenv("S3_USE_PATH_STYLE"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			cfg.S3UsePathStyle = parsed
+		} else {
+			log.Printf("Warning: Invalid S3_USE_PATH_STYLE value '%s', using default %t", val, cfg.S3UsePathStyle)
+		}
+	}
+
+	if val := os.Getenv("AWS_VERIFY_RESOURCES"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			cfg.AWSVerifyResources = parsed
+		} else {
+			log.Printf("Warning: Invalid AWS_VERIFY_RESOURCES value '%s', using default %t", val, cfg.AWSVerifyResources)
+		}
+	}
+
+	if val := os.Getenv("AWS_CREATE_RESOURCES"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			cfg.AWSCreateResources = parsed
+		} else {
+			log.Printf("Warning: Invalid AWS_CREATE_RESOURCES value '%s', using default %t", val, cfg.AWSCreateResources)
+		}
+	}
+
+	// Blob garbage collection
+	if val := os.Getenv("GC_INTERVAL"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.GCInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid GC_INTERVAL value '%s', using default %d", val, cfg.GCInterval)
+		}
+	}
+
+	if val := os.Getenv("GC_GRACE_PERIOD"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			cfg.GCGracePeriod = parsed
+		} else {
+			log.Printf("Warning: Invalid GC_GRACE_PERIOD value '%s', using default %d", val, cfg.GCGracePeriod)
+		}
+	}
+
+	log.Printf("Config loaded - TTL: %ds, DynamoDB cutoff: %d bytes, Max size: %d bytes, Cache max items: %d, Session max age: %ds, DB backend: %s, Blob backend: %s",
+		cfg.PasteTTL, cfg.PasteDynamoDBCutoffSize, cfg.PasteMaxSize, cfg.CacheMaxItems, cfg.SessionMaxAge, cfg.DBBackend, cfg.BlobBackend)
 
 	return cfg
 }
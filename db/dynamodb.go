@@ -2,7 +2,10 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/drewstreib/xipe-go/config"
@@ -18,7 +21,35 @@ import (
 type DBInterface interface {
 	PutRedirect(redirect *RedirectRecord) error
 	GetRedirect(code string) (*RedirectRecord, error)
+	// GetRedirectFresh is GetRedirect bypassing any cache, with a consistent
+	// read, for callers that can't act on a copy another replica has since
+	// changed
+	GetRedirectFresh(code string) (*RedirectRecord, error)
 	DeleteRedirect(code string, ownerID string) error
+	// ConsumeRedirect atomically deletes a record and returns it. Exactly one
+	// caller wins; everyone else (including other replicas) gets nil.
+	// Blobs are left for the caller to read and remove.
+	ConsumeRedirect(code string) (*RedirectRecord, error)
+	// RecordView atomically counts one view of a view-limited record and
+	// returns the updated record, or nil if it is gone or out of views.
+	RecordView(code string) (*RedirectRecord, error)
+	// TakeQuota counts one use of key in a fixed window starting at its first
+	// use, and reports whether the use was within limit
+	TakeQuota(key string, limit int64, window time.Duration) (bool, error)
+	// RefundQuota gives back one use of key counted by TakeQuota, if its
+	// window is still live
+	RefundQuota(key string) error
+	// SetSize records the content size and hex SHA-256 of a type "S" paste
+	// once its blob has been uploaded
+	SetSize(code string, size int64, hash string) error
+	// SetFiles turns a stored upload into a type "B" multi-file paste once
+	// every file is in the blob store, recording the manifest and total size
+	// in place of the single file's content, name and type
+	SetFiles(code string, files BundleFiles) error
+	// ReviseRedirect stores the new content of an edited paste (Typ, Val,
+	// Size, Hash, BlobTag, Rev, Updated and Revs) if ownerID owns it and its stored revision
+	// is still record.Rev-1. Anything else is a ConditionalCheckFailedException.
+	ReviseRedirect(record *RedirectRecord, ownerID string) error
 	GetCacheSize() int
 }
 
@@ -26,36 +57,150 @@ type DynamoDBClient struct {
 	client *dynamodb.Client
 	table  string
 	cache  *expirable.LRU[string, *CachedRecord]
+	blobs  S3Interface // Blob store cleaned up when type "S" records are deleted
 }
 
 // CachedRecord holds the data/URL and original DynamoDB TTL
 type CachedRecord struct {
-	Val       string // URL or data content
-	Typ       string // "R" for redirect, "D" for data
-	DynamoTTL int64  // Original DynamoDB TTL timestamp
-	Created   int64  // Creation timestamp
-	IP        string // Creator IP address
-	Owner     string // Owner ID for deletion authentication
+	Val       string      // URL or data content
+	Typ       string      // "R" for redirect, "D" for data
+	DynamoTTL int64       // Original DynamoDB TTL timestamp
+	Created   int64       // Creation timestamp
+	IP        string      // Creator IP address
+	Owner     string      // Owner ID for deletion authentication
+	PassHash  string      // bcrypt hash for password-protected pastes
+	Enc       bool        // Content is client-side ciphertext
+	Redir     int         // Status for direct redirects
+	Size      int64       // Content size in bytes
+	Hash      string      // SHA-256 of the content
+	DelHash   string      // SHA-256 of the delete token
+	Rev       int64       // Current revision, 0 if never edited
+	Updated   int64       // When the current revision was stored
+	Revs      Revisions   // Earlier revisions
+	BlobTag   string      // Tag in the blob key of content uploaded by an edit
+	Parent    string      // Paste this one was forked from
+	Filename  string      // Name of an uploaded file
+	Mime      string      // MIME type of binary content
+	Lang      string      // Syntax highlighting language
+	Files     BundleFiles // Manifest of a multi-file paste
 }
 
 type RedirectRecord struct {
-	Code    string `dynamodbav:"code"`
-	Typ     string `dynamodbav:"typ"`
-	Val     string `dynamodbav:"val"`
-	Ettl    int64  `dynamodbav:"ettl,omitempty"`
-	Created int64  `dynamodbav:"created"`
-	IP      string `dynamodbav:"ip"`
-	Owner   string `dynamodbav:"owner"`
+	Code    string `dynamodbav:"code" json:"code"`
+	Typ     string `dynamodbav:"typ" json:"typ"`
+	Val     string `dynamodbav:"val" json:"val"`
+	Ettl    int64  `dynamodbav:"ettl,omitempty" json:"ettl,omitempty"`
+	Created int64  `dynamodbav:"created" json:"created"`
+	IP      string `dynamodbav:"ip" json:"ip"`
+	Owner   string `dynamodbav:"owner" json:"owner"`
+	Burn    bool   `dynamodbav:"burn,omitempty" json:"burn,omitempty"` // Delete after the first non-owner read
+
+	MaxViews int64 `dynamodbav:"maxviews,omitempty" json:"maxviews,omitempty"` // View limit, 0 for unlimited
+	Views    int64 `dynamodbav:"views,omitempty" json:"views,omitempty"`       // Views counted against MaxViews
+
+	PassHash string `dynamodbav:"pwhash,omitempty" json:"pwhash,omitempty"` // bcrypt hash, never the password itself
+	Enc      bool   `dynamodbav:"enc,omitempty" json:"enc,omitempty"`       // Content is client-side ciphertext the server cannot read
+
+	Redir int `dynamodbav:"redir,omitempty" json:"redir,omitempty"` // Type "R" only: 301 or 302 to redirect directly, 0 for the interstitial page
+
+	Size    int64  `dynamodbav:"size,omitempty" json:"size,omitempty"`       // Content size in bytes, 0 if unknown
+	DelHash string `dynamodbav:"delhash,omitempty" json:"delhash,omitempty"` // Hex SHA-256 of the delete token, never the token itself
+	Hash    string `dynamodbav:"hash,omitempty" json:"hash,omitempty"`       // Hex SHA-256 of the content as stored, empty for short links, multi-file pastes and pastes stored before it was recorded
+
+	Rev     int64     `dynamodbav:"rev,omitempty" json:"rev,omitempty"`         // Current revision, 0 for a paste that was never edited (revision 1)
+	Updated int64     `dynamodbav:"updated,omitempty" json:"updated,omitempty"` // When the current revision was stored, 0 for revision 1
+	Revs    Revisions `dynamodbav:"revs,omitempty" json:"revs,omitempty"`       // Earlier revisions, oldest first; their content is always in the blob store
+	BlobTag string    `dynamodbav:"blobtag,omitempty" json:"blobtag,omitempty"` // Type "S" only: the tag of the edit that uploaded the content, naming its blob; empty for content at its RevisionBlobKey
+
+	Parent string `dynamodbav:"parent,omitempty" json:"parent,omitempty"` // Code the paste was forked from, with @N when the parent had been edited
+
+	Filename string `dynamodbav:"filename,omitempty" json:"filename,omitempty"` // Original name of an uploaded file
+	Mime     string `dynamodbav:"mime,omitempty" json:"mime,omitempty"`         // Detected MIME type of a binary file, empty for text
+	Lang     string `dynamodbav:"lang,omitempty" json:"lang,omitempty"`         // Syntax highlighting language given on upload, empty to go by the file name
+
+	Files BundleFiles `dynamodbav:"files,omitempty" json:"files,omitempty"` // Type "B" only: the files of a multi-file paste, in upload order; their content is always in the blob store
+}
+
+// Revision describes an earlier revision of an edited paste
+type Revision struct {
+	Rev     int64  `dynamodbav:"rev" json:"rev"`
+	Created int64  `dynamodbav:"created" json:"created"` // When this revision was stored
+	Size    int64  `dynamodbav:"size,omitempty" json:"size,omitempty"`
+	Hash    string `dynamodbav:"hash,omitempty" json:"hash,omitempty"`       // Hex SHA-256 of the content, empty if it was stored before it was recorded
+	BlobTag string `dynamodbav:"blobtag,omitempty" json:"blobtag,omitempty"` // Tag in the key of its blob, as RedirectRecord.BlobTag
 }
 
-func NewDynamoDBClient(cfg *config.Config) (DBInterface, error) {
+// Revisions is the history of an edited paste
+type Revisions []Revision
+
+// BundleFile describes one file of a multi-file paste
+type BundleFile struct {
+	Name string `dynamodbav:"name" json:"name"`
+	Size int64  `dynamodbav:"size,omitempty" json:"size,omitempty"`
+	Mime string `dynamodbav:"mime,omitempty" json:"mime,omitempty"` // Detected MIME type of a binary file, empty for text
+	Hash string `dynamodbav:"hash,omitempty" json:"hash,omitempty"` // Hex SHA-256 of the content
+}
+
+// BundleFiles is the manifest of a multi-file paste
+type BundleFiles []BundleFile
+
+// Index returns the position of the file called name, or -1
+func (f BundleFiles) Index(name string) int {
+	for i, file := range f {
+		if file.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Size returns the total size of the files
+func (f BundleFiles) Size() int64 {
+	var size int64
+	for _, file := range f {
+		size += file.Size
+	}
+	return size
+}
+
+// Revision returns the number of the record's current revision
+func (r *RedirectRecord) Revision() int64 {
+	if r.Rev == 0 {
+		return 1
+	}
+	return r.Rev
+}
+
+// HasRevision reports whether rev is the current or an earlier revision
+func (r *RedirectRecord) HasRevision(rev int64) bool {
+	if rev == r.Revision() {
+		return true
+	}
+	for _, earlier := range r.Revs {
+		if earlier.Rev == rev {
+			return true
+		}
+	}
+	return false
+}
+
+// Binary reports whether the record holds a binary file rather than text.
+// Binary content is always in the blob store.
+func (r *RedirectRecord) Binary() bool {
+	return r.Mime != ""
+}
+
+func NewDynamoDBClient(cfg *config.Config, blobs S3Interface) (DBInterface, error) {
 	log.Println("Initializing DynamoDB client...")
 
 	// Log some environment info for debugging
-	log.Printf("AWS Region: us-east-1")
-	log.Printf("DynamoDB Table: xipe_redirects")
+	log.Printf("AWS Region: %s", cfg.AWSRegion)
+	log.Printf("DynamoDB Table: %s", cfg.DynamoDBTable)
+	if cfg.DynamoDBEndpoint != "" {
+		log.Printf("DynamoDB Endpoint: %s", cfg.DynamoDBEndpoint)
+	}
 
-	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion("us-east-1"))
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion(cfg.AWSRegion))
 	if err != nil {
 		log.Printf("Failed to load AWS config: %v", err)
 		return nil, err
@@ -70,6 +215,18 @@ func NewDynamoDBClient(cfg *config.Config) (DBInterface, error) {
 		// Don't log the actual keys for security
 	}
 
+	dynamoClient := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+		if cfg.DynamoDBEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoDBEndpoint)
+		}
+	})
+
+	if cfg.AWSVerifyResources || cfg.AWSCreateResources {
+		if err := ensureDynamoDBTable(context.TODO(), dynamoClient, cfg.DynamoDBTable, cfg.AWSCreateResources); err != nil {
+			return nil, err
+		}
+	}
+
 	// Use cache max items from config
 	cacheMaxItems := cfg.CacheMaxItems
 
@@ -80,14 +237,69 @@ func NewDynamoDBClient(cfg *config.Config) (DBInterface, error) {
 	log.Printf("Initialized LRU cache with max items: %d, TTL: %v", cacheMaxItems, cacheTTL)
 
 	client := &DynamoDBClient{
-		client: dynamodb.NewFromConfig(awsCfg),
-		table:  "xipe_redirects",
+		client: dynamoClient,
+		table:  cfg.DynamoDBTable,
 		cache:  cache,
+		blobs:  blobs,
 	}
-	log.Printf("DynamoDB client initialized successfully for table: %s", "xipe_redirects")
+	log.Printf("DynamoDB client initialized successfully for table: %s", cfg.DynamoDBTable)
 	return client, nil
 }
 
+// ensureDynamoDBTable verifies that the table exists, optionally creating it
+// (on-demand billing, TTL on ettl) when it is missing
+func ensureDynamoDBTable(ctx context.Context, client *dynamodb.Client, table string, create bool) error {
+	_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err == nil {
+		log.Printf("Verified DynamoDB table %s exists", table)
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to describe DynamoDB table %s: %w", table, err)
+	}
+	if !create {
+		return fmt.Errorf("DynamoDB table %s does not exist (set AWS_CREATE_RESOURCES=true to create it)", table)
+	}
+
+	log.Printf("DynamoDB table %s not found, creating it", table)
+	_, err = client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("code"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("code"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create DynamoDB table %s: %w", table, err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("timed out waiting for DynamoDB table %s: %w", table, err)
+	}
+
+	// TTL is what expires pastes, so a table without it would grow forever
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("ettl"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		// DynamoDB Local doesn't enforce TTL but accepts the call; real failures are worth a warning only
+		log.Printf("Warning: failed to enable TTL on DynamoDB table %s: %v", table, err)
+	}
+
+	log.Printf("Created DynamoDB table %s", table)
+	return nil
+}
+
 func (d *DynamoDBClient) PutRedirect(redirect *RedirectRecord) error {
 	log.Printf("PutRedirect called with code: %s, table: %s", redirect.Code, d.table)
 	av, err := attributevalue.MarshalMap(redirect)
@@ -121,24 +333,50 @@ func (d *DynamoDBClient) GetRedirect(code string) (*RedirectRecord, error) {
 			// Cache hit with valid TTL, return cached value
 			log.Printf("Cache hit for code %s", code)
 			return &RedirectRecord{
-				Code:    code,
-				Typ:     cached.Typ,
-				Val:     cached.Val,
-				Ettl:    cached.DynamoTTL,
-				Created: cached.Created,
-				IP:      cached.IP,
-				Owner:   cached.Owner,
+				Code:     code,
+				Typ:      cached.Typ,
+				Val:      cached.Val,
+				Ettl:     cached.DynamoTTL,
+				Created:  cached.Created,
+				IP:       cached.IP,
+				Owner:    cached.Owner,
+				PassHash: cached.PassHash,
+				Enc:      cached.Enc,
+				Redir:    cached.Redir,
+				Size:     cached.Size,
+				Hash:     cached.Hash,
+				DelHash:  cached.DelHash,
+				Rev:      cached.Rev,
+				Updated:  cached.Updated,
+				Revs:     cached.Revs,
+				BlobTag:  cached.BlobTag,
+				Parent:   cached.Parent,
+				Filename: cached.Filename,
+				Mime:     cached.Mime,
+				Lang:     cached.Lang,
+				Files:    cached.Files,
 			}, nil
 		}
 	}
 
 	// Cache miss or expired, query DynamoDB
 	log.Printf("Cache miss for code %s, querying DynamoDB", code)
+	return d.fetchRedirect(code, false)
+}
+
+func (d *DynamoDBClient) GetRedirectFresh(code string) (*RedirectRecord, error) {
+	d.cache.Remove(code)
+	return d.fetchRedirect(code, true)
+}
+
+// fetchRedirect reads a record from DynamoDB and caches it if it can be
+func (d *DynamoDBClient) fetchRedirect(code string, consistent bool) (*RedirectRecord, error) {
 	result, err := d.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
 		TableName: aws.String(d.table),
 		Key: map[string]types.AttributeValue{
 			"code": &types.AttributeValueMemberS{Value: code},
 		},
+		ConsistentRead: aws.Bool(consistent),
 	})
 
 	if err != nil {
@@ -155,6 +393,13 @@ func (d *DynamoDBClient) GetRedirect(code string) (*RedirectRecord, error) {
 		return nil, err
 	}
 
+	// Burn-after-reading and view-limited records are never cached: another
+	// replica may consume the record at any moment and a cached copy would
+	// serve it again
+	if record.Burn || record.MaxViews > 0 {
+		return &record, nil
+	}
+
 	// Cache the result for 1 hour
 	cached := &CachedRecord{
 		Val:       record.Val,
@@ -163,6 +408,21 @@ func (d *DynamoDBClient) GetRedirect(code string) (*RedirectRecord, error) {
 		Created:   record.Created,
 		IP:        record.IP,
 		Owner:     record.Owner,
+		PassHash:  record.PassHash,
+		Enc:       record.Enc,
+		Redir:     record.Redir,
+		Size:      record.Size,
+		Hash:      record.Hash,
+		DelHash:   record.DelHash,
+		Rev:       record.Rev,
+		Updated:   record.Updated,
+		Revs:      record.Revs,
+		BlobTag:   record.BlobTag,
+		Parent:    record.Parent,
+		Filename:  record.Filename,
+		Mime:      record.Mime,
+		Lang:      record.Lang,
+		Files:     record.Files,
 	}
 	d.cache.Add(code, cached)
 	log.Printf("Cached redirect for code %s", code)
@@ -209,11 +469,278 @@ func (d *DynamoDBClient) DeleteRedirect(code string, ownerID string) error {
 
 	// Remove from cache
 	d.cache.Remove(code)
+	deleteBlob(d.blobs, record)
 	log.Printf("Successfully deleted redirect for code: %s", code)
 
 	return nil
 }
 
+func (d *DynamoDBClient) ConsumeRedirect(code string) (*RedirectRecord, error) {
+	log.Printf("ConsumeRedirect called with code: %s", code)
+
+	// The conditional delete is the atomic gate: only one reader across all
+	// replicas gets the old item back
+	result, err := d.client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		ConditionExpression: aws.String("attribute_exists(code)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	})
+	d.cache.Remove(code)
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			log.Printf("ConsumeRedirect lost the race or record gone for code: %s", code)
+			return nil, nil
+		}
+		log.Printf("DynamoDB DeleteItem failed: %v", err)
+		return nil, err
+	}
+
+	var record RedirectRecord
+	if err := attributevalue.UnmarshalMap(result.Attributes, &record); err != nil {
+		return nil, err
+	}
+
+	// DynamoDB TTL deletion lags, so an expired item may still have been there
+	if record.Ettl > 0 && time.Now().Unix() > record.Ettl {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (d *DynamoDBClient) RecordView(code string) (*RedirectRecord, error) {
+	now := time.Now().Unix()
+	result, err := d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		UpdateExpression: aws.String("SET #views = if_not_exists(#views, :zero) + :one"),
+		ConditionExpression: aws.String("attribute_exists(code) AND maxviews > :zero AND " +
+			"(attribute_not_exists(#views) OR #views < maxviews) AND " +
+			"(attribute_not_exists(ettl) OR ettl >= :now)"),
+		ExpressionAttributeNames: map[string]string{"#views": "views"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			log.Printf("RecordView: code %s is gone or out of views", code)
+			return nil, nil
+		}
+		log.Printf("DynamoDB UpdateItem failed: %v", err)
+		return nil, err
+	}
+
+	var record RedirectRecord
+	if err := attributevalue.UnmarshalMap(result.Attributes, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (d *DynamoDBClient) SetSize(code string, size int64, hash string) error {
+	_, err := d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		// size and hash are DynamoDB reserved words
+		UpdateExpression:         aws.String("SET #size = :size, #hash = :hash"),
+		ConditionExpression:      aws.String("attribute_exists(code)"),
+		ExpressionAttributeNames: map[string]string{"#size": "size", "#hash": "hash"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":size": &types.AttributeValueMemberN{Value: strconv.FormatInt(size, 10)},
+			":hash": &types.AttributeValueMemberS{Value: hash},
+		},
+	})
+	if err != nil {
+		log.Printf("DynamoDB UpdateItem failed: %v", err)
+		return err
+	}
+	d.cache.Remove(code)
+	return nil
+}
+
+func (d *DynamoDBClient) SetFiles(code string, files BundleFiles) error {
+	manifest, err := attributevalue.Marshal(files)
+	if err != nil {
+		return err
+	}
+	_, err = d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		UpdateExpression:         aws.String("SET typ = :typ, val = :val, files = :files, #size = :size REMOVE filename, mime, lang, #hash"),
+		ConditionExpression:      aws.String("attribute_exists(code)"),
+		ExpressionAttributeNames: map[string]string{"#size": "size", "#hash": "hash"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":typ":   &types.AttributeValueMemberS{Value: "B"},
+			":val":   &types.AttributeValueMemberS{Value: ""},
+			":files": manifest,
+			":size":  &types.AttributeValueMemberN{Value: strconv.FormatInt(files.Size(), 10)},
+		},
+	})
+	if err != nil {
+		log.Printf("DynamoDB UpdateItem failed: %v", err)
+		return err
+	}
+	d.cache.Remove(code)
+	return nil
+}
+
+func (d *DynamoDBClient) ReviseRedirect(record *RedirectRecord, ownerID string) error {
+	log.Printf("ReviseRedirect called with code: %s, revision: %d", record.Code, record.Rev)
+
+	revs, err := attributevalue.Marshal(record.Revs)
+	if err != nil {
+		return err
+	}
+
+	// The revision check makes concurrent edits fail instead of one silently
+	// overwriting the other. Revision 1 is stored without a rev attribute.
+	revCondition := "#rev = :prev"
+	values := map[string]types.AttributeValue{
+		":owner":   &types.AttributeValueMemberS{Value: ownerID},
+		":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		":typ":     &types.AttributeValueMemberS{Value: record.Typ},
+		":val":     &types.AttributeValueMemberS{Value: record.Val},
+		":size":    &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Size, 10)},
+		":hash":    &types.AttributeValueMemberS{Value: record.Hash},
+		":blobtag": &types.AttributeValueMemberS{Value: record.BlobTag},
+		":rev":     &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Rev, 10)},
+		":updated": &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Updated, 10)},
+		":revs":    revs,
+	}
+	if record.Rev == 2 {
+		revCondition = "attribute_not_exists(#rev)"
+	} else {
+		values[":prev"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Rev-1, 10)}
+	}
+
+	// Only the content fields are written, so views counted meanwhile are kept
+	_, err = d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: record.Code},
+		},
+		UpdateExpression: aws.String("SET #typ = :typ, #val = :val, #size = :size, #hash = :hash, blobtag = :blobtag, #rev = :rev, #updated = :updated, #revs = :revs"),
+		ConditionExpression: aws.String("#owner = :owner AND " + revCondition + " AND " +
+			"(attribute_not_exists(ettl) OR ettl >= :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner":   "owner",
+			"#typ":     "typ",
+			"#val":     "val",
+			"#size":    "size",
+			"#hash":    "hash",
+			"#rev":     "rev",
+			"#updated": "updated",
+			"#revs":    "revs",
+		},
+		ExpressionAttributeValues: values,
+	})
+
+	// Only this replica's cache can be evicted; others may serve the previous
+	// revision until their cached copy expires
+	d.cache.Remove(record.Code)
+	if err != nil {
+		log.Printf("DynamoDB UpdateItem failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (d *DynamoDBClient) TakeQuota(key string, limit int64, window time.Duration) (bool, error) {
+	now := time.Now()
+	nowAttr := &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)}
+
+	// Quota counters live in the same table as type "Q" items, using keys that
+	// can never be valid codes; the views attribute holds the count and the
+	// TTL on ettl clears them out once their window has passed
+	for attempt := 0; attempt < 2; attempt++ {
+		// Count against the live window
+		_, err := d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			TableName: aws.String(d.table),
+			Key: map[string]types.AttributeValue{
+				"code": &types.AttributeValueMemberS{Value: key},
+			},
+			UpdateExpression:         aws.String("SET #views = #views + :one"),
+			ConditionExpression:      aws.String("attribute_exists(code) AND ettl >= :now AND #views < :limit"),
+			ExpressionAttributeNames: map[string]string{"#views": "views"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":one":   &types.AttributeValueMemberN{Value: "1"},
+				":now":   nowAttr,
+				":limit": &types.AttributeValueMemberN{Value: strconv.FormatInt(limit, 10)},
+			},
+		})
+		var ccf *types.ConditionalCheckFailedException
+		if err == nil {
+			return true, nil
+		}
+		if !errors.As(err, &ccf) {
+			return false, err
+		}
+
+		// No live window, or it is full: start a new window unless a live one exists
+		item, err := attributevalue.MarshalMap(&RedirectRecord{
+			Code:  key,
+			Typ:   "Q",
+			Ettl:  now.Add(window).Unix(),
+			Views: 1,
+		})
+		if err != nil {
+			return false, err
+		}
+		_, err = d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName:                 aws.String(d.table),
+			Item:                      item,
+			ConditionExpression:       aws.String("attribute_not_exists(code) OR ettl < :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":now": nowAttr},
+		})
+		if err == nil {
+			return true, nil
+		}
+		if !errors.As(err, &ccf) {
+			return false, err
+		}
+		// A live window exists; it is either full or another request just
+		// created it, so go round once more to find out which
+	}
+	return false, nil
+}
+
+func (d *DynamoDBClient) RefundQuota(key string) error {
+	_, err := d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression:         aws.String("SET #views = #views - :one"),
+		ConditionExpression:      aws.String("attribute_exists(code) AND ettl >= :now AND #views > :zero"),
+		ExpressionAttributeNames: map[string]string{"#views": "views"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// The window has passed, so there is nothing to give back
+		return nil
+	}
+	return err
+}
+
 func (d *DynamoDBClient) GetCacheSize() int {
 	return d.cache.Len()
 }
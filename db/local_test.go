@@ -0,0 +1,323 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalDBClient(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir()}
+	client, err := NewLocalDBClient(cfg, nil)
+	require.NoError(t, err)
+
+	future := time.Now().Add(time.Hour).Unix()
+
+	t.Run("Put and get", func(t *testing.T) {
+		err := client.PutRedirect(&RedirectRecord{Code: "abcd", Typ: "D", Val: "hello", Ettl: future, Owner: "owner1"})
+		assert.NoError(t, err)
+
+		record, err := client.GetRedirect("abcd")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "hello", record.Val)
+		assert.Equal(t, "owner1", record.Owner)
+	})
+
+	t.Run("Duplicate code is rejected", func(t *testing.T) {
+		err := client.PutRedirect(&RedirectRecord{Code: "abcd", Typ: "D", Val: "other", Ettl: future})
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(err, &ccf))
+
+		record, _ := client.GetRedirect("abcd")
+		assert.Equal(t, "hello", record.Val)
+	})
+
+	t.Run("Missing code returns nil", func(t *testing.T) {
+		record, err := client.GetRedirect("nope")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Path traversal is not found", func(t *testing.T) {
+		record, err := client.GetRedirect("../meta")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Expired record is hidden and can be reused", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute).Unix()
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "old1", Typ: "D", Val: "stale", Ettl: past}))
+
+		record, err := client.GetRedirect("old1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "old1", Typ: "D", Val: "fresh", Ettl: future}))
+		record, _ = client.GetRedirect("old1")
+		require.NotNil(t, record)
+		assert.Equal(t, "fresh", record.Val)
+	})
+
+	t.Run("Delete requires owner", func(t *testing.T) {
+		var ccf *types.ConditionalCheckFailedException
+		err := client.DeleteRedirect("abcd", "someone-else")
+		assert.True(t, errors.As(err, &ccf))
+
+		assert.NoError(t, client.DeleteRedirect("abcd", "owner1"))
+		record, _ := client.GetRedirect("abcd")
+		assert.Nil(t, record)
+
+		err = client.DeleteRedirect("abcd", "owner1")
+		assert.True(t, errors.As(err, &ccf))
+	})
+
+	t.Run("Consume returns the record exactly once", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "brn1", Typ: "D", Val: "secret", Ettl: future, Burn: true}))
+
+		record, err := client.ConsumeRedirect("brn1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "secret", record.Val)
+		assert.True(t, record.Burn)
+
+		record, err = client.ConsumeRedirect("brn1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+
+		record, _ = client.GetRedirect("brn1")
+		assert.Nil(t, record)
+	})
+
+	t.Run("Record view stops at the limit", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "lim1", Typ: "D", Val: "limited", Ettl: future, MaxViews: 2}))
+
+		for want := int64(1); want <= 2; want++ {
+			record, err := client.RecordView("lim1")
+			assert.NoError(t, err)
+			require.NotNil(t, record)
+			assert.Equal(t, want, record.Views)
+		}
+
+		record, err := client.RecordView("lim1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+
+		// Unlimited records are never counted
+		record, err = client.RecordView("old1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Set size", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "siz1", Typ: "S", Ettl: future, DelHash: "abc123"}))
+		assert.NoError(t, client.SetSize("siz1", 4096, "c0ffee"))
+
+		record, err := client.GetRedirect("siz1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, int64(4096), record.Size)
+		assert.Equal(t, "c0ffee", record.Hash)
+		assert.Equal(t, "abc123", record.DelHash)
+	})
+
+	t.Run("Set size or files on a missing record", func(t *testing.T) {
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(client.SetSize("gone", 4096, "c0ffee"), &ccf))
+		assert.True(t, errors.As(client.SetFiles("gone", BundleFiles{{Name: "main.go", Size: 12}}), &ccf))
+
+		record, err := client.GetRedirect("gone")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Set files", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "bnd1", Typ: "D", Val: "package main", Ettl: future, Filename: "main.go", Size: 12}))
+		files := BundleFiles{{Name: "main.go", Size: 12}, {Name: "logo.png", Size: 300, Mime: "image/png"}}
+		assert.NoError(t, client.SetFiles("bnd1", files))
+
+		record, err := client.GetRedirect("bnd1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "B", record.Typ)
+		assert.Empty(t, record.Val)
+		assert.Empty(t, record.Filename)
+		assert.Equal(t, files, record.Files)
+		assert.Equal(t, int64(312), record.Size)
+		assert.Equal(t, 1, record.Files.Index("logo.png"))
+	})
+
+	t.Run("Revise requires owner and the current revision", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "rev1", Typ: "D", Val: "first", Ettl: future, Owner: "owner1", MaxViews: 5}))
+		_, err := client.RecordView("rev1")
+		assert.NoError(t, err)
+
+		revised := &RedirectRecord{Code: "rev1", Typ: "D", Val: "second", Size: 6, Rev: 2, Updated: 5678,
+			Revs: Revisions{{Rev: 1, Created: 1234, Size: 5}}}
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(client.ReviseRedirect(revised, "someone-else"), &ccf))
+		assert.NoError(t, client.ReviseRedirect(revised, "owner1"))
+
+		// Revision 2 is taken now, so a second edit based on revision 1 fails
+		assert.True(t, errors.As(client.ReviseRedirect(revised, "owner1"), &ccf))
+
+		record, err := client.GetRedirect("rev1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "second", record.Val)
+		assert.Equal(t, int64(2), record.Revision())
+		assert.Equal(t, int64(5678), record.Updated)
+		assert.Equal(t, Revisions{{Rev: 1, Created: 1234, Size: 5}}, record.Revs)
+		assert.Equal(t, int64(1), record.Views, "views counted before the edit are kept")
+
+		revised.Rev, revised.Val = 3, "third"
+		revised.Revs = append(revised.Revs, Revision{Rev: 2, Created: 5678, Size: 6})
+		assert.NoError(t, client.ReviseRedirect(revised, "owner1"))
+		record, _ = client.GetRedirect("rev1")
+		require.NotNil(t, record)
+		assert.Equal(t, "third", record.Val)
+		assert.Len(t, record.Revs, 2)
+	})
+
+	t.Run("Sweep removes expired records", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute).Unix()
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "exp1", Typ: "D", Ettl: past}))
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "live", Typ: "D", Ettl: future}))
+
+		removed, err := client.(*LocalDBClient).SweepExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, removed)
+
+		record, _ := client.GetRedirect("live")
+		assert.NotNil(t, record)
+	})
+
+	t.Run("Sweep keeps a record replaced since it looked", func(t *testing.T) {
+		local := client.(*LocalDBClient)
+		past := time.Now().Add(-time.Minute).Unix()
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "exp2", Typ: "D", Ettl: past}))
+		path, _ := local.recordPath("exp2")
+
+		// The sweep saw exp2 expired, then the code was reused before it removed it
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "exp2", Typ: "D", Val: "fresh", Ettl: future}))
+		assert.False(t, local.removeIfExpired(path, time.Now().Unix()))
+
+		record, _ := client.GetRedirect("exp2")
+		require.NotNil(t, record)
+		assert.Equal(t, "fresh", record.Val)
+	})
+}
+
+func TestLocalS3Client(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir()}
+	client, err := NewLocalS3Client(cfg)
+	require.NoError(t, err)
+
+	data := []byte(strings.Repeat("large paste content ", 1000))
+	assert.NoError(t, client.PutObject("S/abcd.zst", data))
+
+	got, err := client.GetObject("S/abcd.zst")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = client.GetObject("S/nope.zst")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "NoSuchKey")
+
+	assert.Error(t, client.PutObject("../escape.zst", data))
+}
+
+func TestLocalDeleteRemovesBlob(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir()}
+	blobs, err := NewLocalS3Client(cfg)
+	require.NoError(t, err)
+	client, err := NewLocalDBClient(cfg, blobs)
+	require.NoError(t, err)
+
+	// Revision 1 at the original key, revision 2 current
+	assert.NoError(t, blobs.PutObject(BlobKey("big1"), []byte("large content")))
+	assert.NoError(t, blobs.PutObject(RevisionBlobKey("big1", 2), []byte("larger content")))
+	assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "big1", Typ: "S", Owner: "owner1", Rev: 2, Revs: Revisions{{Rev: 1}}}))
+
+	assert.NoError(t, client.DeleteRedirect("big1", "owner1"))
+
+	_, err = blobs.GetObject(BlobKey("big1"))
+	assert.Error(t, err)
+
+	var keys []string
+	assert.NoError(t, blobs.ListObjects(BlobPrefix, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}))
+	assert.Empty(t, keys)
+}
+
+func TestLocalS3ClientStream(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir()}
+	client, err := NewLocalS3Client(cfg)
+	require.NoError(t, err)
+
+	data := strings.Repeat("streamed paste content ", 5000)
+	n, err := client.PutObjectStream("S/strm.zst", strings.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// Streamed and buffered blobs use the same format
+	got, err := client.GetObject("S/strm.zst")
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(got))
+
+	rc, err := client.GetObjectStream("S/strm.zst")
+	require.NoError(t, err)
+	streamed, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, data, string(streamed))
+
+	// A failing source must not leave a partial blob behind
+	_, err = client.PutObjectStream("S/fail.zst", iotest.ErrReader(errors.New("boom")))
+	assert.EqualError(t, err, "boom")
+	_, err = client.GetObjectStream("S/fail.zst")
+	assert.Contains(t, err.Error(), "NoSuchKey")
+}
+
+func TestLocalTakeQuota(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir()}
+	client, err := NewLocalDBClient(cfg, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		ok, err := client.TakeQuota("_quota_test", 2, time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, err := client.TakeQuota("_quota_test", 2, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A use given back can be taken again, but only once
+	assert.NoError(t, client.RefundQuota("_quota_test"))
+	ok, err = client.TakeQuota("_quota_test", 2, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = client.TakeQuota("_quota_test", 2, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, client.RefundQuota("_quota_none"))
+
+	// An expired window starts over
+	for i := 0; i < 2; i++ {
+		ok, err = client.TakeQuota("_quota_short", 1, -time.Second)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
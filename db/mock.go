@@ -1,6 +1,10 @@
 package db
 
 import (
+	"bytes"
+	"io"
+	"time"
+
 	"github.com/stretchr/testify/mock"
 )
 
@@ -21,11 +25,60 @@ func (m *MockDB) GetRedirect(code string) (*RedirectRecord, error) {
 	return args.Get(0).(*RedirectRecord), args.Error(1)
 }
 
+func (m *MockDB) GetRedirectFresh(code string) (*RedirectRecord, error) {
+	args := m.Called(code)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*RedirectRecord), args.Error(1)
+}
+
 func (m *MockDB) DeleteRedirect(code string, ownerID string) error {
 	args := m.Called(code, ownerID)
 	return args.Error(0)
 }
 
+func (m *MockDB) ConsumeRedirect(code string) (*RedirectRecord, error) {
+	args := m.Called(code)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*RedirectRecord), args.Error(1)
+}
+
+func (m *MockDB) RecordView(code string) (*RedirectRecord, error) {
+	args := m.Called(code)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*RedirectRecord), args.Error(1)
+}
+
+func (m *MockDB) SetSize(code string, size int64, hash string) error {
+	args := m.Called(code, size, hash)
+	return args.Error(0)
+}
+
+func (m *MockDB) SetFiles(code string, files BundleFiles) error {
+	args := m.Called(code, files)
+	return args.Error(0)
+}
+
+func (m *MockDB) ReviseRedirect(record *RedirectRecord, ownerID string) error {
+	args := m.Called(record, ownerID)
+	return args.Error(0)
+}
+
+func (m *MockDB) TakeQuota(key string, limit int64, window time.Duration) (bool, error) {
+	args := m.Called(key, limit, window)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockDB) RefundQuota(key string) error {
+	args := m.Called(key)
+	return args.Error(0)
+}
+
 func (m *MockDB) GetCacheSize() int {
 	args := m.Called()
 	return args.Int(0)
@@ -48,3 +101,38 @@ func (m *MockS3) GetObject(key string) ([]byte, error) {
 	}
 	return args.Get(0).([]byte), args.Error(1)
 }
+
+func (m *MockS3) DeleteObject(key string) error {
+	args := m.Called(key)
+	return args.Error(0)
+}
+
+func (m *MockS3) ListObjects(prefix string, fn func(ObjectInfo) error) error {
+	args := m.Called(prefix)
+	if objects, ok := args.Get(0).([]ObjectInfo); ok {
+		for _, obj := range objects {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return args.Error(1)
+}
+
+// PutObjectStream drains r so expectations can match on the streamed content
+func (m *MockS3) PutObjectStream(key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	args := m.Called(key, data)
+	return int64(len(data)), args.Error(0)
+}
+
+func (m *MockS3) GetObjectStream(key string) (io.ReadCloser, error) {
+	args := m.Called(key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return io.NopCloser(bytes.NewReader(args.Get(0).([]byte))), args.Error(1)
+}
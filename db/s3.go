@@ -3,12 +3,21 @@ package db
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	xipeconfig "github.com/drewstreib/xipe-go/config"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/klauspost/compress/zstd"
 )
 
@@ -16,23 +25,148 @@ import (
 type S3Interface interface {
 	PutObject(key string, data []byte) error
 	GetObject(key string) ([]byte, error)
+	PutObjectStream(key string, r io.Reader) (int64, error)
+	GetObjectStream(key string) (io.ReadCloser, error)
+	DeleteObject(key string) error
+	ListObjects(prefix string, fn func(ObjectInfo) error) error
+}
+
+// ObjectInfo describes a stored object as reported by ListObjects
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// BlobPrefix is the key prefix under which type "S" paste content is stored
+const BlobPrefix = "S/"
+
+// BlobKey returns the object key holding the content of a type "S" paste
+func BlobKey(code string) string {
+	return BlobPrefix + code + ".zst"
+}
+
+// RevisionBlobKey returns the object key holding one revision of a paste.
+// Revision 1 keeps the original BlobKey so pastes from before revisions
+// existed need no migration.
+func RevisionBlobKey(code string, rev int64) string {
+	if rev <= 1 {
+		return BlobKey(code)
+	}
+	return BlobPrefix + code + "@" + strconv.FormatInt(rev, 10) + ".zst"
+}
+
+// EditBlobKey returns the object key an edit uploads revision rev to. Each
+// attempt has its own random tag, so edits racing for the same revision never
+// write the same object, and only the one whose record is stored names its
+// blob. An empty tag is the plain RevisionBlobKey.
+func EditBlobKey(code string, rev int64, tag string) string {
+	if tag == "" {
+		return RevisionBlobKey(code, rev)
+	}
+	return BlobPrefix + code + "@" + strconv.FormatInt(rev, 10) + "-" + tag + ".zst"
+}
+
+// FileBlobKey returns the object key holding file n of a multi-file paste.
+// The first file keeps the original BlobKey, so an upload that turns out to
+// have more files needs nothing moved.
+func FileBlobKey(code string, n int) string {
+	if n == 0 {
+		return BlobKey(code)
+	}
+	return BlobPrefix + code + "/" + strconv.Itoa(n) + ".zst"
+}
+
+// BlobKeys returns every object key holding content of record: its earlier
+// revisions and, for type "S", the current one, or the files of type "B"
+func BlobKeys(record *RedirectRecord) []string {
+	var keys []string
+	for _, rev := range record.Revs {
+		keys = append(keys, EditBlobKey(record.Code, rev.Rev, rev.BlobTag))
+	}
+	switch record.Typ {
+	case "S":
+		keys = append(keys, EditBlobKey(record.Code, record.Revision(), record.BlobTag))
+	case "B":
+		for n := range record.Files {
+			keys = append(keys, FileBlobKey(record.Code, n))
+		}
+	}
+	return keys
+}
+
+// deleteBlob removes the blobs of a record once its metadata is gone.
+// Failures are only logged; the garbage collector reclaims anything left behind.
+func deleteBlob(blobs S3Interface, record *RedirectRecord) {
+	if blobs == nil || record == nil {
+		return
+	}
+	for _, key := range BlobKeys(record) {
+		if err := blobs.DeleteObject(key); err != nil {
+			log.Printf("Failed to delete blob %s for code %s, leaving it for GC: %v", key, record.Code, err)
+		}
+	}
+}
+
+// CodeFromBlobKey is the inverse of BlobKey, RevisionBlobKey, EditBlobKey and
+// FileBlobKey
+func CodeFromBlobKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, BlobPrefix) || !strings.HasSuffix(key, ".zst") {
+		return "", false
+	}
+	code := strings.TrimSuffix(strings.TrimPrefix(key, BlobPrefix), ".zst")
+	code, file, isFile := strings.Cut(code, "/")
+	if isFile {
+		if n, err := strconv.Atoi(file); err != nil || n < 1 {
+			return "", false
+		}
+	}
+	code, rev, isRevision := strings.Cut(code, "@")
+	if isRevision {
+		rev, tag, isEdit := strings.Cut(rev, "-")
+		if isEdit && tag == "" {
+			return "", false
+		}
+		if n, err := strconv.ParseInt(rev, 10, 64); err != nil || n < 2 {
+			return "", false
+		}
+	}
+	if code == "" || strings.Contains(code, "/") {
+		return "", false
+	}
+	return code, true
 }
 
 // S3Client implements S3Interface for real S3 operations
 type S3Client struct {
-	client  *s3.Client
-	bucket  string
-	encoder *zstd.Encoder
-	decoder *zstd.Decoder
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+	encoder  *zstd.Encoder
+	decoder  *zstd.Decoder
 }
 
 // NewS3Client creates a new S3 client
-func NewS3Client() (*S3Client, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+func NewS3Client(cfg *xipeconfig.Config) (*S3Client, error) {
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(cfg.AWSRegion))
 	if err != nil {
 		return nil, err
 	}
 
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		o.UsePathStyle = cfg.S3UsePathStyle
+	})
+
+	if cfg.AWSVerifyResources || cfg.AWSCreateResources {
+		if err := ensureS3Bucket(context.TODO(), client, cfg.S3Bucket, cfg.AWSRegion, cfg.AWSCreateResources); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create zstd encoder with level 3 compression
 	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(3)))
 	if err != nil {
@@ -45,14 +179,59 @@ func NewS3Client() (*S3Client, error) {
 		return nil, err
 	}
 
+	log.Printf("S3 client initialized for bucket: %s (prefix %q)", cfg.S3Bucket, cfg.S3KeyPrefix)
+	// A single in-flight part keeps streaming uploads to ~5MB of buffer
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.Concurrency = 1
+	})
+
 	return &S3Client{
-		client:  s3.NewFromConfig(cfg),
-		bucket:  "xipe-data",
-		encoder: encoder,
-		decoder: decoder,
+		client:   client,
+		uploader: uploader,
+		bucket:   cfg.S3Bucket,
+		prefix:   cfg.S3KeyPrefix,
+		encoder:  encoder,
+		decoder:  decoder,
 	}, nil
 }
 
+// ensureS3Bucket verifies that the bucket exists, optionally creating it when it is missing
+func ensureS3Bucket(ctx context.Context, client *s3.Client, bucket, region string, create bool) error {
+	_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		log.Printf("Verified S3 bucket %s exists", bucket)
+		return nil
+	}
+
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to access S3 bucket %s: %w", bucket, err)
+	}
+	if !create {
+		return fmt.Errorf("S3 bucket %s does not exist (set AWS_CREATE_RESOURCES=true to create it)", bucket)
+	}
+
+	log.Printf("S3 bucket %s not found, creating it", bucket)
+	input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	// us-east-1 is the default location and must not be sent as a constraint
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	if _, err := client.CreateBucket(ctx, input); err != nil {
+		return fmt.Errorf("failed to create S3 bucket %s: %w", bucket, err)
+	}
+
+	log.Printf("Created S3 bucket %s", bucket)
+	return nil
+}
+
+// objectKey applies the configured key prefix
+func (s *S3Client) objectKey(key string) string {
+	return s.prefix + key
+}
+
 // PutObject stores compressed data in S3
 func (s *S3Client) PutObject(key string, data []byte) error {
 	// Compress data using zstd level 3
@@ -65,7 +244,7 @@ func (s *S3Client) PutObject(key string, data []byte) error {
 
 	_, err := s.client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(s.objectKey(key)),
 		Body:   bytes.NewReader(compressedData),
 	})
 	if err != nil {
@@ -81,7 +260,7 @@ func (s *S3Client) PutObject(key string, data []byte) error {
 func (s *S3Client) GetObject(key string) ([]byte, error) {
 	result, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+		Key:    aws.String(s.objectKey(key)),
 	})
 	if err != nil {
 		log.Printf("Failed to get object %s from S3: %v", key, err)
@@ -116,3 +295,142 @@ func (s *S3Client) GetObject(key string) ([]byte, error) {
 		key, compressedSize, decompressedSize, compressionRatio)
 	return decompressedData, nil
 }
+
+// PutObjectStream compresses r on the fly into a multipart upload, so the
+// content never has to be held in memory. It returns the number of
+// uncompressed bytes stored. Errors from r are returned unwrapped.
+func (s *S3Client) PutObjectStream(key string, r io.Reader) (int64, error) {
+	src := &countingReader{r: r}
+	pr, pw := io.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		enc, err := newStreamEncoder(pw)
+		if err == nil {
+			_, err = io.Copy(enc, src)
+			if closeErr := enc.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	_, err := s.uploader.Upload(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+		Body:   pr,
+	})
+	// Unblock the encoder if the upload stopped reading early
+	_ = pr.CloseWithError(err)
+	<-done
+
+	if src.err != nil {
+		log.Printf("Failed to read stream for object %s: %v", key, src.err)
+		return src.n, src.err
+	}
+	if err != nil {
+		log.Printf("Failed to stream object %s to S3: %v", key, err)
+		return src.n, err
+	}
+	log.Printf("Successfully streamed object %s to S3 (%d bytes uncompressed)", key, src.n)
+	return src.n, nil
+}
+
+// GetObjectStream returns a reader that decompresses the object as it is read
+func (s *S3Client) GetObjectStream(key string) (io.ReadCloser, error) {
+	result, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		log.Printf("Failed to get object %s from S3: %v", key, err)
+		return nil, err
+	}
+	return newStreamDecoder(result.Body)
+}
+
+// DeleteObject removes an object from S3. Deleting a missing key is not an error.
+func (s *S3Client) DeleteObject(key string) error {
+	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		log.Printf("Failed to delete object %s from S3: %v", key, err)
+		return err
+	}
+	log.Printf("Successfully deleted object %s from S3", key)
+	return nil
+}
+
+// ListObjects calls fn for every object whose key starts with prefix.
+// Keys are reported without the configured key prefix.
+func (s *S3Client) ListObjects(prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.objectKey(prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Printf("Failed to list objects with prefix %s in S3: %v", prefix, err)
+			return err
+		}
+		for _, obj := range page.Contents {
+			info := ObjectInfo{
+				Key:  strings.TrimPrefix(aws.ToString(obj.Key), s.prefix),
+				Size: aws.ToInt64(obj.Size),
+			}
+			if obj.LastModified != nil {
+				info.LastModified = *obj.LastModified
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newStreamEncoder creates a single-threaded zstd writer matching the level used by PutObject
+func newStreamEncoder(w io.Writer) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevel(3)), zstd.WithEncoderConcurrency(1))
+}
+
+// newStreamDecoder wraps a compressed body in a decompressing ReadCloser that closes both
+func newStreamDecoder(body io.ReadCloser) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	return &decoderReadCloser{Decoder: dec, body: body}, nil
+}
+
+type decoderReadCloser struct {
+	*zstd.Decoder
+	body io.ReadCloser
+}
+
+func (d *decoderReadCloser) Close() error {
+	d.Decoder.Close()
+	return d.body.Close()
+}
+
+// countingReader counts bytes read and remembers the first non-EOF error, so
+// callers can tell source failures apart from storage failures
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,387 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	_ "modernc.org/sqlite" // Pure Go SQLite driver, keeps CGO_ENABLED=0 builds working
+)
+
+// sqliteMigrations are applied in order, tracked through PRAGMA user_version.
+// Append new statements to the end; never edit ones that have shipped.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS redirects (
+		code    TEXT PRIMARY KEY,
+		typ     TEXT NOT NULL,
+		val     TEXT NOT NULL DEFAULT '',
+		ettl    INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL DEFAULT 0,
+		ip      TEXT NOT NULL DEFAULT '',
+		owner   TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS redirects_ettl ON redirects (ettl) WHERE ettl > 0`,
+	`ALTER TABLE redirects ADD COLUMN burn INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN maxviews INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN views INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN pwhash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN enc INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN redir INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN size INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN delhash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN rev INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN updated INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE redirects ADD COLUMN revs TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN parent TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN filename TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN mime TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN files TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN lang TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN hash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE redirects ADD COLUMN blobtag TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqliteColumns lists the redirects columns in the order returned by sqliteFields
+const sqliteColumns = "code, typ, val, ettl, created, ip, owner, burn, maxviews, views, pwhash, enc, redir, size, delhash, rev, updated, revs, parent, filename, mime, files, lang, hash, blobtag"
+
+// sqliteFields returns pointers to the record fields matching sqliteColumns,
+// usable both as Scan destinations and as insert arguments
+func sqliteFields(r *RedirectRecord) []any {
+	return []any{&r.Code, &r.Typ, &r.Val, &r.Ettl, &r.Created, &r.IP, &r.Owner, &r.Burn, &r.MaxViews, &r.Views, &r.PassHash, &r.Enc, &r.Redir, &r.Size, &r.DelHash, &r.Rev, &r.Updated, &r.Revs, &r.Parent, &r.Filename, &r.Mime, &r.Files, &r.Lang, &r.Hash, &r.BlobTag}
+}
+
+// Value stores revisions as JSON in the revs TEXT column
+func (r Revisions) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan reads revisions back from the revs column
+func (r *Revisions) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case nil:
+	default:
+		return fmt.Errorf("cannot scan %T into Revisions", src)
+	}
+	if len(data) == 0 {
+		*r = nil
+		return nil
+	}
+	return json.Unmarshal(data, r)
+}
+
+// Value stores a multi-file manifest as JSON in the files TEXT column
+func (f BundleFiles) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan reads a multi-file manifest back from the files column
+func (f *BundleFiles) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case nil:
+	default:
+		return fmt.Errorf("cannot scan %T into BundleFiles", src)
+	}
+	if len(data) == 0 {
+		*f = nil
+		return nil
+	}
+	return json.Unmarshal(data, f)
+}
+
+// SQLiteDBClient implements DBInterface on an embedded SQLite database.
+// Unlike DynamoDB, SQLite has no native TTL, so a background sweeper deletes
+// rows whose ettl has passed and every query filters out expired rows.
+type SQLiteDBClient struct {
+	db    *sql.DB
+	blobs S3Interface // Blob store cleaned up when type "S" records are deleted
+}
+
+// NewSQLiteDBClient opens (creating if needed) the SQLite database at cfg.SQLitePath
+func NewSQLiteDBClient(cfg *config.Config, blobs S3Interface) (DBInterface, error) {
+	path := cfg.SQLitePath
+	if path == "" {
+		path = filepath.Join(cfg.DataDir, "xipe.db")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	sqlDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateSQLite(sqlDB); err != nil {
+		_ = sqlDB.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	client := &SQLiteDBClient{db: sqlDB, blobs: blobs}
+	if cfg.SweepInterval > 0 {
+		go client.sweepLoop(time.Duration(cfg.SweepInterval) * time.Second)
+	}
+
+	log.Printf("SQLite metadata store initialized at %s", path)
+	return client, nil
+}
+
+func migrateSQLite(sqlDB *sql.DB) error {
+	var version int
+	if err := sqlDB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		if _, err := sqlDB.Exec(sqliteMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := sqlDB.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDBClient) PutRedirect(redirect *RedirectRecord) error {
+	log.Printf("PutRedirect called with code: %s", redirect.Code)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// An expired row that the sweeper hasn't reached yet must not block the code
+	if _, err := tx.Exec("DELETE FROM redirects WHERE code = ? AND ettl > 0 AND ettl < ?",
+		redirect.Code, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(sqliteFields(redirect))), ", ")
+	result, err := tx.Exec("INSERT OR IGNORE INTO redirects ("+sqliteColumns+") VALUES ("+placeholders+")",
+		sqliteFields(redirect)...)
+	if err != nil {
+		log.Printf("SQLite insert failed: %v", err)
+		return err
+	}
+
+	// Equivalent of attribute_not_exists(code) failing in DynamoDB
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return &types.ConditionalCheckFailedException{Message: aws.String("code already exists")}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDBClient) GetRedirect(code string) (*RedirectRecord, error) {
+	var record RedirectRecord
+	err := s.db.QueryRow("SELECT "+sqliteColumns+" FROM redirects WHERE code = ? AND (ettl = 0 OR ettl >= ?)",
+		code, time.Now().Unix()).Scan(sqliteFields(&record)...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// GetRedirectFresh is GetRedirect, as SQLite records are never cached
+func (s *SQLiteDBClient) GetRedirectFresh(code string) (*RedirectRecord, error) {
+	return s.GetRedirect(code)
+}
+
+func (s *SQLiteDBClient) DeleteRedirect(code string, ownerID string) error {
+	log.Printf("DeleteRedirect called with code: %s", code)
+
+	// The whole record comes back so every blob it names can be removed
+	record := &RedirectRecord{}
+	err := s.db.QueryRow("DELETE FROM redirects WHERE code = ? AND owner = ? AND (ettl = 0 OR ettl >= ?) RETURNING "+sqliteColumns,
+		code, ownerID, time.Now().Unix()).Scan(sqliteFields(record)...)
+
+	// Return same error for both "not found" and "wrong owner" for security
+	if err == sql.ErrNoRows {
+		log.Printf("Delete failed: record not found or owner mismatch")
+		return &types.ConditionalCheckFailedException{}
+	}
+	if err != nil {
+		log.Printf("SQLite delete failed: %v", err)
+		return err
+	}
+
+	deleteBlob(s.blobs, record)
+	log.Printf("Successfully deleted redirect for code: %s", code)
+	return nil
+}
+
+func (s *SQLiteDBClient) ConsumeRedirect(code string) (*RedirectRecord, error) {
+	// DELETE ... RETURNING is a single statement, so only one caller gets the row
+	var record RedirectRecord
+	err := s.db.QueryRow("DELETE FROM redirects WHERE code = ? AND (ettl = 0 OR ettl >= ?) RETURNING "+sqliteColumns,
+		code, time.Now().Unix()).Scan(sqliteFields(&record)...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *SQLiteDBClient) RecordView(code string) (*RedirectRecord, error) {
+	var record RedirectRecord
+	err := s.db.QueryRow("UPDATE redirects SET views = views + 1 WHERE code = ? AND (ettl = 0 OR ettl >= ?) AND maxviews > 0 AND views < maxviews RETURNING "+sqliteColumns,
+		code, time.Now().Unix()).Scan(sqliteFields(&record)...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *SQLiteDBClient) SetSize(code string, size int64, hash string) error {
+	result, err := s.db.Exec("UPDATE redirects SET size = ?, hash = ? WHERE code = ?", size, hash, code)
+	return requireUpdated(result, err)
+}
+
+func (s *SQLiteDBClient) SetFiles(code string, files BundleFiles) error {
+	result, err := s.db.Exec("UPDATE redirects SET typ = 'B', val = '', filename = '', mime = '', lang = '', hash = '', files = ?, size = ? WHERE code = ?",
+		files, files.Size(), code)
+	return requireUpdated(result, err)
+}
+
+// requireUpdated fails an UPDATE that matched no record the way a DynamoDB
+// attribute_exists(code) condition does
+func requireUpdated(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return &types.ConditionalCheckFailedException{}
+	}
+	return nil
+}
+
+func (s *SQLiteDBClient) ReviseRedirect(record *RedirectRecord, ownerID string) error {
+	log.Printf("ReviseRedirect called with code: %s, revision: %d", record.Code, record.Rev)
+
+	// Revision 1 is stored as rev 0. Only the content columns are written, so
+	// views counted meanwhile are kept.
+	result, err := s.db.Exec(`UPDATE redirects SET typ = ?, val = ?, size = ?, hash = ?, blobtag = ?, rev = ?, updated = ?, revs = ?
+		WHERE code = ? AND owner = ? AND (ettl = 0 OR ettl >= ?) AND MAX(rev, 1) = ?`,
+		record.Typ, record.Val, record.Size, record.Hash, record.BlobTag, record.Rev, record.Updated, record.Revs,
+		record.Code, ownerID, time.Now().Unix(), record.Rev-1)
+	if err != nil {
+		log.Printf("SQLite update failed: %v", err)
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		log.Printf("Revise failed: record not found, owner mismatch or revision conflict")
+		return &types.ConditionalCheckFailedException{}
+	}
+	return nil
+}
+
+func (s *SQLiteDBClient) TakeQuota(key string, limit int64, window time.Duration) (bool, error) {
+	now := time.Now()
+
+	// Quota counters are type "Q" rows with the count in views. The upsert
+	// starts a new window when the old one has expired and otherwise only
+	// counts while under the limit, so a full window changes no rows.
+	result, err := s.db.Exec(`INSERT INTO redirects (code, typ, ettl, views) VALUES (?, 'Q', ?, 1)
+		ON CONFLICT (code) DO UPDATE SET
+			views = CASE WHEN ettl < ?3 THEN 1 ELSE views + 1 END,
+			ettl = CASE WHEN ettl < ?3 THEN excluded.ettl ELSE ettl END
+		WHERE ettl < ?3 OR views < ?4`,
+		key, now.Add(window).Unix(), now.Unix(), limit)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (s *SQLiteDBClient) RefundQuota(key string) error {
+	_, err := s.db.Exec("UPDATE redirects SET views = views - 1 WHERE code = ? AND typ = 'Q' AND ettl >= ? AND views > 0",
+		key, time.Now().Unix())
+	return err
+}
+
+// GetCacheSize always returns 0 because SQLite does its own page caching
+func (s *SQLiteDBClient) GetCacheSize() int {
+	return 0
+}
+
+// SweepExpired deletes all rows whose ettl has passed and returns how many were removed
+func (s *SQLiteDBClient) SweepExpired() (int, error) {
+	result, err := s.db.Exec("DELETE FROM redirects WHERE ettl > 0 AND ettl < ?", time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+func (s *SQLiteDBClient) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		removed, err := s.SweepExpired()
+		if err != nil {
+			log.Printf("SQLite sweep failed: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("SQLite sweep removed %d expired records", removed)
+		}
+	}
+}
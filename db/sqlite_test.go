@@ -0,0 +1,262 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteDBClient(t *testing.T) {
+	cfg := &config.Config{SQLitePath: filepath.Join(t.TempDir(), "test.db")}
+	client, err := NewSQLiteDBClient(cfg, nil)
+	require.NoError(t, err)
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+
+	t.Run("Put and get", func(t *testing.T) {
+		err := client.PutRedirect(&RedirectRecord{
+			Code: "abcd", Typ: "D", Val: "hello", Ettl: future, Created: 1234, IP: "10.0.0.1", Owner: "owner1",
+		})
+		assert.NoError(t, err)
+
+		record, err := client.GetRedirect("abcd")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, RedirectRecord{
+			Code: "abcd", Typ: "D", Val: "hello", Ettl: future, Created: 1234, IP: "10.0.0.1", Owner: "owner1",
+		}, *record)
+	})
+
+	t.Run("Duplicate code is rejected", func(t *testing.T) {
+		err := client.PutRedirect(&RedirectRecord{Code: "abcd", Typ: "D", Val: "other", Ettl: future})
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(err, &ccf))
+	})
+
+	t.Run("Expired row is hidden and code can be reused", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "old1", Typ: "D", Val: "stale", Ettl: past}))
+
+		record, err := client.GetRedirect("old1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "old1", Typ: "D", Val: "fresh", Ettl: future}))
+		record, _ = client.GetRedirect("old1")
+		require.NotNil(t, record)
+		assert.Equal(t, "fresh", record.Val)
+	})
+
+	t.Run("Delete requires owner", func(t *testing.T) {
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(client.DeleteRedirect("abcd", "someone-else"), &ccf))
+		assert.NoError(t, client.DeleteRedirect("abcd", "owner1"))
+		assert.True(t, errors.As(client.DeleteRedirect("abcd", "owner1"), &ccf))
+	})
+
+	t.Run("Consume returns the record exactly once", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "brn1", Typ: "D", Val: "secret", Ettl: future, Burn: true}))
+
+		record, err := client.ConsumeRedirect("brn1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "secret", record.Val)
+		assert.True(t, record.Burn)
+
+		record, err = client.ConsumeRedirect("brn1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+
+		record, _ = client.GetRedirect("brn1")
+		assert.Nil(t, record)
+	})
+
+	t.Run("Record view stops at the limit", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "lim1", Typ: "D", Val: "limited", Ettl: future, MaxViews: 2}))
+
+		for want := int64(1); want <= 2; want++ {
+			record, err := client.RecordView("lim1")
+			assert.NoError(t, err)
+			require.NotNil(t, record)
+			assert.Equal(t, want, record.Views)
+		}
+
+		record, err := client.RecordView("lim1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+
+		// Unlimited records are never counted
+		record, err = client.RecordView("old1")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Set size", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "siz1", Typ: "S", Ettl: future, DelHash: "abc123", Parent: "abcd@2",
+			Filename: "photo.png", Mime: "image/png"}))
+		assert.NoError(t, client.SetSize("siz1", 4096, "c0ffee"))
+
+		record, err := client.GetRedirect("siz1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, int64(4096), record.Size)
+		assert.Equal(t, "c0ffee", record.Hash)
+		assert.Equal(t, "abc123", record.DelHash)
+		assert.Equal(t, "abcd@2", record.Parent)
+		assert.Equal(t, "photo.png", record.Filename)
+		assert.True(t, record.Binary())
+	})
+
+	t.Run("Language", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "lng1", Typ: "D", Val: "print(1)", Ettl: future, Lang: "python"}))
+
+		record, err := client.GetRedirect("lng1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "python", record.Lang)
+	})
+
+	t.Run("Set size or files on a missing record", func(t *testing.T) {
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(client.SetSize("gone", 4096, "c0ffee"), &ccf))
+		assert.True(t, errors.As(client.SetFiles("gone", BundleFiles{{Name: "main.go", Size: 12}}), &ccf))
+
+		record, err := client.GetRedirect("gone")
+		assert.NoError(t, err)
+		assert.Nil(t, record)
+	})
+
+	t.Run("Set files", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "bnd1", Typ: "D", Val: "package main", Ettl: future, Filename: "main.go", Size: 12}))
+		files := BundleFiles{{Name: "main.go", Size: 12}, {Name: "logo.png", Size: 300, Mime: "image/png"}}
+		assert.NoError(t, client.SetFiles("bnd1", files))
+
+		record, err := client.GetRedirect("bnd1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "B", record.Typ)
+		assert.Empty(t, record.Val)
+		assert.Empty(t, record.Filename)
+		assert.Equal(t, files, record.Files)
+		assert.Equal(t, int64(312), record.Size)
+		assert.Equal(t, 1, record.Files.Index("logo.png"))
+	})
+
+	t.Run("Revise requires owner and the current revision", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "rev1", Typ: "D", Val: "first", Ettl: future, Owner: "owner1", MaxViews: 5}))
+		_, err := client.RecordView("rev1")
+		assert.NoError(t, err)
+
+		revised := &RedirectRecord{Code: "rev1", Typ: "D", Val: "second", Size: 6, Hash: "5ec0", Rev: 2, Updated: 5678,
+			Revs: Revisions{{Rev: 1, Created: 1234, Size: 5, Hash: "f125"}}}
+		var ccf *types.ConditionalCheckFailedException
+		assert.True(t, errors.As(client.ReviseRedirect(revised, "someone-else"), &ccf))
+		assert.NoError(t, client.ReviseRedirect(revised, "owner1"))
+
+		// Revision 2 is taken now, so a second edit based on revision 1 fails
+		assert.True(t, errors.As(client.ReviseRedirect(revised, "owner1"), &ccf))
+
+		record, err := client.GetRedirect("rev1")
+		assert.NoError(t, err)
+		require.NotNil(t, record)
+		assert.Equal(t, "second", record.Val)
+		assert.Equal(t, int64(2), record.Revision())
+		assert.Equal(t, int64(5678), record.Updated)
+		assert.Equal(t, "5ec0", record.Hash)
+		assert.Equal(t, Revisions{{Rev: 1, Created: 1234, Size: 5, Hash: "f125"}}, record.Revs)
+		assert.Equal(t, int64(1), record.Views, "views counted before the edit are kept")
+
+		revised.Rev, revised.Typ, revised.Val, revised.BlobTag = 3, "S", "", "7a9c"
+		revised.Revs = append(revised.Revs, Revision{Rev: 2, Created: 5678, Size: 6})
+		assert.NoError(t, client.ReviseRedirect(revised, "owner1"))
+		record, _ = client.GetRedirect("rev1")
+		require.NotNil(t, record)
+		assert.Equal(t, "S", record.Typ)
+		assert.Equal(t, "7a9c", record.BlobTag)
+		assert.Len(t, record.Revs, 2)
+		assert.Contains(t, BlobKeys(record), "S/rev1@3-7a9c.zst")
+	})
+
+	t.Run("Sweep removes expired rows", func(t *testing.T) {
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "exp1", Typ: "D", Ettl: past}))
+		assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "exp2", Typ: "D", Ettl: past}))
+
+		removed, err := client.(*SQLiteDBClient).SweepExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, removed)
+
+		record, _ := client.GetRedirect("old1")
+		assert.NotNil(t, record)
+	})
+
+	t.Run("Reopen keeps data and schema version", func(t *testing.T) {
+		reopened, err := NewSQLiteDBClient(cfg, nil)
+		require.NoError(t, err)
+		record, err := reopened.GetRedirect("old1")
+		assert.NoError(t, err)
+		assert.NotNil(t, record)
+	})
+}
+
+func TestSQLiteDeleteRemovesBundleBlobs(t *testing.T) {
+	cfg := &config.Config{DataDir: t.TempDir()}
+	blobs, err := NewLocalS3Client(cfg)
+	require.NoError(t, err)
+	client, err := NewSQLiteDBClient(cfg, blobs)
+	require.NoError(t, err)
+
+	files := BundleFiles{{Name: "main.go", Size: 12}, {Name: "logo.png", Size: 300, Mime: "image/png"}}
+	for n := range files {
+		assert.NoError(t, blobs.PutObject(FileBlobKey("bnd1", n), []byte("file content")))
+	}
+	assert.NoError(t, client.PutRedirect(&RedirectRecord{Code: "bnd1", Typ: "D", Owner: "owner1", Ettl: time.Now().Add(time.Hour).Unix()}))
+	assert.NoError(t, client.SetFiles("bnd1", files))
+
+	assert.NoError(t, client.DeleteRedirect("bnd1", "owner1"))
+
+	var keys []string
+	assert.NoError(t, blobs.ListObjects(BlobPrefix, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}))
+	assert.Empty(t, keys)
+}
+
+func TestSQLiteTakeQuota(t *testing.T) {
+	cfg := &config.Config{SQLitePath: filepath.Join(t.TempDir(), "test.db")}
+	client, err := NewSQLiteDBClient(cfg, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		ok, err := client.TakeQuota("_quota_test", 2, time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, err := client.TakeQuota("_quota_test", 2, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A use given back can be taken again, but only once
+	assert.NoError(t, client.RefundQuota("_quota_test"))
+	ok, err = client.TakeQuota("_quota_test", 2, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = client.TakeQuota("_quota_test", 2, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, client.RefundQuota("_quota_none"))
+
+	// An expired window starts over
+	for i := 0; i < 2; i++ {
+		ok, err = client.TakeQuota("_quota_short", 1, -time.Second)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
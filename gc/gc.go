@@ -0,0 +1,111 @@
+package gc
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+)
+
+// Collector reconciles the blob store against live metadata and deletes blobs
+// that no longer belong to a live paste, either as its content or as one of its
+// earlier revisions. This covers pastes that were deleted, expired through the
+// metadata TTL, or never committed because the metadata insert or revision
+// update failed after the upload.
+type Collector struct {
+	DB          db.DBInterface
+	S3          db.S3Interface
+	GracePeriod time.Duration // Blobs younger than this are skipped, since their metadata may still be in flight
+	DryRun      bool          // Report what would be deleted without deleting anything
+}
+
+// Report summarizes a single collection run
+type Report struct {
+	Scanned        int      `json:"scanned"`
+	Kept           int      `json:"kept"`
+	Skipped        int      `json:"skipped"` // Within the grace period or unrecognised keys
+	Deleted        int      `json:"deleted"`
+	BytesReclaimed int64    `json:"bytes_reclaimed"`
+	Errors         int      `json:"errors"`
+	DeletedKeys    []string `json:"deleted_keys,omitempty"`
+	DryRun         bool     `json:"dry_run"`
+	Duration       string   `json:"duration"`
+}
+
+// Run performs one full pass over the blob store
+func (c *Collector) Run() (*Report, error) {
+	start := time.Now()
+	report := &Report{DryRun: c.DryRun}
+	cutoff := start.Add(-c.GracePeriod)
+
+	err := c.S3.ListObjects(db.BlobPrefix, func(obj db.ObjectInfo) error {
+		report.Scanned++
+
+		code, ok := db.CodeFromBlobKey(obj.Key)
+		if !ok || obj.LastModified.After(cutoff) {
+			report.Skipped++
+			return nil
+		}
+
+		record, err := c.DB.GetRedirect(code)
+		if err == nil && !holdsBlob(record, obj.Key, start.Unix()) {
+			// A cached copy may be older than the blob however long the grace
+			// period is, so only what the database holds now can condemn it
+			record, err = c.DB.GetRedirectFresh(code)
+		}
+		if err != nil {
+			// Never delete on a lookup failure, the paste may well be live
+			log.Printf("GC: failed to look up code %s: %v", code, err)
+			report.Errors++
+			return nil
+		}
+		if holdsBlob(record, obj.Key, start.Unix()) {
+			report.Kept++
+			return nil
+		}
+
+		if !c.DryRun {
+			if err := c.S3.DeleteObject(obj.Key); err != nil {
+				log.Printf("GC: failed to delete %s: %v", obj.Key, err)
+				report.Errors++
+				return nil
+			}
+		}
+		report.Deleted++
+		report.BytesReclaimed += obj.Size
+		report.DeletedKeys = append(report.DeletedKeys, obj.Key)
+		return nil
+	})
+
+	report.Duration = time.Since(start).Round(time.Millisecond).String()
+	return report, err
+}
+
+// holdsBlob reports whether record is live and still refers to the blob at key
+func holdsBlob(record *db.RedirectRecord, key string, now int64) bool {
+	return record != nil && !isExpired(record, now) && slices.Contains(db.BlobKeys(record), key)
+}
+
+// Start runs the collector every interval in a background goroutine
+func (c *Collector) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := c.Run()
+			if err != nil {
+				log.Printf("GC: run failed: %v", err)
+				continue
+			}
+			log.Printf("GC: scanned %d blobs, kept %d, skipped %d, deleted %d (%d bytes reclaimed), %d errors in %s",
+				report.Scanned, report.Kept, report.Skipped, report.Deleted, report.BytesReclaimed, report.Errors, report.Duration)
+		}
+	}()
+}
+
+// isExpired reports whether the record's TTL has passed. DynamoDB can take a
+// while to remove expired items, so the metadata may still be readable.
+func isExpired(record *db.RedirectRecord, now int64) bool {
+	return record.Ettl > 0 && now > record.Ettl
+}
@@ -0,0 +1,197 @@
+package gc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectorRun(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+
+	objects := []db.ObjectInfo{
+		{Key: "S/live.zst", Size: 100, LastModified: old},
+		{Key: "S/gone.zst", Size: 200, LastModified: old},
+		{Key: "S/expd.zst", Size: 300, LastModified: old},
+		{Key: "S/dtyp.zst", Size: 400, LastModified: old},
+		{Key: "S/eror.zst", Size: 500, LastModified: old},
+		{Key: "S/new1.zst", Size: 600, LastModified: time.Now()},
+		{Key: "S/junk", Size: 700, LastModified: old},
+	}
+
+	setup := func() (*db.MockDB, *db.MockS3) {
+		mockDB := new(db.MockDB)
+		mockS3 := new(db.MockS3)
+		mockS3.On("ListObjects", "S/").Return(objects, nil)
+		mockDB.On("GetRedirect", "live").Return(&db.RedirectRecord{Code: "live", Typ: "S", Ettl: future}, nil)
+		// Every blob is only deleted on a fresh read of its record
+		for _, method := range []string{"GetRedirect", "GetRedirectFresh"} {
+			mockDB.On(method, "gone").Return(nil, nil)
+			mockDB.On(method, "expd").Return(&db.RedirectRecord{Code: "expd", Typ: "S", Ettl: past}, nil)
+			mockDB.On(method, "dtyp").Return(&db.RedirectRecord{Code: "dtyp", Typ: "D", Ettl: future}, nil)
+		}
+		mockDB.On("GetRedirect", "eror").Return(nil, errors.New("db error"))
+		return mockDB, mockS3
+	}
+
+	t.Run("Deletes orphaned blobs", func(t *testing.T) {
+		mockDB, mockS3 := setup()
+		mockS3.On("DeleteObject", "S/gone.zst").Return(nil)
+		mockS3.On("DeleteObject", "S/expd.zst").Return(nil)
+		mockS3.On("DeleteObject", "S/dtyp.zst").Return(nil)
+
+		collector := &Collector{DB: mockDB, S3: mockS3, GracePeriod: time.Hour}
+		report, err := collector.Run()
+		require.NoError(t, err)
+
+		assert.Equal(t, 7, report.Scanned)
+		assert.Equal(t, 1, report.Kept)
+		assert.Equal(t, 2, report.Skipped)
+		assert.Equal(t, 3, report.Deleted)
+		assert.Equal(t, 1, report.Errors)
+		assert.Equal(t, int64(900), report.BytesReclaimed)
+		assert.ElementsMatch(t, []string{"S/gone.zst", "S/expd.zst", "S/dtyp.zst"}, report.DeletedKeys)
+
+		mockDB.AssertExpectations(t)
+		mockS3.AssertExpectations(t)
+	})
+
+	t.Run("Dry run deletes nothing", func(t *testing.T) {
+		mockDB, mockS3 := setup()
+
+		collector := &Collector{DB: mockDB, S3: mockS3, GracePeriod: time.Hour, DryRun: true}
+		report, err := collector.Run()
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, report.Deleted)
+		assert.True(t, report.DryRun)
+		mockS3.AssertNotCalled(t, "DeleteObject", "S/gone.zst")
+	})
+}
+
+func TestCollectorRunRevisions(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	future := time.Now().Add(time.Hour).Unix()
+
+	// An edited paste now inline at revision 3, with revisions 1 and 2 archived
+	// and a blob left behind by an edit that never committed revision 4
+	mockDB := new(db.MockDB)
+	mockS3 := new(db.MockS3)
+	mockS3.On("ListObjects", "S/").Return([]db.ObjectInfo{
+		{Key: "S/edit.zst", Size: 100, LastModified: old},
+		{Key: "S/edit@2.zst", Size: 200, LastModified: old},
+		{Key: "S/edit@4.zst", Size: 400, LastModified: old},
+		{Key: "S/edit@x.zst", Size: 500, LastModified: old},
+	}, nil)
+	record := &db.RedirectRecord{
+		Code: "edit", Typ: "D", Ettl: future, Rev: 3, Revs: db.Revisions{{Rev: 1}, {Rev: 2}},
+	}
+	mockDB.On("GetRedirect", "edit").Return(record, nil)
+	mockDB.On("GetRedirectFresh", "edit").Return(record, nil)
+	mockS3.On("DeleteObject", "S/edit@4.zst").Return(nil)
+
+	collector := &Collector{DB: mockDB, S3: mockS3, GracePeriod: time.Hour}
+	report, err := collector.Run()
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Kept)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, []string{"S/edit@4.zst"}, report.DeletedKeys)
+	mockS3.AssertExpectations(t)
+}
+
+func TestCollectorRunTaggedRevisions(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	future := time.Now().Add(time.Hour).Unix()
+
+	// Two edits raced for revision 3: the record names the winner's blob, and
+	// the loser's is left behind
+	mockDB := new(db.MockDB)
+	mockS3 := new(db.MockS3)
+	mockS3.On("ListObjects", "S/").Return([]db.ObjectInfo{
+		{Key: "S/edit.zst", Size: 100, LastModified: old},
+		{Key: "S/edit@2-0a1b.zst", Size: 200, LastModified: old},
+		{Key: "S/edit@3-2c3d.zst", Size: 300, LastModified: old},
+		{Key: "S/edit@3-4e5f.zst", Size: 300, LastModified: old},
+		{Key: "S/edit@3-.zst", Size: 300, LastModified: old},
+	}, nil)
+	record := &db.RedirectRecord{
+		Code: "edit", Typ: "S", Ettl: future, Rev: 3, BlobTag: "2c3d", Revs: db.Revisions{{Rev: 1}, {Rev: 2, BlobTag: "0a1b"}},
+	}
+	mockDB.On("GetRedirect", "edit").Return(record, nil)
+	mockDB.On("GetRedirectFresh", "edit").Return(record, nil)
+	mockS3.On("DeleteObject", "S/edit@3-4e5f.zst").Return(nil)
+
+	collector := &Collector{DB: mockDB, S3: mockS3, GracePeriod: time.Hour}
+	report, err := collector.Run()
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.Kept)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, []string{"S/edit@3-4e5f.zst"}, report.DeletedKeys)
+	mockS3.AssertExpectations(t)
+}
+
+func TestCollectorRunBundles(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	future := time.Now().Add(time.Hour).Unix()
+
+	// A two-file paste, with a third file left behind by an upload that failed
+	mockDB := new(db.MockDB)
+	mockS3 := new(db.MockS3)
+	mockS3.On("ListObjects", "S/").Return([]db.ObjectInfo{
+		{Key: "S/bndl.zst", Size: 100, LastModified: old},
+		{Key: "S/bndl/1.zst", Size: 200, LastModified: old},
+		{Key: "S/bndl/2.zst", Size: 300, LastModified: old},
+		{Key: "S/bndl/0.zst", Size: 400, LastModified: old},
+	}, nil)
+	record := &db.RedirectRecord{
+		Code: "bndl", Typ: "B", Ettl: future, Files: db.BundleFiles{{Name: "main.go"}, {Name: "go.mod"}},
+	}
+	mockDB.On("GetRedirect", "bndl").Return(record, nil)
+	mockDB.On("GetRedirectFresh", "bndl").Return(record, nil)
+	mockS3.On("DeleteObject", "S/bndl/2.zst").Return(nil)
+
+	collector := &Collector{DB: mockDB, S3: mockS3, GracePeriod: time.Hour}
+	report, err := collector.Run()
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Kept)
+	assert.Equal(t, 1, report.Skipped)
+	assert.Equal(t, []string{"S/bndl/2.zst"}, report.DeletedKeys)
+	mockS3.AssertExpectations(t)
+}
+
+func TestCollectorRunStaleCache(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	future := time.Now().Add(time.Hour).Unix()
+
+	// This replica cached the paste before it was edited on another one, so
+	// only the fresh read knows the blob of revision 2
+	mockDB := new(db.MockDB)
+	mockS3 := new(db.MockS3)
+	mockS3.On("ListObjects", "S/").Return([]db.ObjectInfo{
+		{Key: "S/edit.zst", Size: 100, LastModified: old},
+		{Key: "S/edit@2-0a1b.zst", Size: 200, LastModified: old},
+	}, nil)
+	mockDB.On("GetRedirect", "edit").Return(&db.RedirectRecord{Code: "edit", Typ: "S", Ettl: future}, nil)
+	mockDB.On("GetRedirectFresh", "edit").Return(&db.RedirectRecord{
+		Code: "edit", Typ: "S", Ettl: future, Rev: 2, BlobTag: "0a1b", Revs: db.Revisions{{Rev: 1}},
+	}, nil)
+
+	collector := &Collector{DB: mockDB, S3: mockS3, GracePeriod: time.Minute}
+	report, err := collector.Run()
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Kept)
+	assert.Empty(t, report.DeletedKeys)
+	mockDB.AssertExpectations(t)
+	mockS3.AssertNotCalled(t, "DeleteObject", "S/edit@2-0a1b.zst")
+}
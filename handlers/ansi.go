@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+
+	"github.com/drewstreib/xipe-go/db"
+)
+
+// ansiColor is a terminal colour: ansiDefault, an index into the 256-colour
+// palette, or a 24-bit colour made by rgbColor
+type ansiColor int32
+
+const ansiDefault ansiColor = -1
+
+func rgbColor(r, g, b int) ansiColor {
+	return ansiColor(1<<24 | (r&0xff)<<16 | (g&0xff)<<8 | b&0xff)
+}
+
+// hex returns the CSS colour of a palette colour past the first 16, which
+// have classes of their own, or of a 24-bit colour
+func (c ansiColor) hex() string {
+	if c >= 1<<24 {
+		return fmt.Sprintf("#%06x", int32(c)&0xffffff)
+	}
+	if c >= 232 {
+		gray := 8 + 10*int(c-232)
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+	level := func(v int) int {
+		if v == 0 {
+			return 0
+		}
+		return 55 + 40*v
+	}
+	i := int(c - 16)
+	return fmt.Sprintf("#%02x%02x%02x", level(i/36), level(i/6%6), level(i%6))
+}
+
+// ansiStyle is the state set by SGR (Select Graphic Rendition) sequences
+type ansiStyle struct {
+	fg, bg                                        ansiColor
+	bold, dim, italic, underline, strike, inverse bool
+}
+
+var plainStyle = ansiStyle{fg: ansiDefault, bg: ansiDefault}
+
+// apply updates the style with the parameters of one SGR sequence
+func (s *ansiStyle) apply(params []int) {
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			*s = plainStyle
+		case p == 1:
+			s.bold = true
+		case p == 2:
+			s.dim = true
+		case p == 3:
+			s.italic = true
+		case p == 4:
+			s.underline = true
+		case p == 7:
+			s.inverse = true
+		case p == 9:
+			s.strike = true
+		case p == 22:
+			s.bold, s.dim = false, false
+		case p == 23:
+			s.italic = false
+		case p == 24:
+			s.underline = false
+		case p == 27:
+			s.inverse = false
+		case p == 29:
+			s.strike = false
+		case p >= 30 && p <= 37:
+			s.fg = ansiColor(p - 30)
+		case p == 38:
+			s.fg, i = extendedColor(params, i)
+		case p == 39:
+			s.fg = ansiDefault
+		case p >= 40 && p <= 47:
+			s.bg = ansiColor(p - 40)
+		case p == 48:
+			s.bg, i = extendedColor(params, i)
+		case p == 49:
+			s.bg = ansiDefault
+		case p >= 90 && p <= 97:
+			s.fg = ansiColor(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			s.bg = ansiColor(p - 100 + 8)
+		}
+	}
+}
+
+// extendedColor reads the colour of a 38 or 48 parameter at params[i], 5;N
+// from the palette or 2;R;G;B, returning the index of its last parameter
+func extendedColor(params []int, i int) (ansiColor, int) {
+	switch {
+	case i+2 < len(params) && params[i+1] == 5 && params[i+2] < 256:
+		return ansiColor(params[i+2]), i + 2
+	case i+4 < len(params) && params[i+1] == 2:
+		return rgbColor(params[i+2], params[i+3], params[i+4]), i + 4
+	}
+	// Malformed: the rest of the sequence can't be read reliably
+	return ansiDefault, len(params)
+}
+
+// attrs returns the class and style attributes of text in this style, or
+// "" for plain text. The first 16 colours are classes so that they follow
+// the page's palette.
+func (s ansiStyle) attrs() string {
+	fg, bg := s.fg, s.bg
+	var classes, styles []string
+	if s.inverse {
+		fg, bg = bg, fg
+		if fg == ansiDefault {
+			classes = append(classes, "ansi-fg-inverse")
+		}
+		if bg == ansiDefault {
+			classes = append(classes, "ansi-bg-inverse")
+		}
+	}
+	for _, flag := range []struct {
+		set   bool
+		class string
+	}{{s.bold, "ansi-bold"}, {s.dim, "ansi-dim"}, {s.italic, "ansi-italic"}, {s.underline, "ansi-underline"}, {s.strike, "ansi-strike"}} {
+		if flag.set {
+			classes = append(classes, flag.class)
+		}
+	}
+	switch {
+	case fg == ansiDefault:
+	case fg < 16:
+		classes = append(classes, "ansi-fg-"+strconv.Itoa(int(fg)))
+	default:
+		styles = append(styles, "color:"+fg.hex())
+	}
+	switch {
+	case bg == ansiDefault:
+	case bg < 16:
+		classes = append(classes, "ansi-bg-"+strconv.Itoa(int(bg)))
+	default:
+		styles = append(styles, "background-color:"+bg.hex())
+	}
+
+	var out strings.Builder
+	if len(classes) > 0 {
+		out.WriteString(` class="` + strings.Join(classes, " ") + `"`)
+	}
+	if len(styles) > 0 {
+		out.WriteString(` style="` + strings.Join(styles, ";") + `"`)
+	}
+	return out.String()
+}
+
+// ansiSpan is a run of text in one style
+type ansiSpan struct {
+	text  string
+	style ansiStyle
+}
+
+// renderANSI renders terminal output laid out like highlight's, one numbered
+// line per row, with its colours and text attributes as styled spans. Other
+// escape sequences are dropped, and a carriage return starts its line over
+// as a progress bar would.
+func renderANSI(source, anchor string) template.HTML {
+	anchor = template.HTMLEscapeString(anchor)
+	lines := strings.SplitAfter(source, "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var out strings.Builder
+	out.WriteString(`<pre class="chroma ansi"><code>`)
+	style := plainStyle
+	for i, line := range lines {
+		var spans []ansiSpan
+		spans, style = parseANSILine(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), style)
+		fmt.Fprintf(&out, `<span class="line"><span class="ln" id="%s%d"><a class="lnlinks" href="#%s%d">%d</a></span><span class="cl">`, anchor, i+1, anchor, i+1, i+1)
+		for _, span := range spans {
+			text := template.HTMLEscapeString(span.text)
+			if attrs := span.style.attrs(); attrs != "" {
+				text = "<span" + attrs + ">" + text + "</span>"
+			}
+			out.WriteString(text)
+		}
+		out.WriteString("\n</span></span>")
+	}
+	out.WriteString("</code></pre>")
+	// Every piece of the source is escaped, and attrs only holds names and
+	// colours made here
+	return template.HTML(out.String())
+}
+
+// parseANSILine splits one line into styled runs of text, starting in style
+// and returning the style it leaves for the next line
+func parseANSILine(line string, style ansiStyle) ([]ansiSpan, ansiStyle) {
+	var spans []ansiSpan
+	for len(line) > 0 {
+		switch line[0] {
+		case '\r':
+			spans = nil
+			line = line[1:]
+		case 0x1b:
+			var params []int
+			var ok bool
+			params, ok, line = parseEscape(line)
+			if ok {
+				style.apply(params)
+			}
+		default:
+			end := strings.IndexAny(line, "\r\x1b")
+			if end < 0 {
+				end = len(line)
+			}
+			spans = append(spans, ansiSpan{text: line[:end], style: style})
+			line = line[end:]
+		}
+	}
+	return spans, style
+}
+
+// parseEscape reads the escape sequence at the start of s, returning its
+// parameters if it is an SGR sequence and the text after it
+func parseEscape(s string) ([]int, bool, string) {
+	if len(s) < 2 {
+		return nil, false, ""
+	}
+	switch s[1] {
+	case '[':
+		end := strings.IndexFunc(s[2:], func(r rune) bool { return r >= 0x40 && r <= 0x7e })
+		if end < 0 {
+			return nil, false, ""
+		}
+		end += 2
+		if s[end] != 'm' {
+			return nil, false, s[end+1:]
+		}
+		// Empty parameters are 0, and ESC [ m is a reset
+		var params []int
+		for _, field := range strings.Split(strings.ReplaceAll(s[2:end], ":", ";"), ";") {
+			n := 0
+			if field != "" {
+				var err error
+				if n, err = strconv.Atoi(field); err != nil {
+					return nil, false, s[end+1:]
+				}
+			}
+			params = append(params, n)
+		}
+		return params, true, s[end+1:]
+	case ']':
+		// Ends with BEL or ESC \
+		for i := 2; i < len(s); i++ {
+			if s[i] == 0x07 {
+				return nil, false, s[i+1:]
+			}
+			if s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\' {
+				return nil, false, s[i+2:]
+			}
+		}
+		return nil, false, ""
+	}
+	// Intermediate bytes such as ( then a final byte
+	i := 1
+	for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+		i++
+	}
+	if i < len(s) {
+		i++
+	}
+	return nil, false, s[i:]
+}
+
+// ansiPaste renders text of record as terminal output for its page
+func (h *Handlers) ansiPaste(record *db.RedirectRecord, source, anchor string) template.HTML {
+	if !cacheableRender(record) {
+		return renderANSI(source, anchor)
+	}
+	return h.Render.ANSI(source, anchor)
+}
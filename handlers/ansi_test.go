@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderANSI(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		contains []string
+	}{
+		{"Colour and bold", "\x1b[1;31mFAIL\x1b[0m pkg\n", []string{`<span class="ansi-bold ansi-fg-1">FAIL</span> pkg`}},
+		{"Bright colours", "\x1b[92mok\x1b[39m", []string{`<span class="ansi-fg-10">ok</span>`}},
+		{"Palette colour", "\x1b[38;5;208mwarn", []string{`<span style="color:#ff8700">warn</span>`}},
+		{"24-bit background", "\x1b[48;2;1;2;3mx", []string{`<span style="background-color:#010203">x</span>`}},
+		{"Inverse", "\x1b[7mselected", []string{`<span class="ansi-fg-inverse ansi-bg-inverse">selected</span>`}},
+		{"Style carries to the next line", "\x1b[33mone\ntwo\x1b[0m\nthree\n", []string{`<span class="ansi-fg-3">two</span>`, `<span class="cl">three`}},
+		{"Carriage return starts the line over", "10%\r50%\r100%\n", []string{`<span class="cl">100%`}},
+		{"Text is escaped", "\x1b[31m<script>\x1b[0m", []string{`<span class="ansi-fg-1">&lt;script&gt;</span>`}},
+		{"Numbered lines", "a\nb\n", []string{`id="L1"`, `<a class="lnlinks" href="#L2">2</a>`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(renderANSI(tt.source, "L"))
+			for _, s := range tt.contains {
+				assert.Contains(t, out, s)
+			}
+			assert.NotContains(t, out, "\x1b")
+		})
+	}
+}
+
+func TestDataHandlerANSI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	output := "\x1b[32mPASS\x1b[0m ok\n"
+	mockRecord := &db.RedirectRecord{Code: "term", Typ: "D", Val: output, Ettl: future}
+
+	tests := []struct {
+		name         string
+		path         string
+		userAgent    string
+		expectedBody string
+		missingBody  string
+	}{
+		{"Rendered for browsers", "/term", "Mozilla/5.0 (browser)", `<span class="ansi-fg-2">PASS</span>`, ""},
+		{"Source on request", "/term?render=source", "Mozilla/5.0 (browser)", `id="L1"`, `<span class="ansi-fg-2">`},
+		{"Raw keeps the escapes", "/term?raw", "Mozilla/5.0 (browser)", output, ""},
+		{"Raw clients get the escapes", "/term", "curl/8.0", output, ""},
+		{"Stripped for curl", "/term?strip-ansi", "curl/8.0", "PASS ok\n", "\x1b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockDB.On("GetRedirect", "term").Return(mockRecord, nil)
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			if tt.missingBody != "" {
+				assert.NotContains(t, w.Body.String(), tt.missingBody)
+			}
+		})
+	}
+}
@@ -1,16 +1,21 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
 	"github.com/drewstreib/xipe-go/config"
 	"github.com/drewstreib/xipe-go/db"
@@ -22,9 +27,11 @@ import (
 )
 
 type Handlers struct {
-	DB  db.DBInterface
-	S3  db.S3Interface
-	Cfg *config.Config
+	DB      db.DBInterface
+	S3      db.S3Interface
+	Cfg     *config.Config
+	Guesses *GuessLimiter // Wrong-password limiter for protected pastes (nil allows all)
+	Render  *Highlighter  // Highlighted HTML of recently viewed pastes (nil renders every time)
 }
 
 // generateOwnerToken generates a 128-bit random token and encodes it as base64
@@ -37,6 +44,37 @@ func generateOwnerToken() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(bytes), nil
 }
 
+// deleteTokenHeader returns a new paste's delete token on creation and
+// carries it on DELETE requests
+const deleteTokenHeader = "X-Delete-Token"
+
+// hashDeleteToken returns the hex SHA-256 of a delete token. Tokens are 128
+// random bits, so a fast hash is enough and lets them be checked in one step.
+func hashDeleteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validDeleteToken reports whether token is the delete token of record
+func validDeleteToken(record *db.RedirectRecord, token string) bool {
+	if token == "" || record.DelHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(record.DelHash)) == 1
+}
+
+// suppliedDeleteToken looks for a delete token in the X-Delete-Token header,
+// a bearer token or the token query parameter, in that order
+func suppliedDeleteToken(c *gin.Context) string {
+	if token := c.GetHeader(deleteTokenHeader); token != "" {
+		return token
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
 // getOrCreateOwnerID gets existing owner ID from cookie or creates a new one
 func getOrCreateOwnerID(c *gin.Context) (string, error) {
 	// Check if owner ID cookie already exists
@@ -55,10 +93,10 @@ func getOrCreateOwnerID(c *gin.Context) (string, error) {
 	return ownerID, nil
 }
 
-func (h *Handlers) PostHandler(c *gin.Context) {
-	var rawData string
-	var isFormInput bool
+// errCodesExhausted is returned when every code allocation attempt collided
+var errCodesExhausted = errors.New("could not allocate code")
 
+func (h *Handlers) PostHandler(c *gin.Context) {
 	// Get or create owner ID for this post
 	ownerID, err := getOrCreateOwnerID(c)
 	if err != nil {
@@ -67,202 +105,499 @@ func (h *Handlers) PostHandler(c *gin.Context) {
 		return
 	}
 
-	// Check if input format is specified as form
-	if c.Query("input") == "form" {
+	isFormInput := c.Query("input") == "form"
+	record, deleteToken, perr := h.createPaste(c, ownerID, isFormInput, nil)
+	if perr != nil {
+		c.String(perr.status, "Error: %s\n", perr.message)
+		return
+	}
+
+	// The body stays a bare URL for existing scripts, so the token goes in a header
+	c.Header(deleteTokenHeader, deleteToken)
+
+	h.respondCreated(c, record.Code, ownerID, isFormInput)
+}
+
+// pasteError is a createPaste failure: the status to return and the message
+// to show the client
+type pasteError struct {
+	status  int
+	message string
+}
+
+func newPasteError(status int, format string, args ...any) *pasteError {
+	return &pasteError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// createPaste reads a new paste or short link from the request body (or the
+// data/url form field for form input, or the file parts of a multipart
+// upload or JSON array), takes its options from the query string (or form
+// fields), and stores it. An upload of several files becomes a multi-file
+// paste. A fork takes its content from fork instead.
+// It returns the stored record and the paste's delete token, which is only
+// ever stored as a hash.
+func (h *Handlers) createPaste(c *gin.Context, ownerID string, isFormInput bool, fork *forkSource) (record *db.RedirectRecord, deleteToken string, perr *pasteError) {
+	var src io.Reader
+	var isRedirect bool // Shorten a URL instead of storing a paste
+	var isUpload bool   // Named file upload, possibly binary
+	var filename string
+	var more bundleSource // Files after the first of an upload
+
+	if fork != nil {
+		// ForkHandler has already chosen between the edited body and the parent
+		src = fork.content
+	} else if isFormInput {
 		// Read from form body for URL-encoded data
-		rawData = c.PostForm("data")
-		isFormInput = true
+		rawData := c.PostForm("data")
 
-		if rawData == "" {
-			c.String(http.StatusBadRequest, "Error: data parameter is required\n")
-			return
+		if target := c.PostForm("url"); target != "" {
+			isRedirect = true
+			src = strings.NewReader(target)
+		} else if rawData == "" {
+			return nil, "", newPasteError(http.StatusBadRequest, "data parameter is required")
+		} else {
+			src = strings.NewReader(rawData)
 		}
-	} else {
-		// Default: read raw body like old PUT
-		body, err := io.ReadAll(c.Request.Body)
+	} else if isMultipart(c) {
+		part, parts, err := uploadPart(c)
 		if err != nil {
-			c.String(http.StatusBadRequest, "Error: Failed to read request body\n")
-			return
+			return nil, "", newPasteError(http.StatusBadRequest, "%s", err.Error())
 		}
+		isUpload = true
+		filename = cleanFilename(part.FileName())
+		src = part
+		more = parts
+	} else if body, isArray := jsonArrayBody(c); isArray {
+		files, perr := readJSONFiles(body, int64(h.Cfg.PasteMaxSize))
+		if perr != nil {
+			return nil, "", perr
+		}
+		isUpload = true
+		filename = cleanFilename(files[0].Name)
+		src = strings.NewReader(files[0].Content)
+		files = files[1:]
+		more = &files
+	} else {
+		// Default: stream the raw body like old PUT
+		src = body
+	}
 
-		// Validate UTF-8
-		if !utf8.Valid(body) {
-			c.String(http.StatusBadRequest, "Error: Input text must be UTF-8\n")
-			return
+	// Short links: ?url=<target>, or a bare ?url with the target as the body
+	if c.Request.URL.Query().Has("url") {
+		isRedirect = true
+		if target := c.Query("url"); target != "" {
+			src = strings.NewReader(target)
 		}
+	}
+	directParam, directSet := c.GetQuery("direct")
+	if !directSet && isFormInput {
+		directParam = c.PostForm("direct")
+		directSet = directParam != ""
+	}
+	redirectStatus, err := parseRedirectStatus(directParam, directSet)
+	if err != nil {
+		return nil, "", newPasteError(http.StatusBadRequest, "%s", err.Error())
+	}
+	if fork != nil && isRedirect {
+		return nil, "", newPasteError(http.StatusBadRequest, "A fork is always a paste, url cannot be used")
+	}
 
-		// Convert to string for processing
-		rawData = string(body)
+	// Per-paste expiry and view limit, checked before any content is read
+	now := time.Now()
+	ettl, maxViews, err := h.pasteLimits(c, isFormInput, now)
+	if err != nil {
+		return nil, "", newPasteError(http.StatusBadRequest, "%s", err.Error())
+	}
 
-		// Validate that we have content to store
-		if len(rawData) == 0 {
-			c.String(http.StatusBadRequest, "Error: Cannot store empty content\n")
-			return
+	// Optional vanity code in place of a random one
+	slug := c.Query("slug")
+	if slug == "" && isFormInput {
+		slug = c.PostForm("slug")
+	}
+	if slug != "" {
+		if status, err := checkSlug(slug); err != nil {
+			return nil, "", newPasteError(status, "%s", err.Error())
 		}
 	}
 
-	// Smart truncation to configured max size while preserving UTF-8
-	maxBytes := h.Cfg.PasteMaxSize
-	finalData := rawData
-	if len(rawData) > maxBytes {
-		// Find the longest valid UTF-8 prefix within the limit
-		finalData = rawData
-		for len(finalData) > maxBytes {
-			// Remove the last rune to ensure we don't break UTF-8
-			_, size := utf8.DecodeLastRuneInString(finalData)
-			if size == 0 {
-				break
-			}
-			finalData = finalData[:len(finalData)-size]
+	// Optional read password; only a bcrypt hash is ever stored
+	var passHash string
+	password := c.GetHeader(passwordHeader)
+	if password == "" && isFormInput {
+		password = c.PostForm("password")
+	}
+	if password != "" {
+		if passHash, err = hashPassword(password); err != nil {
+			return nil, "", newPasteError(http.StatusBadRequest, "%s", err.Error())
 		}
-		log.Printf("Truncated input from %d bytes to %d bytes", len(rawData), len(finalData))
+	}
 
-		// Ensure truncation didn't result in empty content
-		if len(finalData) == 0 {
-			c.String(http.StatusBadRequest, "Error: Content became empty after truncation\n")
-			return
+	// Optional file name and language, which drive highlighting and the raw
+	// Content-Type; an upload keeps its own file name unless one is given
+	name := c.Query("filename")
+	if name == "" && isFormInput {
+		name = c.PostForm("filename")
+	}
+	if name != "" {
+		if filename = cleanFilename(name); filename == "" {
+			return nil, "", newPasteError(http.StatusBadRequest, "Invalid file name")
+		}
+	}
+	langParam := c.Query("lang")
+	if langParam == "" && isFormInput {
+		langParam = c.PostForm("lang")
+	}
+	var lang string
+	if langParam != "" {
+		l, ok := lookupLanguage(langParam)
+		if !ok {
+			return nil, "", newPasteError(http.StatusBadRequest, "Unknown language %s", langParam)
+		}
+		lang = l.name
+	}
+	if isRedirect && (name != "" || lang != "") {
+		return nil, "", newPasteError(http.StatusBadRequest, "filename and lang only apply to pastes")
+	}
+	if fork != nil {
+		// A fork is named and highlighted like its parent unless told otherwise
+		if filename == "" {
+			filename = fork.filename
+		}
+		if lang == "" {
+			lang = fork.lang
 		}
 	}
 
-	// Determine storage type for POST data
-	dataLen := len(finalData)
-	var recordType string
-	var finalValue string
-	var s3Key string
+	deleteToken, err = generateOwnerToken()
+	if err != nil {
+		log.Printf("Failed to generate delete token: %v", err)
+		return nil, "", newPasteError(http.StatusInternalServerError, "Failed to generate delete token")
+	}
 
-	if dataLen <= h.Cfg.PasteDynamoDBCutoffSize { // Configurable size threshold: store in DynamoDB
-		recordType = "D"
-		finalValue = finalData
-	} else { // Over cutoff size: store in S3
-		recordType = "S"
-		finalValue = "" // Empty in DynamoDB, data will be in S3
+	// Uploads are sniffed: text becomes an ordinary paste, anything else is
+	// kept as a binary file
+	var mimeType string
+	if isUpload && !isRedirect {
+		sniffer := bufio.NewReader(src)
+		peek, err := sniffer.Peek(512)
+		if err != nil && err != io.EOF {
+			return nil, "", newPasteError(http.StatusBadRequest, "Failed to read request body")
+		}
+		mimeType = binaryType(peek)
+		src = sniffer
 	}
 
-	// POST TTL from configuration
-	ettl := time.Now().Add(time.Duration(h.Cfg.PasteTTL) * time.Second).Unix()
+	// Validate UTF-8 and truncate to the configured max size as the body streams in,
+	// so large pastes never have to be held in memory
+	content := utils.NewUTF8LimitReader(src, int64(h.Cfg.PasteMaxSize))
+	var body io.Reader = content
+	if mimeType != "" {
+		// Binary files are stored byte for byte, and refused rather than
+		// truncated when too large
+		body = utils.NewMaxSizeReader(src, int64(h.Cfg.PasteMaxSize))
+	}
 
-	// Try 3 times with 4-character codes, then 3 times with 5-character codes
-	var code string
-	var insertErr error
-	totalAttempts := 0
+	// Read just past the cutoff to decide between DynamoDB and S3 storage
+	head, err := io.ReadAll(io.LimitReader(body, int64(h.Cfg.PasteDynamoDBCutoffSize)+1))
+	if errors.Is(err, utils.ErrInvalidUTF8) {
+		return nil, "", newPasteError(http.StatusBadRequest, "Input text must be UTF-8")
+	}
+	if errors.Is(err, utils.ErrTooLarge) {
+		return nil, "", newPasteError(http.StatusRequestEntityTooLarge, "File exceeds the maximum size of %d bytes", h.Cfg.PasteMaxSize)
+	}
+	if err != nil {
+		return nil, "", newPasteError(http.StatusBadRequest, "Failed to read request body")
+	}
 
-	for _, currentCodeLength := range []int{4, 5} {
-		for attempts := 0; attempts < 3; attempts++ {
-			totalAttempts++
-			code, err = utils.GenerateUniqueCode(currentCodeLength)
-			if err != nil {
-				c.String(http.StatusInternalServerError, "Error: Failed to generate code\n")
-				return
-			}
+	// Validate that we have content to store
+	if len(head) == 0 {
+		if content.Truncated {
+			return nil, "", newPasteError(http.StatusBadRequest, "Content became empty after truncation")
+		}
+		return nil, "", newPasteError(http.StatusBadRequest, "Cannot store empty content")
+	}
 
-			// Set S3 key if using S3 storage
-			if recordType == "S" {
-				s3Key = "S/" + code + ".zst"
-			}
+	record = &db.RedirectRecord{
+		Ettl:    ettl,
+		Created: now.Unix(),
+		IP:      c.ClientIP(),
+		Owner:   ownerID,
+		// Burn-after-reading via ?burn on the URL or the form checkbox
+		Burn:     c.Request.URL.Query().Has("burn") || (isFormInput && c.PostForm("burn") != ""),
+		MaxViews: maxViews,
+		PassHash: passHash,
+		// Client-side encrypted payload, stored and served as opaque ciphertext
+		Enc:     c.Request.URL.Query().Has("enc") || (isFormInput && c.PostForm("enc") != ""),
+		DelHash: hashDeleteToken(deleteToken),
+
+		Filename: filename,
+		Mime:     mimeType,
+		Lang:     lang,
+	}
+	if fork != nil {
+		// The parent is plaintext, so its copy can't be marked as ciphertext
+		if record.Enc {
+			return nil, "", newPasteError(http.StatusBadRequest, "Forks cannot be encrypted")
+		}
+		record.Parent = fork.parent
+	}
 
-			// Get the client IP
-			clientIP := c.ClientIP()
+	// Truncating ciphertext would make it undecryptable, so refuse instead
+	if record.Enc && content.Truncated {
+		return nil, "", newPasteError(http.StatusRequestEntityTooLarge, "Encrypted content exceeds the maximum size")
+	}
+	// Ciphertext is always base64 text, so binary content can't be it
+	if record.Enc && record.Binary() {
+		return nil, "", newPasteError(http.StatusBadRequest, "Encrypted content must be text")
+	}
+	if record.Lang != "" && record.Binary() {
+		return nil, "", newPasteError(http.StatusBadRequest, "lang only applies to text")
+	}
 
-			// Get current timestamp
-			createdTime := time.Now().Unix()
+	// Determine storage type for POST data
+	if isRedirect {
+		if record.Enc {
+			return nil, "", newPasteError(http.StatusBadRequest, "Short links cannot be encrypted")
+		}
+		target, err := validateRedirectTarget(string(head), h.Cfg.RedirectSchemes)
+		if err == nil && content.Truncated {
+			err = fmt.Errorf("URL must be at most %d bytes", maxRedirectURLLength)
+		}
+		if err != nil {
+			return nil, "", newPasteError(http.StatusBadRequest, "%s", err.Error())
+		}
+		record.Typ = "R"
+		record.Val = target
+		record.Redir = redirectStatus
+		record.Size = int64(len(target))
+	} else if redirectStatus != 0 {
+		return nil, "", newPasteError(http.StatusBadRequest, "direct only applies to short links")
+	} else if !record.Binary() && len(head) <= h.Cfg.PasteDynamoDBCutoffSize { // Configurable size threshold: store in DynamoDB
+		record.Typ = "D"
+		record.Val = string(head)
+		record.Size = int64(len(head))
+		record.Hash = contentHash(record.Val)
+		if content.Truncated {
+			log.Printf("Truncated input to %d bytes", len(head))
+		}
+	} else { // Over cutoff size, or binary: store in S3
+		record.Typ = "S"
+		record.Val = "" // Empty in DynamoDB, data will be in S3
+	}
 
-			record := &db.RedirectRecord{
-				Code:    code,
-				Typ:     recordType,
-				Val:     finalValue,
-				Ettl:    ettl,
-				Created: createdTime,
-				IP:      clientIP,
-				Owner:   ownerID,
+	// The metadata goes in first so the code is reserved before anything is
+	// written to S3; a blob upload can then never clobber another paste's content
+	if slug != "" {
+		// Only taken once everything has been checked, and given back if the
+		// paste still isn't created, so only vanity codes in use count
+		quotaKey := vanityQuotaKey(c.ClientIP())
+		if status, err := h.takeVanityQuota(quotaKey); err != nil {
+			return nil, "", newPasteError(status, "%s", err.Error())
+		}
+		defer func() {
+			if perr != nil {
+				h.refundVanityQuota(quotaKey)
+			}
+		}()
+		record.Code = slug
+		if err := h.DB.PutRedirect(record); err != nil {
+			if isDuplicateKeyError(err) {
+				return nil, "", newPasteError(http.StatusConflict, "Code %s is already in use", slug)
+			}
+			log.Printf("POST: Failed to store vanity code %s: %v", slug, err)
+			return nil, "", newPasteError(http.StatusInternalServerError, "Failed to store data")
+		}
+	} else if err := h.insertWithNewCode(record); err != nil {
+		if errors.Is(err, errCodesExhausted) {
+			return nil, "", newPasteError(529, "Could not allocate URL in the target namespace.")
+		}
+		return nil, "", newPasteError(http.StatusInternalServerError, "Failed to store data")
+	}
+	code := record.Code
+
+	if record.Typ == "S" {
+		s3Key := db.BlobKey(code)
+		digest := sha256.New()
+		size, s3Err := h.S3.PutObjectStream(s3Key, io.TeeReader(io.MultiReader(bytes.NewReader(head), body), digest))
+		if s3Err != nil {
+			log.Printf("POST: Failed to store data in S3: %v", s3Err)
+
+			// Roll back the metadata so the code doesn't point at missing content
+			if err := h.DB.DeleteRedirect(code, ownerID); err != nil {
+				log.Printf("POST: Failed to roll back metadata for code %s: %v", code, err)
 			}
 
-			log.Printf("POST: Attempting to store data - Code: %s (%d chars), Type: %s, Size: %d bytes, Attempt: %d/6",
-				code, currentCodeLength, recordType, dataLen, totalAttempts)
-
-			// Store in S3 first if needed
-			if recordType == "S" {
-				s3Err := h.S3.PutObject(s3Key, []byte(finalData))
-				if s3Err != nil {
-					log.Printf("POST: Failed to store data in S3: %v", s3Err)
-					// Check for specific S3 errors
-					errorMsg := s3Err.Error()
-					if strings.Contains(errorMsg, "AccessDenied") || strings.Contains(errorMsg, "Forbidden") {
-						c.String(http.StatusInternalServerError, "Error: Storage service access denied\n")
-					} else if strings.Contains(errorMsg, "ServiceUnavailable") || strings.Contains(errorMsg, "SlowDown") {
-						c.String(http.StatusServiceUnavailable, "Error: Storage service temporarily unavailable\n")
-					} else if strings.Contains(errorMsg, "NoSuchBucket") {
-						c.String(http.StatusInternalServerError, "Error: Storage configuration error\n")
-					} else {
-						c.String(http.StatusInternalServerError, "Error: Failed to store data\n")
-					}
-					return
+			// Check for specific S3 errors
+			errorMsg := s3Err.Error()
+			if errors.Is(s3Err, utils.ErrInvalidUTF8) {
+				return nil, "", newPasteError(http.StatusBadRequest, "Input text must be UTF-8")
+			} else if errors.Is(s3Err, utils.ErrTooLarge) {
+				return nil, "", newPasteError(http.StatusRequestEntityTooLarge, "File exceeds the maximum size of %d bytes", h.Cfg.PasteMaxSize)
+			} else if strings.Contains(errorMsg, "AccessDenied") || strings.Contains(errorMsg, "Forbidden") {
+				return nil, "", newPasteError(http.StatusInternalServerError, "Storage service access denied")
+			} else if strings.Contains(errorMsg, "ServiceUnavailable") || strings.Contains(errorMsg, "SlowDown") {
+				return nil, "", newPasteError(http.StatusServiceUnavailable, "Storage service temporarily unavailable")
+			} else if strings.Contains(errorMsg, "NoSuchBucket") {
+				return nil, "", newPasteError(http.StatusInternalServerError, "Storage configuration error")
+			}
+			return nil, "", newPasteError(http.StatusInternalServerError, "Failed to store data")
+		}
+		if content.Truncated {
+			if record.Enc {
+				// Only known once the stream ends; deleting the record removes the blob too
+				if err := h.DB.DeleteRedirect(code, ownerID); err != nil {
+					log.Printf("POST: Failed to roll back truncated encrypted paste %s: %v", code, err)
 				}
-				log.Printf("POST: Successfully stored data in S3 - Key: %s", s3Key)
+				return nil, "", newPasteError(http.StatusRequestEntityTooLarge, "Encrypted content exceeds the maximum size")
 			}
+			log.Printf("Truncated input to %d bytes", size)
+		}
+		log.Printf("POST: Successfully stored data in S3 - Key: %s, Size: %d bytes", s3Key, size)
 
-			insertErr = h.DB.PutRedirect(record)
-			if insertErr == nil {
-				log.Printf("POST: Successfully stored metadata - Code: %s (%d chars)", code, currentCodeLength)
+		// Only known now the stream has ended; the paste is usable without them
+		record.Size = size
+		record.Hash = hex.EncodeToString(digest.Sum(nil))
+		if err := h.DB.SetSize(code, size, record.Hash); err != nil {
+			log.Printf("POST: Failed to record size for code %s: %v", code, err)
+		}
+	}
 
-				// Set the owner ID cookie (30 days expiration, no HttpOnly)
-				c.SetCookie("id", ownerID, 30*24*60*60, "/", "", false, false)
+	if more != nil && !isRedirect {
+		if perr := h.addBundleFiles(record, ownerID, content.Truncated, more); perr != nil {
+			return nil, "", perr
+		}
+	}
 
-				// Get session and set user identification values
-				session := sessions.Default(c)
+	return record, deleteToken, nil
+}
 
-				// Check if session already has a userid
-				existingUserID := session.Get("userid")
-				if existingUserID != nil {
-					log.Printf("Extending existing session for userid=%v", existingUserID)
-				} else {
-					log.Printf("Creating new session for userid=%s", ownerID)
-				}
+// pasteLimits reads the optional ttl, expires and views parameters from the
+// query string (or form fields for form input) and checks them against the
+// configured bounds. Without ttl or expires the paste gets the default PasteTTL.
+func (h *Handlers) pasteLimits(c *gin.Context, isFormInput bool, now time.Time) (ettl int64, maxViews int64, err error) {
+	param := func(name string) string {
+		if val := c.Query(name); val != "" {
+			return val
+		}
+		if isFormInput {
+			return c.PostForm(name)
+		}
+		return ""
+	}
 
-				// Set/update session values - userid matches the id cookie
-				session.Set("userid", ownerID)   // Same value as in the id cookie
-				session.Set("provider", "local") // Local authentication provider
+	ttl := time.Duration(h.Cfg.PasteTTL) * time.Second
+	ttlParam, expiresParam := param("ttl"), param("expires")
+	switch {
+	case ttlParam != "" && expiresParam != "":
+		return 0, 0, errors.New("ttl and expires cannot be combined")
+	case ttlParam != "":
+		if ttl, err = utils.ParseTTL(ttlParam); err != nil {
+			return 0, 0, err
+		}
+	case expiresParam != "":
+		expires, err := utils.ParseExpiry(expiresParam)
+		if err != nil {
+			return 0, 0, err
+		}
+		ttl = expires.Sub(now)
+	}
 
-				// Save session - this automatically:
-				// 1. Preserves all existing session values
-				// 2. Re-signs the cookie with the current key
-				// 3. Sets a new expiration 30 days from now (using store's MaxAge)
-				if err := session.Save(); err != nil {
-					log.Printf("Failed to save session: %v", err)
-				}
+	if ttlParam != "" || expiresParam != "" {
+		minTTL := time.Duration(h.Cfg.PasteMinTTL) * time.Second
+		maxTTL := time.Duration(h.Cfg.PasteMaxTTL) * time.Second
+		if ttl < minTTL || ttl > maxTTL {
+			return 0, 0, fmt.Errorf("expiry must be between %d and %d seconds from now", h.Cfg.PasteMinTTL, h.Cfg.PasteMaxTTL)
+		}
+	}
 
-				// Build the full URL
-				scheme := "https"
-				if c.Request.Header.Get("X-Forwarded-Proto") == "" && c.Request.TLS == nil {
-					scheme = "http"
-				}
-				host := c.Request.Host
-				if host == "" {
-					host = "xi.pe"
-				}
-				fullURL := scheme + "://" + host + "/" + code
-
-				// Return response based on whether this was form input
-				if isFormInput {
-					// For form input, redirect to info page like old POST behavior
-					redirectPath := fmt.Sprintf("/%s?from=success", code)
-					// Preserve html parameter if present
-					if c.Request.URL.Query().Has("html") {
-						redirectPath += "&html"
-					}
-					c.Redirect(http.StatusSeeOther, redirectPath)
-				} else {
-					// For raw input, return plain text URL like PUT
-					c.String(http.StatusOK, fullURL+"\n")
-				}
-				return
+	if viewsParam := param("views"); viewsParam != "" {
+		maxViews, err = strconv.ParseInt(viewsParam, 10, 64)
+		if err != nil || maxViews < 1 || maxViews > h.Cfg.PasteMaxViews {
+			return 0, 0, fmt.Errorf("views must be a whole number between 1 and %d", h.Cfg.PasteMaxViews)
+		}
+	}
+
+	return now.Add(ttl).Unix(), maxViews, nil
+}
+
+// checkSlug validates a requested vanity code, returning the HTTP status to
+// fail with
+func checkSlug(slug string) (int, error) {
+	if !utils.IsValidCode(slug) {
+		return http.StatusBadRequest, errors.New("code must be 4-64 letters, digits, - or _ and start with a letter or digit")
+	}
+	if utils.IsReservedSlug(slug) {
+		return http.StatusConflict, fmt.Errorf("code %s is reserved", slug)
+	}
+	return 0, nil
+}
+
+// vanityQuotaKey is the quota key counting the vanity codes claimed from a
+// client IP. The owner cookie can't be used: a client can drop it to get a
+// fresh quota. It is counted across all replicas, and hashed so it is always
+// a safe record key that can never be a valid code.
+func vanityQuotaKey(clientIP string) string {
+	return "_vanity_" + contentHash(clientIP)
+}
+
+// takeVanityQuota takes one use of the vanity quota counted under key,
+// returning the HTTP status to fail with
+func (h *Handlers) takeVanityQuota(key string) (int, error) {
+	if h.Cfg.VanityQuota <= 0 {
+		return 0, nil
+	}
+	ok, err := h.DB.TakeQuota(key, h.Cfg.VanityQuota, time.Duration(h.Cfg.VanityQuotaWindow)*time.Second)
+	if err != nil {
+		log.Printf("POST: Failed to check vanity quota: %v", err)
+		return http.StatusInternalServerError, errors.New("failed to check vanity code quota")
+	}
+	if !ok {
+		return http.StatusTooManyRequests, errors.New("vanity code quota exceeded, try again later")
+	}
+	return 0, nil
+}
+
+// refundVanityQuota gives back a use of the vanity quota taken for a paste
+// that wasn't created after all
+func (h *Handlers) refundVanityQuota(key string) {
+	if h.Cfg.VanityQuota <= 0 {
+		return
+	}
+	if err := h.DB.RefundQuota(key); err != nil {
+		log.Printf("POST: Failed to give back vanity quota: %v", err)
+	}
+}
+
+// insertWithNewCode assigns a fresh random code to record and inserts it.
+// It tries 3 times with 4-character codes, then 3 times with 5-character
+// codes, and returns errCodesExhausted if every attempt collided.
+func (h *Handlers) insertWithNewCode(record *db.RedirectRecord) error {
+	totalAttempts := 0
+
+	for _, currentCodeLength := range []int{4, 5} {
+		for attempts := 0; attempts < 3; attempts++ {
+			totalAttempts++
+			code, err := utils.GenerateUniqueCode(currentCodeLength)
+			if err != nil {
+				log.Printf("Failed to generate code: %v", err)
+				return err
+			}
+			record.Code = code
+
+			log.Printf("POST: Attempting to store data - Code: %s (%d chars), Type: %s, Attempt: %d/6",
+				code, currentCodeLength, record.Typ, totalAttempts)
+
+			insertErr := h.DB.PutRedirect(record)
+			if insertErr == nil {
+				log.Printf("POST: Successfully stored metadata - Code: %s (%d chars)", code, currentCodeLength)
+				return nil
 			}
 
 			// Check if error is due to duplicate key
 			if !isDuplicateKeyError(insertErr) {
 				// Some other error occurred
 				log.Printf("DynamoDB error (not duplicate key): %v", insertErr)
-				c.String(http.StatusInternalServerError, "Error: Failed to store data\n")
-				return
+				return insertErr
 			}
 			log.Printf("POST: Duplicate key error for %d-char code, retrying. Error: %v", currentCodeLength, insertErr)
 			// Continue to next attempt if duplicate key
@@ -270,7 +605,62 @@ func (h *Handlers) PostHandler(c *gin.Context) {
 	}
 
 	// All attempts failed
-	c.String(529, "Error: Could not allocate URL in the target namespace.\n")
+	return errCodesExhausted
+}
+
+// respondCreated sets the owner cookie and session, then returns the new
+// paste's URL (raw input) or redirects to its info page (form input)
+func (h *Handlers) respondCreated(c *gin.Context, code, ownerID string, isFormInput bool) {
+	// Set the owner ID cookie (30 days expiration, no HttpOnly)
+	c.SetCookie("id", ownerID, 30*24*60*60, "/", "", false, false)
+
+	// Get session and set user identification values
+	session := sessions.Default(c)
+
+	// Check if session already has a userid
+	existingUserID := session.Get("userid")
+	if existingUserID != nil {
+		log.Printf("Extending existing session for userid=%v", existingUserID)
+	} else {
+		log.Printf("Creating new session for userid=%s", ownerID)
+	}
+
+	// Set/update session values - userid matches the id cookie
+	session.Set("userid", ownerID)   // Same value as in the id cookie
+	session.Set("provider", "local") // Local authentication provider
+
+	// Save session - this automatically:
+	// 1. Preserves all existing session values
+	// 2. Re-signs the cookie with the current key
+	// 3. Sets a new expiration 30 days from now (using store's MaxAge)
+	if err := session.Save(); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+
+	// Build the full URL
+	scheme := "https"
+	if c.Request.Header.Get("X-Forwarded-Proto") == "" && c.Request.TLS == nil {
+		scheme = "http"
+	}
+	host := c.Request.Host
+	if host == "" {
+		host = "xi.pe"
+	}
+	fullURL := scheme + "://" + host + "/" + code
+
+	// Return response based on whether this was form input
+	if isFormInput {
+		// For form input, redirect to info page like old POST behavior
+		redirectPath := fmt.Sprintf("/%s?from=success", code)
+		// Preserve html parameter if present
+		if c.Request.URL.Query().Has("html") {
+			redirectPath += "&html"
+		}
+		c.Redirect(http.StatusSeeOther, redirectPath)
+	} else {
+		// For raw input, return plain text URL like PUT
+		c.String(http.StatusOK, fullURL+"\n")
+	}
 }
 
 func (h *Handlers) DeleteHandler(c *gin.Context) {
@@ -278,8 +668,19 @@ func (h *Handlers) DeleteHandler(c *gin.Context) {
 
 	// Get owner ID from cookie
 	ownerID, err := c.Cookie("id")
+
+	// A paste's delete token stands in for the owner cookie, for clients such
+	// as CI scripts that don't keep cookies
+	if token := suppliedDeleteToken(c); token != "" {
+		if record, lookupErr := h.DB.GetRedirect(code); lookupErr != nil {
+			log.Printf("Delete token lookup failed for code %s: %v", code, lookupErr)
+		} else if record != nil && validDeleteToken(record, token) {
+			ownerID, err = record.Owner, nil
+		}
+	}
+
 	if err != nil || ownerID == "" {
-		log.Printf("Delete request without valid owner ID cookie for code: %s", code)
+		log.Printf("Delete request without valid owner ID cookie or delete token for code: %s", code)
 		if utils.ShouldReturnHTML(c) {
 			// For browser clients, redirect to error page
 			c.HTML(http.StatusUnauthorized, "error.html", gin.H{
@@ -5,14 +5,20 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/drewstreib/xipe-go/config"
 	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPostHandlerSimple(t *testing.T) {
@@ -105,3 +111,451 @@ func TestPostHandlerSimple(t *testing.T) {
 		mockS3.AssertExpectations(t)
 	})
 }
+
+func TestPostHandlerStreaming(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		PasteTTL:                86400 * 7,
+		PasteDynamoDBCutoffSize: 16,
+		PasteMaxSize:            40,
+	}
+
+	newRouter := func(h *Handlers) *gin.Engine {
+		r := gin.New()
+		store := cookie.NewStore([]byte("test-secret-key"))
+		r.Use(sessions.Sessions("xipe_session", store))
+		r.POST("/", h.PostHandler)
+		return r
+	}
+
+	t.Run("Large body is streamed to S3 and truncated on a rune boundary", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		var stored *db.RedirectRecord
+		mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+			stored = args.Get(0).(*db.RedirectRecord)
+		}).Return(nil)
+
+		// 38 ASCII bytes followed by a 3-byte character that would cross the 40-byte limit
+		body := strings.Repeat("x", 38) + "€tail"
+		mockS3.On("PutObjectStream", mock.AnythingOfType("string"), []byte(strings.Repeat("x", 38))).Return(nil)
+		mockDB.On("SetSize", mock.AnythingOfType("string"), int64(38), mock.AnythingOfType("string")).Return(nil)
+
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "S", stored.Typ)
+		assert.Empty(t, stored.Val)
+		mockS3.AssertCalled(t, "PutObjectStream", db.BlobKey(stored.Code), mock.Anything)
+		mockDB.AssertExpectations(t)
+		mockS3.AssertExpectations(t)
+	})
+
+	t.Run("Invalid UTF-8 after the cutoff rolls back the metadata", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Return(nil)
+		mockDB.On("DeleteRedirect", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(nil)
+
+		// Deliver the body byte by byte so the bad byte arrives after the storage decision
+		body := strings.Repeat("x", 20) + "\xff"
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/", iotest.OneByteReader(strings.NewReader(body))))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "UTF-8")
+		mockDB.AssertExpectations(t)
+		mockS3.AssertNotCalled(t, "PutObjectStream", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Invalid UTF-8 before the cutoff stores nothing", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("bad\xffinput")))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		mockDB.AssertNotCalled(t, "PutRedirect", mock.Anything)
+	})
+}
+
+func TestPostHandlerBurn(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		PasteTTL:                86400 * 7,
+		PasteDynamoDBCutoffSize: 10240,
+		PasteMaxSize:            2097152,
+	}
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		expectBurn  bool
+	}{
+		{"Raw body with burn parameter", "/?burn", "text/plain", "secret", true},
+		{"Raw body without burn parameter", "/", "text/plain", "secret", false},
+		{"Form with burn checkbox", "/?input=form&html", "application/x-www-form-urlencoded", "data=secret&burn=1", true},
+		{"Form without burn checkbox", "/?input=form&html", "application/x-www-form-urlencoded", "data=secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+
+			r := gin.New()
+			store := cookie.NewStore([]byte("test-secret-key"))
+			r.Use(sessions.Sessions("xipe_session", store))
+			r.POST("/", h.PostHandler)
+
+			req := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Less(t, w.Code, 400)
+			assert.Equal(t, "secret", stored.Val)
+			assert.Equal(t, tt.expectBurn, stored.Burn)
+		})
+	}
+}
+
+func TestPostHandlerLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		PasteTTL:                86400 * 7,
+		PasteMinTTL:             60,
+		PasteMaxTTL:             86400 * 30,
+		PasteMaxViews:           100,
+		PasteDynamoDBCutoffSize: 10240,
+		PasteMaxSize:            2097152,
+	}
+	future := time.Now().Add(48 * time.Hour).UTC()
+
+	tests := []struct {
+		name           string
+		target         string
+		expectedStatus int
+		expectedTTL    time.Duration
+		expectedViews  int64
+	}{
+		{"Default TTL", "/", http.StatusOK, 7 * 24 * time.Hour, 0},
+		{"Duration TTL", "/?ttl=1h", http.StatusOK, time.Hour, 0},
+		{"Day TTL", "/?ttl=2d", http.StatusOK, 48 * time.Hour, 0},
+		{"Absolute expiry", "/?expires=" + future.Format("2006-01-02T15:04Z"), http.StatusOK, 48 * time.Hour, 0},
+		{"View limit", "/?views=3", http.StatusOK, 7 * 24 * time.Hour, 3},
+		{"TTL below minimum", "/?ttl=10s", http.StatusBadRequest, 0, 0},
+		{"TTL above maximum", "/?ttl=60d", http.StatusBadRequest, 0, 0},
+		{"Expiry in the past", "/?expires=2020-01-01", http.StatusBadRequest, 0, 0},
+		{"TTL and expiry together", "/?ttl=1h&expires=" + future.Format(time.RFC3339), http.StatusBadRequest, 0, 0},
+		{"Unparseable TTL", "/?ttl=soon", http.StatusBadRequest, 0, 0},
+		{"Zero views", "/?views=0", http.StatusBadRequest, 0, 0},
+		{"Too many views", "/?views=101", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+
+			r := gin.New()
+			store := cookie.NewStore([]byte("test-secret-key"))
+			r.Use(sessions.Sessions("xipe_session", store))
+			r.POST("/", h.PostHandler)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", tt.target, strings.NewReader("content")))
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus != http.StatusOK {
+				mockDB.AssertNotCalled(t, "PutRedirect", mock.Anything)
+				return
+			}
+			// Absolute expiries are given to the minute
+			assert.InDelta(t, time.Now().Add(tt.expectedTTL).Unix(), stored.Ettl, 60)
+			assert.Equal(t, tt.expectedViews, stored.MaxViews)
+		})
+	}
+}
+
+func TestPostHandlerEncrypted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		PasteTTL:                86400 * 7,
+		PasteDynamoDBCutoffSize: 16,
+		PasteMaxSize:            40,
+	}
+
+	newRouter := func(h *Handlers) *gin.Engine {
+		r := gin.New()
+		store := cookie.NewStore([]byte("test-secret-key"))
+		r.Use(sessions.Sessions("xipe_session", store))
+		r.POST("/", h.PostHandler)
+		return r
+	}
+
+	t.Run("Ciphertext is stored with the marker", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+		var stored *db.RedirectRecord
+		mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+			stored = args.Get(0).(*db.RedirectRecord)
+		}).Return(nil)
+
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/?enc", strings.NewReader("q83vEjRWeJA")))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, stored.Enc)
+		assert.Equal(t, "q83vEjRWeJA", stored.Val)
+	})
+
+	t.Run("Oversized inline ciphertext is refused", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: &config.Config{PasteTTL: 86400, PasteDynamoDBCutoffSize: 100, PasteMaxSize: 10}}
+
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/?enc", strings.NewReader(strings.Repeat("A", 20))))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		mockDB.AssertNotCalled(t, "PutRedirect", mock.Anything)
+	})
+
+	t.Run("Oversized streamed ciphertext is rolled back", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Return(nil)
+		mockDB.On("DeleteRedirect", mock.AnythingOfType("string"), mock.AnythingOfType("string")).Return(nil)
+		mockS3.On("PutObjectStream", mock.AnythingOfType("string"), mock.Anything).Return(nil)
+
+		w := httptest.NewRecorder()
+		body := iotest.OneByteReader(strings.NewReader(strings.Repeat("A", 60)))
+		newRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/?enc", body))
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		mockDB.AssertExpectations(t)
+	})
+}
+
+func TestPostHandlerVanityCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	utils.ReservedCodes["privacy"] = true
+
+	tests := []struct {
+		name           string
+		target         string
+		quota          int64
+		setupMock      func(*db.MockDB)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:   "Free slug is used as the code",
+			target: "/?slug=release-notes",
+			setupMock: func(m *db.MockDB) {
+				m.On("PutRedirect", mock.MatchedBy(func(r *db.RedirectRecord) bool { return r.Code == "release-notes" })).Return(nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "/release-notes\n",
+		},
+		{
+			name:   "Taken slug is a conflict",
+			target: "/?slug=release-notes",
+			setupMock: func(m *db.MockDB) {
+				m.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Return(&types.ConditionalCheckFailedException{})
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "Taken slug gives the quota back",
+			target: "/?slug=release-notes",
+			quota:  3,
+			setupMock: func(m *db.MockDB) {
+				m.On("TakeQuota", vanityQuotaKey("192.0.2.1"),
+					int64(3), time.Hour).Return(true, nil)
+				m.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Return(&types.ConditionalCheckFailedException{})
+				m.On("RefundQuota", vanityQuotaKey("192.0.2.1")).Return(nil)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "Stored slug keeps the quota",
+			target: "/?slug=release-notes",
+			quota:  3,
+			setupMock: func(m *db.MockDB) {
+				m.On("TakeQuota", vanityQuotaKey("192.0.2.1"),
+					int64(3), time.Hour).Return(true, nil)
+				m.On("PutRedirect", mock.MatchedBy(func(r *db.RedirectRecord) bool { return r.Code == "release-notes" })).Return(nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "/release-notes\n",
+		},
+		{
+			name:           "Rejected paste doesn't take the quota",
+			target:         "/?slug=release-notes&ttl=bogus",
+			quota:          3,
+			setupMock:      func(m *db.MockDB) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Reserved page name is a conflict",
+			target:         "/?slug=Privacy",
+			setupMock:      func(m *db.MockDB) {},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Route name is a conflict",
+			target:         "/?slug=api",
+			setupMock:      func(m *db.MockDB) {},
+			expectedStatus: http.StatusBadRequest, // Too short for the grammar anyway
+		},
+		{
+			name:           "Invalid characters",
+			target:         "/?slug=no.dots",
+			setupMock:      func(m *db.MockDB) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Quota exceeded",
+			target: "/?slug=release-notes",
+			quota:  3,
+			setupMock: func(m *db.MockDB) {
+				m.On("TakeQuota", vanityQuotaKey("192.0.2.1"),
+					int64(3), time.Hour).Return(false, nil)
+			},
+			expectedStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			tt.setupMock(mockDB)
+			cfg := &config.Config{
+				PasteTTL:                86400,
+				PasteDynamoDBCutoffSize: 10240,
+				PasteMaxSize:            2097152,
+				VanityQuota:             tt.quota,
+				VanityQuotaWindow:       3600,
+			}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+			r := gin.New()
+			store := cookie.NewStore([]byte("test-secret-key"))
+			r.Use(sessions.Sessions("xipe_session", store))
+			r.POST("/", h.PostHandler)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", tt.target, strings.NewReader("content")))
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.True(t, strings.HasSuffix(w.Body.String(), tt.expectedBody), w.Body.String())
+			}
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestVanityQuotaKey(t *testing.T) {
+	// Keyed on the client IP, whatever owner cookie is sent
+	v4, v6 := vanityQuotaKey("192.0.2.1"), vanityQuotaKey("2001:db8::1")
+	assert.NotEqual(t, v4, v6)
+	assert.Equal(t, v4, vanityQuotaKey("192.0.2.1"))
+	for _, key := range []string{v4, v6} {
+		assert.True(t, strings.HasPrefix(key, "_vanity_"))
+		assert.False(t, strings.ContainsAny(key, `/\:.`), key)
+		assert.False(t, utils.IsValidCode(key))
+	}
+}
+
+func TestDeleteHandlerToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 86400, PasteDynamoDBCutoffSize: 10240, PasteMaxSize: 2097152}
+	mockDB := &db.MockDB{}
+	h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+	var stored *db.RedirectRecord
+	mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+		stored = args.Get(0).(*db.RedirectRecord)
+	}).Return(nil)
+
+	r := gin.New()
+	r.Use(sessions.Sessions("xipe_session", cookie.NewStore([]byte("test-secret-key"))))
+	r.POST("/", h.PostHandler)
+	r.DELETE("/:code", h.DeleteHandler)
+
+	// Creating a paste returns its delete token in a header, the body stays a bare URL
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("from CI")))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, stored)
+	token := w.Header().Get("X-Delete-Token")
+	require.NotEmpty(t, token)
+	assert.Equal(t, hashDeleteToken(token), stored.DelHash)
+	assert.NotContains(t, w.Body.String(), token)
+
+	code := stored.Code
+	mockDB.On("GetRedirect", code).Return(stored, nil)
+	mockDB.On("DeleteRedirect", code, stored.Owner).Return(nil)
+	mockDB.On("DeleteRedirect", code, "someone-else").Return(&types.ConditionalCheckFailedException{})
+
+	tests := []struct {
+		name           string
+		setup          func(*http.Request)
+		expectedStatus int
+	}{
+		{"Token in header", func(r *http.Request) { r.Header.Set("X-Delete-Token", token) }, http.StatusOK},
+		{"Token in query", func(r *http.Request) { r.URL.RawQuery = "token=" + token }, http.StatusOK},
+		{"Bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }, http.StatusOK},
+		{"Owner cookie still works", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: stored.Owner}) }, http.StatusOK},
+		{"Valid token beats a wrong cookie", func(r *http.Request) {
+			r.Header.Set("X-Delete-Token", token)
+			r.AddCookie(&http.Cookie{Name: "id", Value: "someone-else"})
+		}, http.StatusOK},
+		{"Wrong token", func(r *http.Request) { r.Header.Set("X-Delete-Token", "wrong") }, http.StatusUnauthorized},
+		{"Wrong token and wrong cookie", func(r *http.Request) {
+			r.Header.Set("X-Delete-Token", "wrong")
+			r.AddCookie(&http.Cookie{Name: "id", Value: "someone-else"})
+		}, http.StatusUnauthorized},
+		{"Nothing", func(r *http.Request) {}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/"+code, nil)
+			req.Header.Set("User-Agent", "curl/8.0")
+			tt.setup(req)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
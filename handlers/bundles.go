@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBundleFiles caps the number of files in a multi-file paste
+const maxBundleFiles = 100
+
+// archiveFormats are the suffixes a multi-file paste can be downloaded
+// whole with, as /:code.zip or /:code.tar.gz
+var archiveFormats = []string{".zip", ".tar.gz"}
+
+// bundleSource yields the files of an upload after its first
+type bundleSource interface {
+	// next returns the name and content of the next file, or io.EOF
+	next() (string, io.Reader, error)
+}
+
+// multipartFiles yields the remaining file parts of a multipart upload
+type multipartFiles struct {
+	reader *multipart.Reader
+}
+
+func (m *multipartFiles) next() (string, io.Reader, error) {
+	part, err := nextUploadPart(m.reader)
+	if err != nil {
+		return "", nil, err
+	}
+	return cleanFilename(part.FileName()), part, nil
+}
+
+// jsonFile is one element of a JSON array upload
+type jsonFile struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// jsonFiles yields the remaining files of a JSON array upload
+type jsonFiles []jsonFile
+
+func (j *jsonFiles) next() (string, io.Reader, error) {
+	if len(*j) == 0 {
+		return "", nil, io.EOF
+	}
+	file := (*j)[0]
+	*j = (*j)[1:]
+	return cleanFilename(file.Name), strings.NewReader(file.Content), nil
+}
+
+// jsonArrayBody reports whether the request is JSON whose body is an array,
+// i.e. a list of files, and returns the body with the peeked bytes still
+// unread. Any other JSON is an ordinary paste.
+func jsonArrayBody(c *gin.Context) (*bufio.Reader, bool) {
+	body := bufio.NewReader(c.Request.Body)
+	if c.ContentType() != "application/json" {
+		return body, false
+	}
+	for n := 1; n <= 512; n++ {
+		peek, err := body.Peek(n)
+		if len(peek) < n {
+			return body, false
+		}
+		if b := peek[n-1]; b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return body, b == '['
+		}
+		if err != nil {
+			return body, false
+		}
+	}
+	return body, false
+}
+
+// readJSONFiles decodes a JSON array of {"name", "content"} objects. The
+// array is read whole, so it is limited to twice the maximum paste size to
+// leave room for escaping.
+func readJSONFiles(body io.Reader, maxSize int64) (jsonFiles, *pasteError) {
+	var files jsonFiles
+	err := json.NewDecoder(utils.NewMaxSizeReader(body, 2*maxSize)).Decode(&files)
+	if errors.Is(err, utils.ErrTooLarge) {
+		return nil, newPasteError(http.StatusRequestEntityTooLarge, "Multi-file pastes cannot exceed %d bytes in total", maxSize)
+	}
+	if err != nil {
+		return nil, newPasteError(http.StatusBadRequest, "A JSON array upload must be a list of {\"name\", \"content\"} objects")
+	}
+	if len(files) == 0 {
+		return nil, newPasteError(http.StatusBadRequest, "Cannot store empty content")
+	}
+	return files, nil
+}
+
+// addBundleFiles turns a stored upload into a multi-file paste if more files
+// follow its first. The first file stays where createPaste put it, moved to
+// the blob store if it was stored inline, and the rest are streamed to blobs
+// of their own before the manifest is recorded. On failure the whole paste is
+// removed again.
+func (h *Handlers) addBundleFiles(record *db.RedirectRecord, ownerID string, truncated bool, more bundleSource) *pasteError {
+	name, content, err := more.next()
+	if errors.Is(err, io.EOF) {
+		return nil // Just the one file
+	}
+
+	code := record.Code
+	maxSize := int64(h.Cfg.PasteMaxSize)
+	files := db.BundleFiles{{Name: record.Filename, Size: record.Size, Mime: record.Mime, Hash: record.Hash}}
+	uploaded := 0
+	fail := func(perr *pasteError) *pasteError {
+		if err := h.DB.DeleteRedirect(code, ownerID); err != nil {
+			log.Printf("POST: Failed to roll back multi-file paste %s: %v", code, err)
+		}
+		for n := 0; n < uploaded; n++ {
+			if err := h.S3.DeleteObject(db.FileBlobKey(code, n)); err != nil {
+				log.Printf("POST: Failed to delete file %d of %s, leaving it for GC: %v", n, code, err)
+			}
+		}
+		return perr
+	}
+
+	if err != nil {
+		return fail(newPasteError(http.StatusBadRequest, "%s", err.Error()))
+	}
+	if record.Enc {
+		return fail(newPasteError(http.StatusBadRequest, "Multi-file pastes cannot be encrypted"))
+	}
+	// Each file is read on its own, and the first read would take the others
+	// with it
+	if record.Burn || record.MaxViews > 0 {
+		return fail(newPasteError(http.StatusBadRequest, "Multi-file pastes cannot be burned after reading or limited to a number of views"))
+	}
+	if record.Filename == "" {
+		return fail(newPasteError(http.StatusBadRequest, "Every file of a multi-file paste needs a name"))
+	}
+	if record.Lang != "" {
+		return fail(newPasteError(http.StatusBadRequest, "Each file of a multi-file paste is highlighted by its name, lang cannot be used"))
+	}
+	if truncated {
+		return fail(newPasteError(http.StatusRequestEntityTooLarge, "Multi-file pastes cannot exceed %d bytes in total", maxSize))
+	}
+	if record.Typ == "D" {
+		// Every file of a bundle is in the blob store, the first one included
+		if err := h.S3.PutObject(db.BlobKey(code), []byte(record.Val)); err != nil {
+			log.Printf("POST: Failed to move first file of %s to S3: %v", code, err)
+			return fail(newPasteError(http.StatusInternalServerError, "Failed to store data"))
+		}
+	}
+	uploaded = 1
+
+	for ; err == nil; name, content, err = more.next() {
+		switch {
+		case len(files) >= maxBundleFiles:
+			return fail(newPasteError(http.StatusBadRequest, "A paste can hold at most %d files", maxBundleFiles))
+		case name == "":
+			return fail(newPasteError(http.StatusBadRequest, "Every file of a multi-file paste needs a name"))
+		case files.Index(name) >= 0:
+			return fail(newPasteError(http.StatusBadRequest, "Duplicate file name %s", name))
+		}
+
+		// Unlike a single paste, a file of a bundle is never truncated
+		limited := bufio.NewReader(utils.NewMaxSizeReader(content, maxSize-files.Size()))
+		peek, err := limited.Peek(512)
+		if err != nil && err != io.EOF && !errors.Is(err, utils.ErrTooLarge) {
+			return fail(newPasteError(http.StatusBadRequest, "Failed to read request body"))
+		}
+		mimeType := binaryType(peek)
+		var body io.Reader = limited
+		if mimeType == "" {
+			body = utils.NewUTF8LimitReader(limited, maxSize+1)
+		}
+
+		s3Key := db.FileBlobKey(code, len(files))
+		digest := sha256.New()
+		size, err := h.S3.PutObjectStream(s3Key, io.TeeReader(body, digest))
+		if err != nil {
+			switch {
+			case errors.Is(err, utils.ErrTooLarge):
+				return fail(newPasteError(http.StatusRequestEntityTooLarge, "Multi-file pastes cannot exceed %d bytes in total", maxSize))
+			case errors.Is(err, utils.ErrInvalidUTF8):
+				return fail(newPasteError(http.StatusBadRequest, "Input text must be UTF-8"))
+			}
+			log.Printf("POST: Failed to store file %s of %s in S3: %v", name, code, err)
+			return fail(newPasteError(http.StatusInternalServerError, "Failed to store data"))
+		}
+		uploaded++
+		files = append(files, db.BundleFile{Name: name, Size: size, Mime: mimeType, Hash: hex.EncodeToString(digest.Sum(nil))})
+	}
+	if !errors.Is(err, io.EOF) {
+		return fail(newPasteError(http.StatusBadRequest, "%s", err.Error()))
+	}
+
+	if err := h.DB.SetFiles(code, files); err != nil {
+		log.Printf("POST: Failed to record files of %s: %v", code, err)
+		return fail(newPasteError(http.StatusInternalServerError, "Failed to store data"))
+	}
+	log.Printf("POST: Stored %d files for code %s", len(files), code)
+
+	record.Typ = "B"
+	record.Val = ""
+	record.Filename = ""
+	record.Mime = ""
+	record.Lang = ""
+	record.Hash = ""
+	record.Files = files
+	record.Size = files.Size()
+	return nil
+}
+
+// archivePath splits /:code.zip or /:code.tar.gz into the code and format
+func archivePath(path string) (string, string, bool) {
+	for _, format := range archiveFormats {
+		if code, ok := strings.CutSuffix(path, format); ok && utils.IsValidCode(code) {
+			return code, format, true
+		}
+	}
+	return "", "", false
+}
+
+// bundleFileView is one file of a multi-file paste as data.html shows it
+type bundleFileView struct {
+	Name     string
+	Anchor   string // Element id of the file's block
+	Path     string // URL path of the raw file
+	Size     int64
+	Preview  string // How a binary file is shown, see previewKind
+	Binary   bool
+	Lang     string        // Highlighting language of a text file
+	Content  template.HTML // Highlighted text of a text file
+	Markdown bool          // Content is rendered Markdown instead
+}
+
+// bundleFileURL returns the URL of one file of a multi-file paste from the
+// URL, or path, of the paste
+func bundleFileURL(pasteURL, name string) string {
+	return pasteURL + "/" + url.PathEscape(name)
+}
+
+// bundleAnchor returns the element id of a file's block on the paste page
+func bundleAnchor(name string) string {
+	return "file-" + strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+// serveBundle answers a read of a multi-file paste: one file raw for
+// /:code/:filename, the whole paste as an archive for /:code.zip, .tar.gz or
+// ?download, the paste page for browsers, and otherwise the URL of each file.
+func (h *Handlers) serveBundle(c *gin.Context, record *db.RedirectRecord, fullURL string, wantHTML, isOwner, burned bool) {
+	filename, archive := c.Param("filename"), c.Param("archive")
+	download := c.Request.URL.Query().Has("download")
+	if download && filename == "" && archive == "" {
+		archive = ".zip"
+	}
+
+	setCacheHeaders(c, record, 0)
+
+	switch {
+	case filename != "":
+		n := record.Files.Index(filename)
+		if n < 0 {
+			respondError(c, http.StatusNotFound, "File not found")
+			return
+		}
+		file := record.Files[n]
+		var stored *storedContent
+		if hashVisible(record, isOwner) {
+			stored = &storedContent{hash: file.Hash, size: file.Size, modified: record.Created}
+		}
+		h.streamFile(c, db.FileBlobKey(record.Code, n), filename, file.Mime, download, stored)
+	case archive != "":
+		h.writeArchive(c, record, archive)
+	case wantHTML:
+		h.renderBundle(c, record, fullURL, isOwner, burned)
+	default:
+		var list strings.Builder
+		base := pasteURL(c, record.Code)
+		for _, file := range record.Files {
+			list.WriteString(bundleFileURL(base, file.Name) + "\n")
+		}
+		c.String(http.StatusOK, list.String())
+	}
+}
+
+// renderBundle shows every file of a multi-file paste on one page, text in
+// its own highlighted block and binary files as a preview or a link
+func (h *Handlers) renderBundle(c *gin.Context, record *db.RedirectRecord, fullURL string, isOwner, burned bool) {
+	// As for single files, a preview would be a second, counted read
+	protected := record.PassHash != "" || record.Burn || record.MaxViews > 0
+	files := make([]bundleFileView, len(record.Files))
+	hasMarkdown, markdownView := false, false
+	for n, file := range record.Files {
+		view := bundleFileView{
+			Name:   file.Name,
+			Anchor: bundleAnchor(file.Name),
+			Path:   bundleFileURL("/"+record.Code, file.Name),
+			Size:   file.Size,
+			Binary: file.Mime != "",
+		}
+		if view.Binary {
+			if isOwner || !protected {
+				view.Preview = previewKind(file.Mime)
+			}
+			files[n] = view
+			continue
+		}
+
+		s3Key := db.FileBlobKey(record.Code, n)
+		stream, ok := h.openBlob(c, s3Key)
+		if !ok {
+			return
+		}
+		data, err := io.ReadAll(stream)
+		if closeErr := stream.Close(); closeErr != nil {
+			log.Printf("Failed to close S3 stream for %s: %v", s3Key, closeErr)
+		}
+		if err != nil {
+			log.Printf("S3 error reading %s: %v", s3Key, err)
+			respondError(c, http.StatusInternalServerError, "Failed to retrieve content")
+			return
+		}
+		view.Lang = languageForFile(file.Name)
+		text := string(data)
+		isMarkdown := isMarkdownFile(file.Name)
+		hasMarkdown = hasMarkdown || isMarkdown
+		// Line anchors are per file, as #file-main.go-L3
+		switch mode := pageRender(c, isMarkdown, text); {
+		case mode == renderModeMarkdown && isMarkdown:
+			// Only the Markdown files are rendered
+			view.Markdown, markdownView = true, true
+			view.Content = h.markdownPaste(record, text)
+		case mode == renderModeANSI:
+			view.Content = h.ansiPaste(record, text, view.Anchor+"-L")
+		default:
+			view.Content = h.highlightPaste(record, text, view.Lang, view.Anchor+"-L")
+		}
+		files[n] = view
+	}
+
+	c.HTML(http.StatusOK, "data.html", gin.H{
+		"code":         record.Code,
+		"url":          fullURL,
+		"files":        files,
+		"size":         record.Size,
+		"isMarkdown":   hasMarkdown,
+		"markdownView": markdownView,
+		"noh":          c.Request.URL.Query().Has("noh"),
+		"fromSuccess":  c.Query("from") == "success",
+		"created":      record.Created,
+		"expires":      record.Ettl,
+		"showDelete":   isOwner,
+		"isStaticPage": false,
+		"burn":         record.Burn,
+		"burned":       burned,
+		"maxViews":     record.MaxViews,
+		"viewsLeft":    record.MaxViews - record.Views,
+	})
+}
+
+// writeArchive streams every file of a multi-file paste as a zip or gzipped
+// tar archive. Once the first byte is sent a failing blob can only be logged,
+// leaving the client with a truncated archive.
+func (h *Handlers) writeArchive(c *gin.Context, record *db.RedirectRecord, format string) {
+	contentType := "application/zip"
+	if format == ".tar.gz" {
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", contentDisposition("attachment", record.Code+format))
+	c.Status(http.StatusOK)
+
+	modified := time.Unix(record.Created, 0)
+	var err error
+	if format == ".zip" {
+		zw := zip.NewWriter(c.Writer)
+		for n, file := range record.Files {
+			header := &zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: modified}
+			if file.Mime != "" {
+				// Binary formats are mostly compressed already
+				header.Method = zip.Store
+			}
+			var w io.Writer
+			if w, err = zw.CreateHeader(header); err != nil {
+				break
+			}
+			if err = h.copyBlob(w, db.FileBlobKey(record.Code, n)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+	} else {
+		gz := gzip.NewWriter(c.Writer)
+		tw := tar.NewWriter(gz)
+		for n, file := range record.Files {
+			header := &tar.Header{Name: file.Name, Mode: 0o644, Size: file.Size, ModTime: modified, Typeflag: tar.TypeReg}
+			if err = tw.WriteHeader(header); err != nil {
+				break
+			}
+			if err = h.copyBlob(tw, db.FileBlobKey(record.Code, n)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = errors.Join(tw.Close(), gz.Close())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write %s archive of %s: %v", format, record.Code, err)
+	}
+}
+
+// copyBlob streams the blob at s3Key into w
+func (h *Handlers) copyBlob(w io.Writer, s3Key string) error {
+	stream, err := h.S3.GetObjectStream(s3Key)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", s3Key, err)
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			log.Printf("Failed to close S3 stream for %s: %v", s3Key, err)
+		}
+	}()
+	_, err = io.Copy(w, stream)
+	return err
+}
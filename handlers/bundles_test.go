@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchivePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		code   string
+		format string
+		ok     bool
+	}{
+		{"abcd.zip", "abcd", ".zip", true},
+		{"abcd.tar.gz", "abcd", ".tar.gz", true},
+		{"abcd.tar", "", "", false},
+		{"ab.zip", "", "", false},
+		{".zip", "", "", false},
+	}
+
+	for _, tt := range tests {
+		code, format, ok := archivePath(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.code, code, tt.path)
+		assert.Equal(t, tt.format, format, tt.path)
+	}
+}
+
+func TestPostHandlerBundle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 3600, PasteDynamoDBCutoffSize: 1024, PasteMaxSize: 64, PasteMaxViews: 10}
+
+	type file struct{ name, content string }
+	multipartBody := func(files []file) (*bytes.Buffer, string) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for _, f := range files {
+			part, err := writer.CreateFormFile("file", f.name)
+			require.NoError(t, err)
+			_, err = part.Write([]byte(f.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+		return &body, writer.FormDataContentType()
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		files          []file // Sent as a multipart upload when set
+		json           string // Sent as the JSON body otherwise
+		expectedStatus int
+		expectedFiles  db.BundleFiles
+		expectedError  string
+	}{
+		{
+			"Multipart files", "/", []file{{"main.go", "package main\n"}, {"go.mod", "module x\n"}, {"pixel.png", pngData}}, "",
+			http.StatusOK,
+			db.BundleFiles{
+				{Name: "main.go", Size: 13, Hash: contentHash("package main\n")},
+				{Name: "go.mod", Size: 9, Hash: contentHash("module x\n")},
+				{Name: "pixel.png", Size: int64(len(pngData)), Mime: "image/png", Hash: contentHash(pngData)},
+			},
+			"",
+		},
+		{
+			"JSON array", "/", nil, `[{"name": "a.txt", "content": "one"}, {"name": "b.txt", "content": "two"}]`,
+			http.StatusOK,
+			db.BundleFiles{{Name: "a.txt", Size: 3, Hash: contentHash("one")}, {Name: "b.txt", Size: 3, Hash: contentHash("two")}},
+			"",
+		},
+		{"Duplicate names", "/", []file{{"a.txt", "one"}, {"a.txt", "two"}}, "", http.StatusBadRequest, nil, "Duplicate file name a.txt"},
+		{"Unnamed file", "/", nil, `[{"name": "a.txt", "content": "one"}, {"content": "two"}]`, http.StatusBadRequest, nil, "needs a name"},
+		{"Too large in total", "/", []file{{"a.txt", string(make([]byte, 40))}, {"b.txt", string(make([]byte, 40))}}, "", http.StatusRequestEntityTooLarge, nil, "cannot exceed 64 bytes"},
+		{"Encrypted", "/?enc", []file{{"a.txt", "one"}, {"b.txt", "two"}}, "", http.StatusBadRequest, nil, "cannot be encrypted"},
+		{"Burn after reading", "/?burn", []file{{"a.txt", "one"}, {"b.txt", "two"}}, "", http.StatusBadRequest, nil, "cannot be burned after reading"},
+		{"View limit", "/?views=3", []file{{"a.txt", "one"}, {"b.txt", "two"}}, "", http.StatusBadRequest, nil, "limited to a number of views"},
+		{"Not a list of files", "/", nil, `[1, 2]`, http.StatusBadRequest, nil, "must be a list of"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+			mockDB.On("SetSize", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			mockDB.On("SetFiles", mock.Anything, mock.Anything).Return(nil)
+			mockDB.On("DeleteRedirect", mock.Anything, mock.Anything).Return(nil)
+			mockS3.On("PutObject", mock.Anything, mock.Anything).Return(nil)
+			mockS3.On("PutObjectStream", mock.Anything, mock.Anything).Return(nil)
+			mockS3.On("DeleteObject", mock.Anything).Return(nil)
+
+			r := gin.New()
+			r.Use(sessions.Sessions("xipe_session", cookie.NewStore([]byte("test-secret-key"))))
+			r.POST("/", h.PostHandler)
+
+			var req *http.Request
+			if tt.files != nil {
+				body, contentType := multipartBody(tt.files)
+				req = httptest.NewRequest("POST", tt.path, body)
+				req.Header.Set("Content-Type", contentType)
+			} else {
+				req = httptest.NewRequest("POST", tt.path, bytes.NewBufferString(tt.json))
+				req.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedError != "" {
+				assert.Contains(t, w.Body.String(), tt.expectedError)
+				mockDB.AssertNotCalled(t, "SetFiles", mock.Anything, mock.Anything)
+				if stored != nil {
+					mockDB.AssertCalled(t, "DeleteRedirect", stored.Code, mock.Anything)
+				}
+				return
+			}
+
+			require.NotNil(t, stored)
+			mockDB.AssertCalled(t, "SetFiles", stored.Code, tt.expectedFiles)
+			// The first file was small enough to be stored inline, so it is moved
+			mockS3.AssertCalled(t, "PutObject", "S/"+stored.Code+".zst", mock.Anything)
+			mockS3.AssertCalled(t, "PutObjectStream", "S/"+stored.Code+"/1.zst", mock.Anything)
+		})
+	}
+}
+
+func TestDataHandlerBundle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	bundle := &db.RedirectRecord{
+		Code: "bndl", Typ: "B", Ettl: future, Size: int64(13 + len(pngData)),
+		Files: db.BundleFiles{{Name: "main.go", Size: 13}, {Name: "pixel.png", Size: int64(len(pngData)), Mime: "image/png"}},
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		userAgent      string
+		expectedStatus int
+		expectedType   string
+		expectedBody   string
+	}{
+		{"File list", "/bndl", "curl/8.0", http.StatusOK, "text/plain; charset=utf-8", "http://example.com/bndl/main.go\nhttp://example.com/bndl/pixel.png\n"},
+		{"Text file", "/bndl/main.go", "curl/8.0", http.StatusOK, "text/x-go; charset=utf-8", "package main\n"},
+		{"Binary file", "/bndl/pixel.png", "curl/8.0", http.StatusOK, "image/png", pngData},
+		{"Missing file", "/bndl/other.go", "curl/8.0", http.StatusNotFound, "text/plain; charset=utf-8", "File not found"},
+		{"Lines of a text file", "/bndl/main.go?head=1", "curl/8.0", http.StatusOK, "text/x-go; charset=utf-8", "package main\n"},
+		{"Lines of a binary file", "/bndl/pixel.png?head=1", "curl/8.0", http.StatusBadRequest, "text/plain; charset=utf-8", "only apply to text files"},
+		{"Lines of the whole paste", "/bndl?head=1", "curl/8.0", http.StatusBadRequest, "text/plain; charset=utf-8", "only apply to text pastes"},
+		{"Paste page", "/bndl", "Mozilla/5.0 (browser)", http.StatusOK, "text/html; charset=utf-8", `id="file-main.go"`},
+		{"Zip archive", "/bndl.zip", "curl/8.0", http.StatusOK, "application/zip", ""},
+		{"Tar archive", "/bndl.tar.gz", "curl/8.0", http.StatusOK, "application/gzip", ""},
+		{"Download is a zip archive", "/bndl?download", "Mozilla/5.0 (browser)", http.StatusOK, "application/zip", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			mockDB.On("GetRedirect", "bndl").Return(bundle, nil)
+			mockS3.On("GetObjectStream", "S/bndl.zst").Return([]byte("package main\n"), nil)
+			mockS3.On("GetObjectStream", "S/bndl/1.zst").Return([]byte(pngData), nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			router.GET("/:code/:filename", h.DataHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.Equal(t, tt.expectedType, w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			if tt.expectedType == "application/zip" {
+				assertArchive(t, w.Body.Bytes(), true)
+			}
+			if tt.expectedType == "application/gzip" {
+				assertArchive(t, w.Body.Bytes(), false)
+			}
+		})
+	}
+}
+
+// assertArchive checks a downloaded archive holds the files of the test bundle
+func assertArchive(t *testing.T, data []byte, isZip bool) {
+	t.Helper()
+	contents := map[string]string{}
+	if isZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			require.NoError(t, err)
+			content, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			contents[f.Name] = string(content)
+		}
+	} else {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			content, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			contents[header.Name] = string(content)
+		}
+	}
+	assert.Equal(t, map[string]string{"main.go": "package main\n", "pixel.png": pngData}, contents)
+}
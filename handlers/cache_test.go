@@ -50,7 +50,7 @@ func TestCacheHeaders(t *testing.T) {
 		{
 			name:    "Dynamic data page cache headers - short TTL",
 			handler: "data",
-			code:    "test1",
+			code:    "test1@1", // An earlier revision never changes
 			setupMock: func(m *db.MockDB, s *db.MockS3) {
 				// TTL that expires in 30 minutes (1800 seconds)
 				shortTTL := time.Now().Add(30 * time.Minute).Unix()
@@ -70,7 +70,7 @@ func TestCacheHeaders(t *testing.T) {
 		{
 			name:    "Dynamic data page cache headers - long TTL",
 			handler: "data",
-			code:    "test2",
+			code:    "test2@1",
 			setupMock: func(m *db.MockDB, s *db.MockS3) {
 				// TTL that expires in 2 hours
 				longTTL := time.Now().Add(2 * time.Hour).Unix()
@@ -87,6 +87,41 @@ func TestCacheHeaders(t *testing.T) {
 			expectExpires:        true,
 			expectNoPragma:       true,
 		},
+		{
+			name:    "Current revision of an editable paste is revalidated",
+			handler: "data",
+			code:    "test3",
+			setupMock: func(m *db.MockDB, s *db.MockS3) {
+				m.On("GetRedirect", "test3").Return(&db.RedirectRecord{
+					Code:    "test3",
+					Typ:     "D",
+					Val:     "Test content",
+					Ettl:    time.Now().Add(2 * time.Hour).Unix(),
+					Created: time.Now().Unix(),
+					Owner:   "owner123",
+				}, nil)
+			},
+			expectedCacheControl: "public, no-cache",
+			expectNoPragma:       true,
+		},
+		{
+			name:    "Short link cache headers",
+			handler: "data",
+			code:    "test4",
+			setupMock: func(m *db.MockDB, s *db.MockS3) {
+				m.On("GetRedirect", "test4").Return(&db.RedirectRecord{
+					Code:    "test4",
+					Typ:     "R",
+					Val:     "https://example.com/",
+					Ettl:    time.Now().Add(2 * time.Hour).Unix(),
+					Created: time.Now().Unix(),
+					Owner:   "owner123",
+				}, nil)
+			},
+			expectedCacheControl: "public, max-age=3600", // Links can't be edited
+			expectExpires:        true,
+			expectNoPragma:       true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -187,10 +222,11 @@ func TestCacheDurationCalculation(t *testing.T) {
 			c, router := gin.CreateTestContext(w)
 			router.LoadHTMLGlob("../templates/*")
 
-			req := httptest.NewRequest("GET", "/test", nil)
+			// Earlier revisions are cached for as long as they live
+			req := httptest.NewRequest("GET", "/test@1", nil)
 			req.Header.Set("User-Agent", "Mozilla/5.0 (browser)")
 			c.Request = req
-			c.Params = gin.Params{{Key: "code", Value: "test"}}
+			c.Params = gin.Params{{Key: "code", Value: "test@1"}}
 
 			h.DataHandler(c)
 
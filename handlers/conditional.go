@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storedContent describes content as it is stored, for conditional and range
+// requests on its raw form. A paste's content never changes once stored;
+// editing it stores a new revision instead.
+type storedContent struct {
+	hash     string // Hex SHA-256, empty if stored before it was recorded
+	size     int64  // 0 if unknown
+	modified int64  // When it was stored
+}
+
+// contentHash returns the hex SHA-256 of content
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// pasteContent returns what is known of revision rev of a text or binary
+// paste, or of its current content when rev is 0
+func pasteContent(record *db.RedirectRecord, rev int64) storedContent {
+	if rev != 0 && rev != record.Revision() {
+		for _, earlier := range record.Revs {
+			if earlier.Rev == rev {
+				return storedContent{hash: earlier.Hash, size: earlier.Size, modified: earlier.Created}
+			}
+		}
+		return storedContent{}
+	}
+	content := storedContent{hash: record.Hash, size: record.Size, modified: record.Updated}
+	if content.modified == 0 {
+		content.modified = record.Created
+	}
+	if record.Typ == "D" {
+		content.size = int64(len(record.Val))
+		if content.hash == "" {
+			content.hash = contentHash(record.Val)
+		}
+	}
+	return content
+}
+
+// hashVisible reports whether the hash of record's content can be given to
+// the caller. A hash confirms a guess at the content, so a password keeps it
+// from all but the owner. A burn or view-limited paste leaves it out too,
+// since revalidating or fetching a range would still use up a view.
+func hashVisible(record *db.RedirectRecord, isOwner bool) bool {
+	return isOwner || (record.PassHash == "" && !record.Burn && record.MaxViews == 0)
+}
+
+// etag returns the strong entity tag of the content, or "" without its hash
+func (s storedContent) etag() string {
+	if s.hash == "" {
+		return ""
+	}
+	return `"` + s.hash + `"`
+}
+
+// setHeaders sets the validators and digest of the content on a response
+// carrying it as stored
+func (s storedContent) setHeaders(c *gin.Context) {
+	if s.hash != "" {
+		c.Header("ETag", s.etag())
+		c.Header("Content-SHA256", s.hash)
+		if sum, err := hex.DecodeString(s.hash); err == nil {
+			c.Header("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+	if s.modified > 0 {
+		c.Header("Last-Modified", time.Unix(s.modified, 0).UTC().Format(http.TimeFormat))
+	}
+	if s.size > 0 {
+		c.Header("Accept-Ranges", "bytes")
+	}
+}
+
+// isCurrent reports whether a conditional request's copy of the content is
+// current, to be answered with 304. If-None-Match takes precedence over
+// If-Modified-Since.
+func (s storedContent) isCurrent(c *gin.Context) bool {
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		return etagMatches(match, s.etag())
+	}
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	return err == nil && s.modified > 0 && s.modified <= since.Unix()
+}
+
+// sendNotModified answers a conditional request with 304
+func (s storedContent) sendNotModified(c *gin.Context) {
+	s.setHeaders(c)
+	c.AbortWithStatus(http.StatusNotModified)
+}
+
+// etagMatches reports whether an If-None-Match list names etag, comparing
+// weakly as RFC 9110 has it
+func etagMatches(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// byteRange is one range of bytes of the content
+type byteRange struct {
+	start, length int64
+}
+
+// requestedRange returns the byte range asked for with Range, or nil when
+// the whole content is to be sent: without a size, for a Range that isn't a
+// single valid byte range, or when If-Range shows the client's copy is out
+// of date. A range starting past the end is answered with 416 and ok false.
+func (s storedContent) requestedRange(c *gin.Context) (r *byteRange, ok bool) {
+	spec, found := strings.CutPrefix(c.GetHeader("Range"), "bytes=")
+	if !found || s.size <= 0 || strings.Contains(spec, ",") {
+		return nil, true
+	}
+	if ifRange := c.GetHeader("If-Range"); ifRange != "" {
+		if strings.HasPrefix(ifRange, `"`) {
+			if ifRange != s.etag() || s.etag() == "" {
+				return nil, true
+			}
+		} else if t, err := http.ParseTime(ifRange); err != nil || t.Unix() != s.modified {
+			return nil, true
+		}
+	}
+
+	first, last, _ := strings.Cut(spec, "-")
+	r = &byteRange{}
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, true
+		}
+		if n == 0 {
+			return s.unsatisfiable(c)
+		}
+		r.start = max(s.size-n, 0)
+		r.length = s.size - r.start
+		return r, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, true
+	}
+	end := s.size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return nil, true
+		}
+		end = min(end, s.size-1)
+	}
+	if start >= s.size {
+		return s.unsatisfiable(c)
+	}
+	r.start, r.length = start, end-start+1
+	return r, true
+}
+
+func (s storedContent) unsatisfiable(c *gin.Context) (*byteRange, bool) {
+	c.Header("Content-Range", fmt.Sprintf("bytes */%d", s.size))
+	utils.RespondWithError(c, http.StatusRequestedRangeNotSatisfiable, "error", "Range not satisfiable")
+	return nil, false
+}
+
+// sendContent sends content as the response body, or the part of it asked
+// for with Range when it is sent as stored. length is -1 if unknown.
+func sendContent(c *gin.Context, stored *storedContent, contentType string, body io.Reader, length int64, headers map[string]string) {
+	if stored != nil {
+		r, ok := stored.requestedRange(c)
+		if !ok {
+			return
+		}
+		if r != nil {
+			// Blobs are compressed, so the bytes before the range are read
+			// and dropped rather than skipped
+			if _, err := io.CopyN(io.Discard, body, r.start); err != nil {
+				log.Printf("Failed to read up to byte %d of content: %v", r.start, err)
+				utils.RespondWithError(c, http.StatusInternalServerError, "error", "Failed to retrieve content")
+				return
+			}
+			c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, stored.size))
+			c.DataFromReader(http.StatusPartialContent, r.length, contentType, io.LimitReader(body, r.length), headers)
+			return
+		}
+	}
+	c.DataFromReader(http.StatusOK, length, contentType, body, headers)
+}
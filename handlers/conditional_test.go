@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestedRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	stored := storedContent{hash: "abc", size: 100, modified: 1700000000}
+	lastModified := time.Unix(1700000000, 0).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		rangeH  string
+		ifRange string
+		want    *byteRange
+		ok      bool
+	}{
+		{"No range", "", "", nil, true},
+		{"Start and end", "bytes=10-19", "", &byteRange{10, 10}, true},
+		{"Open ended", "bytes=90-", "", &byteRange{90, 10}, true},
+		{"End past the size", "bytes=90-500", "", &byteRange{90, 10}, true},
+		{"Suffix", "bytes=-5", "", &byteRange{95, 5}, true},
+		{"Suffix longer than the content", "bytes=-500", "", &byteRange{0, 100}, true},
+		{"Several ranges are sent whole", "bytes=0-1,5-6", "", nil, true},
+		{"Backwards range is ignored", "bytes=20-10", "", nil, true},
+		{"Other units are ignored", "lines=1-2", "", nil, true},
+		{"Start past the end", "bytes=100-", "", nil, false},
+		{"Empty suffix", "bytes=-0", "", nil, false},
+		{"If-Range matches the ETag", "bytes=0-9", `"abc"`, &byteRange{0, 10}, true},
+		{"If-Range names another version", "bytes=0-9", `"def"`, nil, true},
+		{"If-Range matches the date", "bytes=0-9", lastModified, &byteRange{0, 10}, true},
+		{"If-Range is an older date", "bytes=0-9", time.Unix(1600000000, 0).UTC().Format(http.TimeFormat), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/abcd", nil)
+			if tt.rangeH != "" {
+				c.Request.Header.Set("Range", tt.rangeH)
+			}
+			if tt.ifRange != "" {
+				c.Request.Header.Set("If-Range", tt.ifRange)
+			}
+
+			r, ok := stored.requestedRange(c)
+			assert.Equal(t, tt.want, r)
+			assert.Equal(t, tt.ok, ok)
+			if !ok {
+				assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+				assert.Equal(t, "bytes */100", w.Header().Get("Content-Range"))
+			}
+		})
+	}
+}
+
+func TestDataHandlerConditional(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	created := time.Now().Add(-time.Hour).Unix()
+	text := "0123456789abcdefghij"
+	hash := contentHash(text)
+	etag := `"` + hash + `"`
+	records := map[string]*db.RedirectRecord{
+		"inln": {Code: "inln", Typ: "D", Val: text, Size: 20, Hash: hash, Ettl: future, Created: created},
+		"big1": {Code: "big1", Typ: "S", Size: 20, Hash: hash, Ettl: future, Created: created},
+		"old1": {Code: "old1", Typ: "S", Ettl: future, Created: created},
+		"term": {Code: "term", Typ: "D", Val: "\x1b[31mred\x1b[0m", Ettl: future, Created: created},
+		"pix1": {Code: "pix1", Typ: "S", Mime: "image/png", Filename: "pixel.png", Size: int64(len(pngData)), Hash: contentHash(pngData), Ettl: future, Created: created},
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		headers      map[string]string
+		expectedCode int
+		expectedBody string
+		expectETag   bool
+	}{
+		{"Validators on inline content", "/inln", nil, http.StatusOK, text, true},
+		{"Validators on streamed content", "/big1", nil, http.StatusOK, text, true},
+		{"Matching ETag", "/inln", map[string]string{"If-None-Match": etag}, http.StatusNotModified, "", true},
+		{"Matching ETag in a list", "/big1", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified, "", true},
+		{"Other ETag", "/inln", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, text, true},
+		{"Not modified since", "/inln", map[string]string{"If-Modified-Since": time.Now().UTC().Format(http.TimeFormat)}, http.StatusNotModified, "", true},
+		{"Modified since", "/inln", map[string]string{"If-Modified-Since": time.Unix(created-60, 0).UTC().Format(http.TimeFormat)}, http.StatusOK, text, true},
+		{"Range of inline content", "/inln", map[string]string{"Range": "bytes=5-9"}, http.StatusPartialContent, "56789", true},
+		{"Range of streamed content", "/big1", map[string]string{"Range": "bytes=10-"}, http.StatusPartialContent, "abcdefghij", true},
+		{"Suffix range", "/big1", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "hij", true},
+		{"Range past the end", "/big1", map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "Range not satisfiable", true},
+		{"Stale If-Range", "/big1", map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}, http.StatusOK, text, true},
+		{"No hash recorded", "/old1", nil, http.StatusOK, text, false},
+		{"A slice is not the stored content", "/big1?lines=1", map[string]string{"If-None-Match": etag, "Range": "bytes=0-1"}, http.StatusOK, text, false},
+		{"Nor a stripped copy", "/term?strip-ansi", map[string]string{"If-None-Match": etag}, http.StatusOK, "red", false},
+		{"Binary file", "/pix1", map[string]string{"Range": "bytes=0-3"}, http.StatusPartialContent, pngData[:4], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			mockS3 := &db.MockS3{}
+			mockS3.On("GetObjectStream", "S/big1.zst").Return([]byte(text), nil)
+			mockS3.On("GetObjectStream", "S/old1.zst").Return([]byte(text), nil)
+			mockS3.On("GetObjectStream", "S/pix1.zst").Return([]byte(pngData), nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", "curl/8.0")
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			if tt.expectedCode == http.StatusNotModified {
+				assert.Empty(t, w.Body.String())
+			}
+			if tt.expectETag {
+				record := records[tt.path[1:5]]
+				assert.Equal(t, `"`+record.Hash+`"`, w.Header().Get("ETag"))
+				assert.Equal(t, record.Hash, w.Header().Get("Content-SHA256"))
+				assert.Contains(t, w.Header().Get("Digest"), "sha-256=")
+				assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+				assert.Equal(t, time.Unix(created, 0).UTC().Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+			} else {
+				assert.Empty(t, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestDataHandlerPageHasNoETag(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	record := &db.RedirectRecord{Code: "inln", Typ: "D", Val: "hello", Hash: contentHash("hello"), Ettl: time.Now().Add(time.Hour).Unix()}
+	mockDB := &db.MockDB{}
+	mockDB.On("GetRedirect", "inln").Return(record, nil)
+	h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+
+	w := httptest.NewRecorder()
+	_, router := gin.CreateTestContext(w)
+	router.LoadHTMLGlob("../templates/*")
+	router.GET("/:code", h.CatchAllHandler)
+	req := httptest.NewRequest("GET", "/inln", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (browser)")
+	req.Header.Set("If-None-Match", `"`+record.Hash+`"`)
+	router.ServeHTTP(w, req)
+
+	// The page shows more than the content, such as the delete button
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestDataHandlerViewLimitedIgnoresConditionals(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	text := "one-time secret"
+	record := func(code string) *db.RedirectRecord {
+		r := &db.RedirectRecord{Code: code, Typ: "D", Val: text, Hash: contentHash(text), Ettl: time.Now().Add(time.Hour).Unix(), Created: time.Now().Add(-time.Hour).Unix(), Owner: "owner1"}
+		switch code {
+		case "brn1":
+			r.Burn = true
+		case "lim1":
+			r.MaxViews = 2
+		case "pic1":
+			r.Typ, r.Val, r.Mime, r.Filename = "S", "", "image/png", "pixel.png"
+			r.Size, r.Hash, r.Burn = int64(len(pngData)), contentHash(pngData), true
+		}
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		code         string
+		headers      map[string]string
+		owner        string
+		expectedCode int
+		expectedBody string
+		expectETag   bool
+	}{
+		{"Range gets the whole burn paste", "brn1", map[string]string{"Range": "bytes=0-1"}, "", http.StatusOK, text, false},
+		{"Matching ETag gets the whole burn paste", "brn1", map[string]string{"If-None-Match": `"` + contentHash(text) + `"`}, "", http.StatusOK, text, false},
+		{"Matching ETag gets a view-limited paste", "lim1", map[string]string{"If-None-Match": `"` + contentHash(text) + `"`}, "", http.StatusOK, text, false},
+		{"Not modified since gets the whole paste", "lim1", map[string]string{"If-Modified-Since": time.Now().UTC().Format(http.TimeFormat)}, "", http.StatusOK, text, false},
+		{"Range gets the whole burn file", "pic1", map[string]string{"Range": "bytes=0-3"}, "", http.StatusOK, pngData, false},
+		{"The owner uses no view", "brn1", map[string]string{"Range": "bytes=0-2"}, "owner1", http.StatusPartialContent, "one", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockDB.On("GetRedirect", tt.code).Return(record(tt.code), nil)
+			mockDB.On("ConsumeRedirect", tt.code).Return(record(tt.code), nil)
+			viewed := record(tt.code)
+			viewed.Views = 1
+			mockDB.On("RecordView", tt.code).Return(viewed, nil)
+			mockS3 := &db.MockS3{}
+			mockS3.On("GetObjectStream", "S/pic1.zst").Return([]byte(pngData), nil)
+			mockS3.On("DeleteObject", "S/pic1.zst").Return(nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", "/"+tt.code, nil)
+			req.Header.Set("User-Agent", "curl/8.0")
+			if tt.owner != "" {
+				req.AddCookie(&http.Cookie{Name: "id", Value: tt.owner})
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			router.ServeHTTP(w, req)
+
+			// A read that uses up a view always gets all of the content
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+			if tt.expectETag {
+				assert.NotEmpty(t, w.Header().Get("ETag"))
+				mockDB.AssertNotCalled(t, "ConsumeRedirect", tt.code)
+			} else {
+				assert.Empty(t, w.Header().Get("ETag"))
+				assert.Empty(t, w.Header().Get("Content-SHA256"))
+				assert.Empty(t, w.Header().Get("Accept-Ranges"))
+			}
+		})
+	}
+}
@@ -1,28 +1,31 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/drewstreib/xipe-go/db"
 	"github.com/drewstreib/xipe-go/utils"
 	"github.com/gin-gonic/gin"
 )
 
-func isValidCode(code string) bool {
-	matched, _ := regexp.MatchString("^[a-zA-Z0-9]{4,5}$", code)
-	return matched
-}
-
 func (h *Handlers) DataHandler(c *gin.Context) {
 	code := c.Param("code")
+	// One file of a multi-file paste, or all of them as an archive
+	filename, archive := c.Param("filename"), c.Param("archive")
+	// Language from an extension URL such as /:code.py
+	viewLang := c.Param("lang")
 
 	// Check if this is a reserved code (static page)
-	if utils.IsReservedCode(code) {
-		content, err := utils.GetPageContent(code)
+	if utils.IsReservedCode(code) && filename == "" && archive == "" && viewLang == "" {
+		content, isMarkdown, err := utils.GetPageContent(code)
 		if err != nil {
 			utils.RespondWithError(c, http.StatusInternalServerError, "error", "Failed to load page")
 			return
@@ -47,11 +50,25 @@ func (h *Handlers) DataHandler(c *gin.Context) {
 			// Remove the no-cache headers set by middleware
 			c.Header("Pragma", "")
 
+			var highlighted, rendered template.HTML
+			switch pageRender(c, isMarkdown, content) {
+			case renderModeMarkdown:
+				rendered = h.Render.Markdown(content)
+			case renderModeANSI:
+				highlighted = h.Render.ANSI(content, "L")
+			default:
+				highlighted = h.Render.Highlight(content, "plaintext", "L")
+			}
 			// Browser clients get HTML template (same as data.html)
 			c.HTML(http.StatusOK, "data.html", gin.H{
 				"code":         code,
 				"url":          fullURL,
 				"data":         content,
+				"highlighted":  highlighted,
+				"rendered":     rendered,
+				"isMarkdown":   isMarkdown,
+				"markdownView": rendered != "",
+				"noh":          true, // Static pages are prose, not code
 				"fromSuccess":  false,
 				"created":      0,     // Static pages have no creation time
 				"expires":      0,     // Static pages don't expire
@@ -65,13 +82,23 @@ func (h *Handlers) DataHandler(c *gin.Context) {
 		return
 	}
 
+	// An earlier revision can be asked for as /:code@N or with ?rev=N
+	code, rev, ok := splitRevision(c, code)
+	if !ok {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", "Invalid revision")
+		return
+	}
+
 	// For regular codes, validate format
-	if !isValidCode(code) {
+	if !utils.IsValidCode(code) {
 		utils.RespondWithError(c, http.StatusBadRequest, "error", "Invalid code format")
 		return
 	}
 
 	redirect, err := h.DB.GetRedirect(code)
+	if err == nil {
+		redirect, err = h.withRevision(redirect, rev)
+	}
 	if err != nil {
 		utils.RespondWithError(c, http.StatusInternalServerError, "error", "Failed to retrieve URL")
 		return
@@ -81,6 +108,10 @@ func (h *Handlers) DataHandler(c *gin.Context) {
 		utils.RespondWithError(c, http.StatusNotFound, "error", "Short URL not found or has expired")
 		return
 	}
+	if rev != 0 && !redirect.HasRevision(rev) {
+		utils.RespondWithError(c, http.StatusNotFound, "error", "Revision not found")
+		return
+	}
 
 	// Default behavior: show info page (no automatic redirects for security)
 	// Build the full URL for display
@@ -93,88 +124,296 @@ func (h *Handlers) DataHandler(c *gin.Context) {
 		host = "xi.pe"
 	}
 	fullURL := scheme + "://" + host + "/" + code
+	if rev != 0 {
+		// Permalink to the revision being viewed
+		fullURL += "@" + strconv.FormatInt(rev, 10)
+	}
 
 	// Check if this is from a successful creation
 	fromSuccess := c.Query("from") == "success"
 
-	// Handle data/pastebin types (both D and S)
-	if redirect.Typ != "D" && redirect.Typ != "S" {
+	// Handle data/pastebin types (D, S and multi-file B) and short links (R)
+	if redirect.Typ != "D" && redirect.Typ != "S" && redirect.Typ != "B" && redirect.Typ != "R" {
 		utils.RespondWithError(c, http.StatusNotFound, "error", "Content not found")
 		return
 	}
+	// Checked before any view is counted
+	if (filename != "" || archive != "") && (redirect.Typ != "B" || (filename != "" && redirect.Files.Index(filename) < 0)) {
+		utils.RespondWithError(c, http.StatusNotFound, "error", "File not found")
+		return
+	}
+	if viewLang != "" && (redirect.Typ == "R" || redirect.Typ == "B" || redirect.Binary()) {
+		utils.RespondWithError(c, http.StatusNotFound, "error", "Content not found")
+		return
+	}
+
+	// ?format gets JSON, YAML or CSV normalized, never the page
+	format := c.Query("format")
+	if format != "" && !dataFormats[format] {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", fmt.Sprintf("Unknown format %s", format))
+		return
+	}
+	if format != "" && (redirect.Typ == "R" || redirect.Typ == "B" || redirect.Binary() || redirect.Enc) {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", "format only applies to JSON, YAML and CSV pastes")
+		return
+	}
+
+	// ?lines, ?head and ?tail get part of a text paste, never the page
+	lineRange, err := utils.ParseLineRange(c.Request.URL.Query())
+	if err != nil {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", err.Error())
+		return
+	}
+	// The files of a multi-file paste are checked as they are streamed
+	if lineRange != nil && (redirect.Typ == "R" || (redirect.Typ == "B" && filename == "") || redirect.Binary() || redirect.Enc) {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", "Line ranges only apply to text pastes")
+		return
+	}
+	if lineRange != nil && format != "" {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", "format can't be combined with a line range")
+		return
+	}
+
+	// ?download always gets the content itself, as an attachment
+	download := c.Request.URL.Query().Has("download")
+	wantHTML := utils.ShouldReturnHTML(c) && !download && format == "" && lineRange == nil
+
+	// The owner can read their own protected or view-limited paste freely
+	isOwner := false
+	if ownerCookie, err := c.Cookie("id"); err == nil && ownerCookie == redirect.Owner {
+		isOwner = true
+	}
+	// Password-protected pastes are checked before any view is counted
+	if redirect.PassHash != "" && !isOwner && !h.checkPastePassword(c, redirect, wantHTML) {
+		return
+	}
+
+	// Burn-after-reading and view-limited pastes: other readers are counted
+	// atomically in the database so no replica can serve more views than allowed
+	burned := false // Set when this read removed the paste
+	if (redirect.Burn || redirect.MaxViews > 0) && !isOwner {
+		c.Header("Cache-Control", "private, no-store")
+		c.Header("Pragma", "")
+
+		// Link unfurlers and browsers that haven't confirmed only get a notice,
+		// otherwise pasting the link into chat would use up a view. Submitting
+		// the password form counts as confirmation.
+		// A short link preview must not use up a view either.
+		confirmed := c.Request.URL.Query().Has("reveal") || c.Request.Method == http.MethodPost
+		preview := redirect.Typ == "R" && c.Request.URL.Query().Has("preview")
+		if utils.IsPreviewBot(c) || preview || (redirect.Burn && wantHTML && !confirmed) {
+			c.HTML(http.StatusOK, "burn.html", gin.H{
+				"code":      code,
+				"burn":      redirect.Burn,
+				"viewsLeft": redirect.MaxViews - redirect.Views,
+			})
+			return
+		}
+
+		redirect, burned, err = h.countView(redirect)
+		if err != nil {
+			utils.RespondWithError(c, http.StatusInternalServerError, "error", "Failed to retrieve URL")
+			return
+		}
+		if redirect == nil {
+			utils.RespondWithError(c, http.StatusNotFound, "error", "Short URL not found or has expired")
+			return
+		}
+		if burned {
+			log.Printf("Burned code %s on read", code)
+		}
+	}
+
+	if redirect.Typ == "R" {
+		h.serveRedirect(c, redirect, fullURL, wantHTML, isOwner)
+		return
+	}
+
+	if burned {
+		// Registered first so it runs after any stream below has been closed
+		defer h.deleteBurnedBlob(redirect)
+	}
+
+	if redirect.Typ == "B" {
+		h.serveBundle(c, redirect, fullURL, wantHTML, isOwner, burned)
+		return
+	}
+	if redirect.Binary() {
+		h.serveFile(c, redirect, fullURL, wantHTML, isOwner)
+		return
+	}
+
+	// The content as it is stored can be revalidated, and fetched in ranges,
+	// by raw clients; a slice or a stripped copy of it can't
+	stripANSI := c.Request.URL.Query().Has("strip-ansi") && !redirect.Enc
+	var stored *storedContent
+	if !wantHTML && format == "" && lineRange == nil && !stripANSI && hashVisible(redirect, isOwner) {
+		content := pasteContent(redirect, rev)
+		if content.isCurrent(c) {
+			setCacheHeaders(c, redirect, rev)
+			content.sendNotModified(c)
+			return
+		}
+		stored = &content
+	}
 
 	// Get the actual data content
 	var dataContent string
-	switch redirect.Typ {
-	case "D":
+	var dataStream io.Reader
+	if s3Key := revisionBlobKey(redirect, rev); s3Key == "" {
 		// Data stored directly in DynamoDB
 		dataContent = redirect.Val
-	case "S":
+	} else {
 		// Data stored in S3, need to fetch it
-		s3Key := "S/" + code + ".zst"
-		s3Data, err := h.S3.GetObject(s3Key)
-		if err != nil {
-			// Check for specific S3 errors
-			errorMsg := err.Error()
-			if strings.Contains(errorMsg, "NoSuchKey") || strings.Contains(errorMsg, "NotFound") {
-				// S3 object not found - treat as 404 since DynamoDB record exists but S3 data is missing
-				utils.RespondWithError(c, http.StatusNotFound, "error", "Content not found or has expired")
-			} else {
-				// Other S3 errors (access denied, service unavailable, etc.)
-				log.Printf("S3 error retrieving %s: %v", s3Key, err)
+		stream, ok := h.openBlob(c, s3Key)
+		if !ok {
+			return
+		}
+		defer func() {
+			if closeErr := stream.Close(); closeErr != nil {
+				log.Printf("Failed to close S3 stream for %s: %v", s3Key, closeErr)
+			}
+		}()
+
+		if wantHTML || format != "" {
+			// The HTML template and the parsers need the whole content
+			s3Data, err := io.ReadAll(stream)
+			if err != nil {
+				log.Printf("S3 error reading %s: %v", s3Key, err)
 				utils.RespondWithError(c, http.StatusInternalServerError, "error", "Failed to retrieve content")
+				return
 			}
-			return
+			dataContent = string(s3Data)
+		} else {
+			// Raw clients get the content streamed straight through the decoder
+			dataStream = stream
 		}
-		dataContent = string(s3Data)
 	}
 
-	// Calculate cache duration: min(1 hour, time until expiration)
-	now := time.Now().Unix()
-	maxCacheDuration := int64(3600) // 1 hour in seconds
-	var cacheDuration int64
+	setCacheHeaders(c, redirect, rev)
 
-	if redirect.Ettl > 0 && redirect.Ettl > now {
-		// Item has a TTL and hasn't expired yet
-		timeUntilExpiration := redirect.Ettl - now
-		if timeUntilExpiration < maxCacheDuration {
-			cacheDuration = timeUntilExpiration
-		} else {
-			cacheDuration = maxCacheDuration
+	viewing := rev
+	if viewing == 0 {
+		viewing = redirect.Revision()
+	}
+	lang := viewLang
+	if lang == "" {
+		lang = pasteLanguage(redirect)
+	}
+	// ?strip-ansi gets terminal output as plain text, without its colours
+	if stripANSI {
+		dataContent = utils.StripANSI(dataContent)
+		if dataStream != nil {
+			dataStream = utils.NewANSIStripReader(dataStream)
+		}
+	}
+	if lineRange != nil {
+		dataContent = lineRange.Slice(dataContent)
+		if dataStream != nil {
+			dataStream = lineRange.Reader(dataStream)
 		}
-	} else {
-		// No TTL or already expired (shouldn't happen since we got the record)
-		cacheDuration = maxCacheDuration
 	}
-
-	// Set cache headers for data pages (both HTML and raw responses)
-	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", cacheDuration))
-	c.Header("Expires", time.Now().Add(time.Duration(cacheDuration)*time.Second).UTC().Format(http.TimeFormat))
-	// Remove the no-cache headers set by middleware
-	c.Header("Pragma", "")
 
 	// Return response based on client type
-	if utils.ShouldReturnHTML(c) {
-		// Browser clients get HTML template
-		// Check if user owns this paste by comparing full owner IDs
-		showDelete := false
-		if ownerCookie, err := c.Cookie("id"); err == nil && ownerCookie == redirect.Owner {
-			showDelete = true
-		}
+	if wantHTML {
+		// Ciphertext is shown as it is until the browser decrypts it
+		var highlighted, rendered, structured template.HTML
+		var dataErr *dataError
+		isMarkdown := isMarkdownFile(redirect.Filename) || lang == "markdown"
+		kind := ""
+		if !redirect.Enc {
+			kind = dataKind(lang, redirect.Filename, dataContent)
+			mode := pageRender(c, isMarkdownFile(redirect.Filename), dataContent)
+			// JSON, YAML and CSV are checked whichever way they're shown as
+			// code, so the page can point at a syntax error
+			var err error
+			switch {
+			case kind == "" || mode == renderModeMarkdown || mode == renderModeANSI:
+			case mode == renderModeData:
+				structured, err = renderData(kind, dataContent)
+			default:
+				_, err = parseData(kind, dataContent)
+			}
+			errors.As(err, &dataErr)
 
+			switch {
+			case mode == renderModeMarkdown:
+				rendered = h.markdownPaste(redirect, dataContent)
+			case mode == renderModeANSI:
+				highlighted = h.ansiPaste(redirect, dataContent, "L")
+			case structured == "":
+				highlighted = h.highlightPaste(redirect, dataContent, lang, "L")
+			}
+		}
+		// Browser clients get HTML template
+		// Only the owner (matching full owner ID) gets a delete button
 		c.HTML(http.StatusOK, "data.html", gin.H{
 			"code":         code,
 			"url":          fullURL,
 			"data":         dataContent,
+			"highlighted":  highlighted,
+			"rendered":     rendered,
+			"isMarkdown":   isMarkdown && !redirect.Enc, // Offers the rendered view
+			"markdownView": rendered != "",
+			"structured":   structured,
+			"dataKind":     dataLabel(kind), // Offers the structured view
+			"dataError":    dataErr,
+			"noh":          c.Request.URL.Query().Has("noh"),
 			"fromSuccess":  fromSuccess,
 			"created":      redirect.Created,
 			"expires":      redirect.Ettl,
-			"showDelete":   showDelete,
+			"showDelete":   isOwner,
 			"isStaticPage": false, // Flag to indicate this is user data
+			"burn":         redirect.Burn,
+			"burned":       burned,
+			"maxViews":     redirect.MaxViews,
+			"viewsLeft":    redirect.MaxViews - redirect.Views,
+			"encrypted":    redirect.Enc, // Decrypted in the browser with the key from the URL fragment
+			"revision":     viewing,
+			"revisions":    revisionLinks(redirect, viewing),
+			"parent":       redirect.Parent,
+			"filename":     redirect.Filename,
+			"lang":         lang,
+			// Same rules as ForkHandler; a burned paste is already gone
+			"canFork": !redirect.Enc && !burned && (isOwner || (redirect.PassHash == "" && !redirect.Burn && redirect.MaxViews == 0)),
 		})
+		return
+	}
+
+	c.Header(revisionHeader, strconv.FormatInt(viewing, 10))
+	if format != "" {
+		kind := dataKind(lang, redirect.Filename, dataContent)
+		if kind == "" {
+			utils.RespondWithError(c, http.StatusBadRequest, "error", "format only applies to JSON, YAML and CSV pastes")
+			return
+		}
+		normalized, err := formatData(kind, dataContent, format)
+		if err != nil {
+			utils.RespondWithError(c, http.StatusUnprocessableEntity, "error", fmt.Sprintf("Invalid %s at %v", dataLabel(kind), err))
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", normalized)
+		return
+	}
+	if download {
+		c.Header("Content-Disposition", contentDisposition("attachment", downloadName(redirect)))
+	}
+
+	contentType := textContentType(lang)
+	if redirect.Enc {
+		// Opaque ciphertext: tell clients what it is so they can decrypt it themselves
+		c.Header("X-Paste-Encryption", "aes-256-gcm")
+		contentType = "text/plain; charset=utf-8"
+	}
+	if stored != nil {
+		stored.setHeaders(c)
+	}
+	if dataStream != nil {
+		// API clients get raw content as text, streamed for S3-backed pastes
+		sendContent(c, stored, contentType, dataStream, -1, nil)
 	} else {
-		// API clients get raw content as plain text
-		c.String(http.StatusOK, dataContent)
+		// API clients get raw content as text
+		sendContent(c, stored, contentType, strings.NewReader(dataContent), int64(len(dataContent)), nil)
 	}
 }
 
@@ -188,13 +427,120 @@ func (h *Handlers) CatchAllHandler(c *gin.Context) {
 		return
 	}
 
-	// Then check if it matches the standard code pattern for generated codes
-	codePattern := regexp.MustCompile("^[a-zA-Z0-9]{4,5}$")
-	if codePattern.MatchString(path) {
+	// Then check if it matches the code grammar (generated or vanity codes),
+	// optionally followed by @N for a revision
+	if code, _, _ := strings.Cut(path, "@"); utils.IsValidCode(code) {
 		c.Params = append(c.Params, gin.Param{Key: "code", Value: path})
 		h.DataHandler(c)
 		return
 	}
 
+	// A multi-file paste as a whole, /:code.zip or /:code.tar.gz
+	if code, format, ok := archivePath(path); ok {
+		// Ahead of the route's own code parameter, which has the suffix
+		c.Params = append(gin.Params{{Key: "code", Value: code}, {Key: "archive", Value: format}}, c.Params...)
+		h.DataHandler(c)
+		return
+	}
+
+	// A paste highlighted as the language of an extension, /:code.py
+	if code, lang, ok := extensionPath(path); ok {
+		c.Params = append(gin.Params{{Key: "code", Value: code}, {Key: "lang", Value: lang}}, c.Params...)
+		h.DataHandler(c)
+		return
+	}
+
 	utils.RespondWithError(c, http.StatusNotFound, "error", "Page not found")
 }
+
+// setCacheHeaders lets shared caches keep a paste or short link for up to an
+// hour, never past its expiry, unless it is view-limited or password-protected.
+// The current revision of a paste that can still be edited must be
+// revalidated every time; an earlier revision (rev != 0) never changes.
+func setCacheHeaders(c *gin.Context, redirect *db.RedirectRecord, rev int64) {
+	// Calculate cache duration: min(1 hour, time until expiration)
+	now := time.Now().Unix()
+	maxCacheDuration := int64(3600) // 1 hour in seconds
+	var cacheDuration int64
+
+	if redirect.Ettl > 0 && redirect.Ettl > now {
+		// Item has a TTL and hasn't expired yet
+		timeUntilExpiration := redirect.Ettl - now
+		if timeUntilExpiration < maxCacheDuration {
+			cacheDuration = timeUntilExpiration
+		} else {
+			cacheDuration = maxCacheDuration
+		}
+	} else {
+		// No TTL or already expired (shouldn't happen since we got the record)
+		cacheDuration = maxCacheDuration
+	}
+
+	// Set cache headers for data pages (both HTML and raw responses)
+	if redirect.Burn || redirect.MaxViews > 0 || redirect.PassHash != "" {
+		// Shared caches must never hold a copy of a view-limited paste, or
+		// they would serve it without the views being counted, nor of a
+		// password-protected one, or they would serve it without the password
+		c.Header("Cache-Control", "private, no-store")
+	} else if rev == 0 && editable(redirect) {
+		c.Header("Cache-Control", "public, no-cache")
+	} else {
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", cacheDuration))
+		c.Header("Expires", time.Now().Add(time.Duration(cacheDuration)*time.Second).UTC().Format(http.TimeFormat))
+	}
+	// Remove the no-cache headers set by middleware
+	c.Header("Pragma", "")
+}
+
+// countView applies burn-after-reading and view limits to a read by someone
+// other than the owner. Views are counted atomically in the database so no
+// replica can serve more than allowed. It returns the record as read, nil if
+// it is gone or out of views, and whether this read removed it.
+func (h *Handlers) countView(record *db.RedirectRecord) (*db.RedirectRecord, bool, error) {
+	code := record.Code
+	if record.Burn {
+		record, err := h.DB.ConsumeRedirect(code)
+		return record, record != nil, err
+	}
+
+	record, err := h.DB.RecordView(code)
+	if err != nil || record == nil || record.Views < record.MaxViews {
+		return record, false, err
+	}
+	// Last allowed view: remove the record now rather than leaving it to the
+	// TTL, the caller removes the blob once the response is written
+	if _, err := h.DB.ConsumeRedirect(code); err != nil {
+		log.Printf("Failed to remove code %s after its last view: %v", code, err)
+	}
+	return record, true, nil
+}
+
+// openBlob streams the content of a paste stored at s3Key. If the blob can't
+// be read it writes a 404 or 500 and returns false.
+func (h *Handlers) openBlob(c *gin.Context, s3Key string) (io.ReadCloser, bool) {
+	stream, err := h.S3.GetObjectStream(s3Key)
+	if err != nil {
+		// Check for specific S3 errors
+		errorMsg := err.Error()
+		if strings.Contains(errorMsg, "NoSuchKey") || strings.Contains(errorMsg, "NotFound") {
+			// S3 object not found - treat as 404 since DynamoDB record exists but S3 data is missing
+			respondError(c, http.StatusNotFound, "Content not found or has expired")
+		} else {
+			// Other S3 errors (access denied, service unavailable, etc.)
+			log.Printf("S3 error retrieving %s: %v", s3Key, err)
+			respondError(c, http.StatusInternalServerError, "Failed to retrieve content")
+		}
+		return nil, false
+	}
+	return stream, true
+}
+
+// deleteBurnedBlob removes the blobs of a paste whose record was consumed,
+// including those of its earlier revisions
+func (h *Handlers) deleteBurnedBlob(record *db.RedirectRecord) {
+	for _, s3Key := range db.BlobKeys(record) {
+		if err := h.S3.DeleteObject(s3Key); err != nil {
+			log.Printf("Failed to delete burned blob %s: %v", s3Key, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -159,8 +160,32 @@ func TestCatchAllHandler(t *testing.T) {
 			expectedBody:   nil, // Now returns HTML, don't check body
 		},
 		{
-			name:           "Invalid path - too long (6 chars)",
-			path:           "/abcdef",
+			name: "Valid vanity code",
+			path: "/release-notes_v2",
+			setupMock: func(m *db.MockDB) {
+				m.On("GetRedirect", "release-notes_v2").Return(&db.RedirectRecord{
+					Code:    "release-notes_v2",
+					Typ:     "D",
+					Val:     "Vanity data",
+					Created: 1234567890,
+					Ettl:    1234567890,
+				}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedHeader: "",
+			expectedBody:   nil, // Returns HTML data page
+		},
+		{
+			name:           "Invalid path - too long (65 chars)",
+			path:           "/" + strings.Repeat("a", 65),
+			setupMock:      func(m *db.MockDB) {},
+			expectedStatus: http.StatusNotFound,
+			expectedHeader: "",
+			expectedBody:   nil, // Now returns HTML, don't check body
+		},
+		{
+			name:           "Invalid path - internal key prefix",
+			path:           "/_vanity_owner",
 			setupMock:      func(m *db.MockDB) {},
 			expectedStatus: http.StatusNotFound,
 			expectedHeader: "",
@@ -334,3 +359,363 @@ func TestDataHandlerBranching(t *testing.T) {
 		})
 	}
 }
+
+func TestDataHandlerS3Content(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		userAgent   string
+		expectHTML  bool
+		expectedRaw string
+	}{
+		{"Raw client gets streamed content", "curl/8.0", false, "large content from S3"},
+		{"Browser gets full page", "Mozilla/5.0 (browser)", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := new(db.MockDB)
+			mockS3 := new(db.MockS3)
+			mockDB.On("GetRedirect", "big1").Return(&db.RedirectRecord{
+				Code:    "big1",
+				Typ:     "S",
+				Ettl:    time.Now().Add(time.Hour).Unix(),
+				Created: time.Now().Unix(),
+			}, nil)
+			mockS3.On("GetObjectStream", "S/big1.zst").Return([]byte("large content from S3"), nil)
+
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			c, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			req := httptest.NewRequest("GET", "/big1", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			c.Request = req
+			c.Params = gin.Params{{Key: "code", Value: "big1"}}
+
+			h.DataHandler(c)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			if tt.expectHTML {
+				assert.Contains(t, w.Body.String(), "large content from S3")
+				assert.Contains(t, w.Body.String(), "</html>")
+			} else {
+				assert.Equal(t, tt.expectedRaw, w.Body.String())
+				assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+			}
+
+			mockDB.AssertExpectations(t)
+			mockS3.AssertExpectations(t)
+		})
+	}
+}
+
+func TestDataHandlerBurn(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	burnRecord := func() *db.RedirectRecord {
+		return &db.RedirectRecord{
+			Code:    "brn1",
+			Typ:     "D",
+			Val:     "one-time secret",
+			Ettl:    time.Now().Add(time.Hour).Unix(),
+			Created: time.Now().Unix(),
+			Owner:   "owner1",
+			Burn:    true,
+		}
+	}
+
+	serve := func(h *Handlers, target, userAgent, ownerCookie string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, router := gin.CreateTestContext(w)
+		router.LoadHTMLGlob("../templates/*")
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("User-Agent", userAgent)
+		if ownerCookie != "" {
+			req.AddCookie(&http.Cookie{Name: "id", Value: ownerCookie})
+		}
+		c.Request = req
+		c.Params = gin.Params{{Key: "code", Value: "brn1"}}
+		h.DataHandler(c)
+		return w
+	}
+
+	t.Run("Preview bot does not consume", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "brn1").Return(burnRecord(), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "/brn1?reveal", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "one-time secret")
+		assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+		mockDB.AssertNotCalled(t, "ConsumeRedirect", "brn1")
+	})
+
+	t.Run("Browser gets notice until reveal", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "brn1").Return(burnRecord(), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "/brn1", "Mozilla/5.0 (browser)", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "reveal")
+		assert.NotContains(t, w.Body.String(), "one-time secret")
+		mockDB.AssertNotCalled(t, "ConsumeRedirect", "brn1")
+	})
+
+	t.Run("Owner views without consuming", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "brn1").Return(burnRecord(), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "/brn1", "curl/8.0", "owner1")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "one-time secret", w.Body.String())
+		mockDB.AssertNotCalled(t, "ConsumeRedirect", "brn1")
+	})
+
+	t.Run("First reader consumes", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "brn1").Return(burnRecord(), nil)
+		mockDB.On("ConsumeRedirect", "brn1").Return(burnRecord(), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "/brn1", "curl/8.0", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "one-time secret", w.Body.String())
+		assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("Losing the race is not found", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "brn1").Return(burnRecord(), nil)
+		mockDB.On("ConsumeRedirect", "brn1").Return(nil, nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "/brn1?reveal&html", "Mozilla/5.0 (browser)", "")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NotContains(t, w.Body.String(), "one-time secret")
+	})
+
+	t.Run("Burned S3 paste deletes its blob", func(t *testing.T) {
+		record := burnRecord()
+		record.Typ = "S"
+		record.Val = ""
+		mockDB := new(db.MockDB)
+		mockS3 := new(db.MockS3)
+		mockDB.On("GetRedirect", "brn1").Return(record, nil)
+		mockDB.On("ConsumeRedirect", "brn1").Return(record, nil)
+		mockS3.On("GetObjectStream", "S/brn1.zst").Return([]byte("large secret"), nil)
+		mockS3.On("DeleteObject", "S/brn1.zst").Return(nil)
+		h := &Handlers{DB: mockDB, S3: mockS3}
+
+		w := serve(h, "/brn1?reveal&html", "Mozilla/5.0 (browser)", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "large secret")
+		assert.Contains(t, w.Body.String(), "has been burned")
+		mockDB.AssertExpectations(t)
+		mockS3.AssertExpectations(t)
+	})
+}
+
+func TestDataHandlerViewLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limited := func(views int64) *db.RedirectRecord {
+		return &db.RedirectRecord{
+			Code:     "lim1",
+			Typ:      "D",
+			Val:      "limited content",
+			Ettl:     time.Now().Add(time.Hour).Unix(),
+			Created:  time.Now().Unix(),
+			Owner:    "owner1",
+			MaxViews: 3,
+			Views:    views,
+		}
+	}
+
+	serve := func(h *Handlers, userAgent string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, router := gin.CreateTestContext(w)
+		router.LoadHTMLGlob("../templates/*")
+		req := httptest.NewRequest("GET", "/lim1", nil)
+		req.Header.Set("User-Agent", userAgent)
+		c.Request = req
+		c.Params = gin.Params{{Key: "code", Value: "lim1"}}
+		h.DataHandler(c)
+		return w
+	}
+
+	t.Run("View is counted and remaining views shown", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "lim1").Return(limited(0), nil)
+		mockDB.On("RecordView", "lim1").Return(limited(1), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "Mozilla/5.0 (browser)")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "limited content")
+		assert.Contains(t, w.Body.String(), "Views left: 2 of 3")
+		assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+		mockDB.AssertExpectations(t)
+		mockDB.AssertNotCalled(t, "ConsumeRedirect", "lim1")
+	})
+
+	t.Run("Last view removes the paste", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "lim1").Return(limited(2), nil)
+		mockDB.On("RecordView", "lim1").Return(limited(3), nil)
+		mockDB.On("ConsumeRedirect", "lim1").Return(limited(3), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "curl/8.0")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "limited content", w.Body.String())
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("Out of views is not found", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "lim1").Return(limited(2), nil)
+		mockDB.On("RecordView", "lim1").Return(nil, nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "curl/8.0")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Preview bot does not use a view", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "lim1").Return(limited(1), nil)
+		h := &Handlers{DB: mockDB}
+
+		w := serve(h, "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "2 views left")
+		assert.NotContains(t, w.Body.String(), "limited content")
+		mockDB.AssertNotCalled(t, "RecordView", "lim1")
+	})
+}
+
+func TestDataHandlerEncrypted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	record := &db.RedirectRecord{
+		Code:    "enc1",
+		Typ:     "D",
+		Val:     "q83vEjRWeJA",
+		Ettl:    time.Now().Add(time.Hour).Unix(),
+		Created: time.Now().Unix(),
+		Enc:     true,
+	}
+
+	serve := func(userAgent string) *httptest.ResponseRecorder {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "enc1").Return(record, nil)
+		h := &Handlers{DB: mockDB}
+
+		w := httptest.NewRecorder()
+		c, router := gin.CreateTestContext(w)
+		router.LoadHTMLGlob("../templates/*")
+		req := httptest.NewRequest("GET", "/enc1", nil)
+		req.Header.Set("User-Agent", userAgent)
+		c.Request = req
+		c.Params = gin.Params{{Key: "code", Value: "enc1"}}
+		h.DataHandler(c)
+		return w
+	}
+
+	t.Run("Raw client gets opaque ciphertext", func(t *testing.T) {
+		w := serve("curl/8.0")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "q83vEjRWeJA", w.Body.String())
+		assert.Equal(t, "aes-256-gcm", w.Header().Get("X-Paste-Encryption"))
+	})
+
+	t.Run("Browser decrypts client-side", func(t *testing.T) {
+		w := serve("Mozilla/5.0 (browser)")
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.Contains(t, body, "q83vEjRWeJA")
+		assert.Contains(t, body, "decryptPaste().then(initContent)")
+		assert.Empty(t, w.Header().Get("X-Paste-Encryption"))
+	})
+}
+
+func TestDataHandlerLineRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	log := "one\ntwo\nthree\nfour\nfive\n"
+	records := map[string]*db.RedirectRecord{
+		"log1": {Code: "log1", Typ: "D", Val: log, Ettl: future},
+		"big1": {Code: "big1", Typ: "S", Ettl: future},
+		"enc1": {Code: "enc1", Typ: "D", Val: "q83vEjRWeJA", Ettl: future, Enc: true},
+		"link": {Code: "link", Typ: "R", Val: "https://example.com", Ettl: future},
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		userAgent    string
+		expectedCode int
+		expectedBody string
+	}{
+		{"Range", "/log1?lines=2-4", "curl/8.0", http.StatusOK, "two\nthree\nfour\n"},
+		{"Range as in a link", "/log1?lines=L2-L3", "curl/8.0", http.StatusOK, "two\nthree\n"},
+		{"Single line", "/log1?lines=5", "curl/8.0", http.StatusOK, "five\n"},
+		{"To the end", "/log1?lines=4-", "curl/8.0", http.StatusOK, "four\nfive\n"},
+		{"Past the end", "/log1?lines=9-12", "curl/8.0", http.StatusOK, ""},
+		{"Head", "/log1?head=2", "curl/8.0", http.StatusOK, "one\ntwo\n"},
+		{"Tail", "/log1?tail=2", "curl/8.0", http.StatusOK, "four\nfive\n"},
+		{"Browsers get the slice too", "/log1?lines=1", "Mozilla/5.0 (browser)", http.StatusOK, "one\n"},
+		{"Streamed from the blob store", "/big1?lines=2-3", "curl/8.0", http.StatusOK, "two\nthree\n"},
+		{"Streamed tail", "/big1?tail=1", "curl/8.0", http.StatusOK, "five\n"},
+		{"Backwards range", "/log1?lines=4-2", "curl/8.0", http.StatusBadRequest, "lines must be"},
+		{"Zero", "/log1?head=0", "curl/8.0", http.StatusBadRequest, "head must be"},
+		{"Two at once", "/log1?head=1&tail=1", "curl/8.0", http.StatusBadRequest, "only one of"},
+		{"Encrypted", "/enc1?head=1", "curl/8.0", http.StatusBadRequest, "only apply to text pastes"},
+		{"Short link", "/link?head=1", "curl/8.0", http.StatusBadRequest, "only apply to text pastes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			mockS3 := &db.MockS3{}
+			mockS3.On("GetObjectStream", "S/big1.zst").Return([]byte(log), nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			if tt.expectedCode == http.StatusOK {
+				assert.Equal(t, tt.expectedBody, w.Body.String())
+			} else {
+				assert.Contains(t, w.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
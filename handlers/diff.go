@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// diffContextLines is how many unchanged lines are shown around each change
+const diffContextLines = 3
+
+// diffCell is one side of a row in the split diff view. Line is 0 when the
+// side is empty.
+type diffCell struct {
+	Line  int
+	Text  string
+	Class string // "ctx", "del" or "add"
+}
+
+// diffRow is a row of the diff view: a hunk header, a unified line with both
+// line numbers, or an old and new cell side by side
+type diffRow struct {
+	Header           string
+	Class            string
+	OldLine, NewLine int
+	Text             string
+	Old, New         diffCell
+}
+
+// DiffHandler handles GET /diff/:a/:b, comparing two pastes, or two revisions
+// given as code@N, line by line. Browsers get a highlighted view that is
+// unified or, with ?view=split, side by side; other clients get a plain
+// unified diff, which is empty when the contents are identical.
+func (h *Handlers) DiffHandler(c *gin.Context) {
+	oldName, newName := c.Param("a"), c.Param("b")
+	oldText, ok := h.diffContent(c, oldName)
+	if !ok {
+		return
+	}
+	newText, ok := h.diffContent(c, newName)
+	if !ok {
+		return
+	}
+
+	lines := utils.DiffLines(utils.SplitLines(oldText), utils.SplitLines(newText))
+	hunks := utils.DiffHunks(lines, diffContextLines)
+
+	if !utils.ShouldReturnHTML(c) {
+		c.String(http.StatusOK, utils.UnifiedDiff(oldName, newName, hunks))
+		return
+	}
+
+	added, removed := 0, 0
+	for _, line := range lines {
+		switch line.Kind {
+		case utils.DiffInsert:
+			added++
+		case utils.DiffDelete:
+			removed++
+		}
+	}
+
+	split := c.Query("view") == "split"
+	var rows []diffRow
+	if split {
+		rows = splitDiffRows(hunks)
+	} else {
+		rows = unifiedDiffRows(hunks)
+	}
+
+	c.HTML(http.StatusOK, "diff.html", gin.H{
+		"old":       oldName,
+		"new":       newName,
+		"rows":      rows,
+		"split":     split,
+		"added":     added,
+		"removed":   removed,
+		"identical": len(hunks) == 0,
+	})
+}
+
+// diffContent loads one side of a diff, writing an error and returning false
+// if it can't be compared. Pastes behind a password or view limit are only
+// diffed for their owner, since a diff would read them without a password
+// or a counted view.
+func (h *Handlers) diffContent(c *gin.Context, param string) (string, bool) {
+	code, rev, ok := cutRevision(param)
+	if !ok {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid revision: %s", param))
+		return "", false
+	}
+	if !utils.IsValidCode(code) {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid code format: %s", code))
+		return "", false
+	}
+
+	record, err := h.DB.GetRedirect(code)
+	if err == nil {
+		record, err = h.withRevision(record, rev)
+	}
+	if err != nil {
+		log.Printf("Diff: Failed to look up code %s: %v", code, err)
+		respondError(c, http.StatusInternalServerError, "Failed to retrieve paste")
+		return "", false
+	}
+	if record == nil {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Paste %s not found or has expired", code))
+		return "", false
+	}
+	if rev != 0 && !record.HasRevision(rev) {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Revision not found: %s", param))
+		return "", false
+	}
+	if record.Typ == "B" {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("%s is a multi-file paste and cannot be diffed", code))
+		return "", false
+	}
+	if record.Typ != "D" && record.Typ != "S" {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("%s is not a paste", code))
+		return "", false
+	}
+	if record.Binary() {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("%s is a binary file and cannot be diffed", code))
+		return "", false
+	}
+	if record.Enc {
+		// The server never sees the key, so only the browser can read these
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("%s is encrypted and cannot be diffed", code))
+		return "", false
+	}
+	if (record.PassHash != "" || record.Burn || record.MaxViews > 0) && !isRecordOwner(c, record) {
+		respondError(c, http.StatusForbidden, fmt.Sprintf("%s is protected and can only be diffed by its owner", code))
+		return "", false
+	}
+
+	s3Key := revisionBlobKey(record, rev)
+	if s3Key == "" {
+		return record.Val, true
+	}
+	stream, ok := h.openBlob(c, s3Key)
+	if !ok {
+		return "", false
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			log.Printf("Failed to close S3 stream for %s: %v", s3Key, err)
+		}
+	}()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		log.Printf("S3 error reading %s: %v", s3Key, err)
+		respondError(c, http.StatusInternalServerError, "Failed to retrieve content")
+		return "", false
+	}
+	return string(data), true
+}
+
+// diffClass is the CSS class of a diff line
+func diffClass(kind utils.DiffKind) string {
+	switch kind {
+	case utils.DiffDelete:
+		return "del"
+	case utils.DiffInsert:
+		return "add"
+	}
+	return "ctx"
+}
+
+// unifiedDiffRows lays hunks out one line per row
+func unifiedDiffRows(hunks []utils.DiffHunk) []diffRow {
+	var rows []diffRow
+	for _, hunk := range hunks {
+		rows = append(rows, diffRow{Header: hunk.Header()})
+		for _, line := range hunk.Lines {
+			rows = append(rows, diffRow{Class: diffClass(line.Kind), OldLine: line.OldLine, NewLine: line.NewLine, Text: line.Text})
+		}
+	}
+	return rows
+}
+
+// splitDiffRows lays hunks out side by side. Each run of deleted lines is
+// paired with the inserted lines that follow it, so a changed line shows
+// its old and new version on the same row.
+func splitDiffRows(hunks []utils.DiffHunk) []diffRow {
+	var rows []diffRow
+	for _, hunk := range hunks {
+		rows = append(rows, diffRow{Header: hunk.Header()})
+		lines := hunk.Lines
+		for i := 0; i < len(lines); {
+			if lines[i].Kind == utils.DiffEqual {
+				line := lines[i]
+				rows = append(rows, diffRow{
+					Old: diffCell{Line: line.OldLine, Text: line.Text, Class: "ctx"},
+					New: diffCell{Line: line.NewLine, Text: line.Text, Class: "ctx"},
+				})
+				i++
+				continue
+			}
+
+			var dels, adds []utils.DiffLine
+			for i < len(lines) && lines[i].Kind == utils.DiffDelete {
+				dels = append(dels, lines[i])
+				i++
+			}
+			for i < len(lines) && lines[i].Kind == utils.DiffInsert {
+				adds = append(adds, lines[i])
+				i++
+			}
+			for j := 0; j < max(len(dels), len(adds)); j++ {
+				var row diffRow
+				if j < len(dels) {
+					row.Old = diffCell{Line: dels[j].OldLine, Text: dels[j].Text, Class: "del"}
+				}
+				if j < len(adds) {
+					row.New = diffCell{Line: adds[j].NewLine, Text: adds[j].Text, Class: "add"}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"abcd": {Code: "abcd", Typ: "D", Val: "one\ntwo\nthree\n", Ettl: future, Owner: "owner1"},
+		"efgh": {Code: "efgh", Typ: "S", Ettl: future, Owner: "owner1"},
+		"edit": {
+			Code: "edit", Typ: "D", Val: "one\nTWO\nthree\n", Ettl: future, Rev: 2, Owner: "owner1",
+			Revs: db.Revisions{{Rev: 1, Created: 1000, Size: 14}},
+		},
+		"link": {Code: "link", Typ: "R", Val: "https://example.com/", Ettl: future},
+		"encr": {Code: "encr", Typ: "D", Val: "ciphertext", Ettl: future, Enc: true},
+		"pass": {Code: "pass", Typ: "D", Val: "secret", Ettl: future, PassHash: "hash", Owner: "owner1"},
+		"burn": {Code: "burn", Typ: "D", Val: "other", Ettl: future, Burn: true, Owner: "owner1"},
+		"file": {Code: "file", Typ: "S", Ettl: future, Filename: "pixel.png", Mime: "image/png"},
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		userAgent      string
+		cookie         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Unified diff for raw clients", "/diff/abcd/efgh", "curl/8.0", "", http.StatusOK,
+			"--- abcd\n+++ efgh\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"},
+		{"Identical contents", "/diff/abcd/edit@1", "curl/8.0", "", http.StatusOK, ""},
+		{"Revisions", "/diff/edit@1/edit", "curl/8.0", "", http.StatusOK, "-two\n+TWO\n"},
+		{"Unified view in the browser", "/diff/abcd/edit", "Mozilla/5.0 (browser)", "", http.StatusOK, `<tr class="add">`},
+		{"Split view in the browser", "/diff/abcd/edit?view=split", "Mozilla/5.0 (browser)", "", http.StatusOK, `<td class="text add">TWO</td>`},
+		{"Identical in the browser", "/diff/abcd/abcd", "Mozilla/5.0 (browser)", "", http.StatusOK, "The contents are identical."},
+		{"Missing paste", "/diff/abcd/gone", "curl/8.0", "", http.StatusNotFound, "Paste gone not found or has expired"},
+		{"Missing revision", "/diff/edit@5/edit", "curl/8.0", "", http.StatusNotFound, "Revision not found: edit@5"},
+		{"Invalid revision", "/diff/edit@x/edit", "curl/8.0", "", http.StatusBadRequest, "Invalid revision: edit@x"},
+		{"Short link", "/diff/abcd/link", "curl/8.0", "", http.StatusBadRequest, "link is not a paste"},
+		{"Binary file", "/diff/abcd/file", "curl/8.0", "", http.StatusBadRequest, "file is a binary file"},
+		{"Encrypted paste", "/diff/encr/abcd", "curl/8.0", "", http.StatusBadRequest, "encr is encrypted"},
+		{"Password protected", "/diff/pass/abcd", "curl/8.0", "", http.StatusForbidden, "pass is protected"},
+		{"Burn after reading", "/diff/abcd/burn", "curl/8.0", "", http.StatusForbidden, "burn is protected"},
+		{"Protected paste for its owner", "/diff/pass/burn", "curl/8.0", "owner1", http.StatusOK, "-secret\n+other\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+				mockDB.On("GetRedirectFresh", code).Return(record, nil)
+			}
+			mockDB.On("GetRedirect", "gone").Return(nil, nil)
+			mockS3.On("GetObjectStream", "S/efgh.zst").Return([]byte("one\n2\nthree\n"), nil)
+			mockS3.On("GetObjectStream", "S/edit.zst").Return([]byte("one\ntwo\nthree\n"), nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/diff/:a/:b", h.DiffHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "id", Value: tt.cookie})
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedBody == "" {
+				assert.Empty(t, w.Body.String())
+			} else {
+				assert.Contains(t, w.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadField is the multipart field holding an uploaded file
+const uploadField = "file"
+
+// maxFilenameLength caps a stored upload name, in bytes
+const maxFilenameLength = 255
+
+// inlineTypes are the binary types browsers only ever display. They are
+// served as themselves and previewed on the file page; every other type is
+// served as an application/octet-stream attachment so nothing uploaded can
+// run in the browser.
+var inlineTypes = map[string]bool{
+	"image/png":    true,
+	"image/jpeg":   true,
+	"image/gif":    true,
+	"image/webp":   true,
+	"image/bmp":    true,
+	"image/x-icon": true,
+	"audio/mpeg":   true,
+	"audio/wave":   true,
+	"video/mp4":    true,
+	"video/webm":   true,
+}
+
+// isMultipart reports whether the request body is a multipart/form-data upload
+func isMultipart(c *gin.Context) bool {
+	return c.ContentType() == "multipart/form-data"
+}
+
+// uploadPart finds the first file part of a multipart upload, and returns
+// the source of any files after it. The body is streamed rather than parsed
+// as a whole form, so other fields are never read; options go in the query
+// string as they do for a raw body.
+func uploadPart(c *gin.Context) (*multipart.Part, *multipartFiles, error) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid multipart upload: %w", err)
+	}
+	part, err := nextUploadPart(reader)
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("multipart upload needs a %s field", uploadField)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return part, &multipartFiles{reader: reader}, nil
+}
+
+// nextUploadPart skips to the next file part, returning io.EOF after the last
+func nextUploadPart(reader *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart upload: %w", err)
+		}
+		if part.FormName() == uploadField {
+			return part, nil
+		}
+	}
+}
+
+// cleanFilename reduces a client-supplied file name to a base name without
+// control characters, safe to show on a page and in Content-Disposition
+func cleanFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	// Windows clients may send the full path with backslashes
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	for len(name) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// binaryType sniffs the start of an upload and returns its MIME type, or ""
+// if it is UTF-8 text to be stored as an ordinary paste
+func binaryType(head []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !strings.HasPrefix(mediaType, "text/") {
+		return mediaType
+	}
+	// The sniffed prefix may end part way through a character
+	text := head
+	for i := 0; i < utf8.UTFMax-1 && len(text) > 0 && !utf8.Valid(text); i++ {
+		text = text[:len(text)-1]
+	}
+	if !utf8.Valid(text) {
+		return mediaType
+	}
+	return ""
+}
+
+// previewKind is the HTML element file.html shows a binary file with, or ""
+// if it can only be downloaded
+func previewKind(mimeType string) string {
+	if !inlineTypes[mimeType] {
+		return ""
+	}
+	kind, _, _ := strings.Cut(mimeType, "/")
+	return kind
+}
+
+// downloadName is the file name a paste is saved as: the uploaded file's, or
+// the code with the extension of its language if it had none
+func downloadName(record *db.RedirectRecord) string {
+	if record.Filename != "" {
+		return record.Filename
+	}
+	if record.Binary() {
+		return record.Code
+	}
+	return record.Code + languageExt(pasteLanguage(record))
+}
+
+// contentDisposition builds a Content-Disposition header naming the file
+func contentDisposition(disposition, name string) string {
+	return mime.FormatMediaType(disposition, map[string]string{"filename": name})
+}
+
+// serveFile answers a read of a binary file. Browsers get a preview page
+// that loads the file itself with ?raw, unless a password, burn or view limit
+// means that second request would fail; then, like raw clients, they get the
+// file straight away. With ?download it is always an attachment.
+func (h *Handlers) serveFile(c *gin.Context, record *db.RedirectRecord, fullURL string, wantHTML, isOwner bool) {
+	download := c.Request.URL.Query().Has("download")
+	protected := record.PassHash != "" || record.Burn || record.MaxViews > 0
+
+	setCacheHeaders(c, record, 0)
+
+	if wantHTML && (isOwner || !protected) {
+		c.HTML(http.StatusOK, "file.html", gin.H{
+			"code":        record.Code,
+			"url":         fullURL,
+			"filename":    record.Filename,
+			"mime":        record.Mime,
+			"size":        record.Size,
+			"preview":     previewKind(record.Mime),
+			"fromSuccess": c.Query("from") == "success",
+			"created":     record.Created,
+			"expires":     record.Ettl,
+			"showDelete":  isOwner,
+		})
+		return
+	}
+
+	var stored *storedContent
+	if hashVisible(record, isOwner) {
+		content := pasteContent(record, 0)
+		stored = &content
+	}
+	h.streamFile(c, db.BlobKey(record.Code), downloadName(record), record.Mime, download, stored)
+}
+
+// streamFile sends the file stored at s3Key. Text and the inline types are
+// served as themselves, everything else as an application/octet-stream
+// attachment; with download set, everything is an attachment. Sent as
+// stored, the file can be revalidated and fetched in ranges, unless stored is
+// nil.
+func (h *Handlers) streamFile(c *gin.Context, s3Key, name, mimeType string, download bool, stored *storedContent) {
+	lineRange, err := utils.ParseLineRange(c.Request.URL.Query())
+	if err != nil {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", err.Error())
+		return
+	}
+	if lineRange != nil && mimeType != "" {
+		utils.RespondWithError(c, http.StatusBadRequest, "error", "Line ranges only apply to text files")
+		return
+	}
+	stripANSI := mimeType == "" && c.Request.URL.Query().Has("strip-ansi")
+	asStored := stored != nil && lineRange == nil && !stripANSI
+	if asStored && stored.isCurrent(c) {
+		stored.sendNotModified(c)
+		return
+	}
+
+	stream, ok := h.openBlob(c, s3Key)
+	if !ok {
+		return
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			log.Printf("Failed to close S3 stream for %s: %v", s3Key, err)
+		}
+	}()
+
+	var body io.Reader = stream
+	contentType, disposition := "application/octet-stream", "attachment"
+	switch {
+	case mimeType == "":
+		contentType = textContentType(languageForFile(name))
+		if !download {
+			disposition = "inline"
+		}
+		if stripANSI {
+			body = utils.NewANSIStripReader(stream)
+		}
+		if lineRange != nil {
+			body = lineRange.Reader(body)
+		}
+	case inlineTypes[mimeType] && !download:
+		contentType, disposition = mimeType, "inline"
+	}
+	headers := map[string]string{"Content-Disposition": contentDisposition(disposition, name)}
+	if !asStored {
+		sendContent(c, nil, contentType, body, -1, headers)
+		return
+	}
+	stored.setHeaders(c)
+	sendContent(c, stored, contentType, body, -1, headers)
+}
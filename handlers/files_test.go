@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// pngData is the start of a PNG file, enough for content sniffing
+const pngData = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89"
+
+func TestCleanFilename(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"photo.png", "photo.png"},
+		{`C:\Users\me\photo.png`, "photo.png"},
+		{"../../etc/passwd", "passwd"},
+		{"bad\x00\nname.txt", "badname.txt"},
+		{"bad\xffutf8.txt", "badutf8.txt"},
+		{"", ""},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127)},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, cleanFilename(tt.input), tt.input)
+	}
+}
+
+func TestBinaryType(t *testing.T) {
+	assert.Equal(t, "image/png", binaryType([]byte(pngData)))
+	assert.Equal(t, "application/pdf", binaryType([]byte("%PDF-1.7\n")))
+	assert.Equal(t, "", binaryType([]byte("package main\n")))
+	assert.Equal(t, "", binaryType([]byte("<html><body>hi</body></html>")), "HTML is stored as text")
+	assert.Equal(t, "", binaryType([]byte("ab€")[:3]), "a prefix may end part way through a character")
+	assert.Equal(t, "application/octet-stream", binaryType([]byte("\x00\x01\x02\x03")))
+}
+
+func TestPostHandlerUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 3600, PasteDynamoDBCutoffSize: 1024, PasteMaxSize: 64}
+
+	multipartBody := func(field, filename, content string) (*bytes.Buffer, string) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		require.NoError(t, writer.WriteField("note", "ignored"))
+		part, err := writer.CreateFormFile(field, filename)
+		require.NoError(t, err)
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+		return &body, writer.FormDataContentType()
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		field          string
+		filename       string
+		content        string
+		expectedStatus int
+		expectedTyp    string
+		expectedMime   string
+	}{
+		{"Binary file goes to the blob store", "/", "file", "pixel.png", pngData, http.StatusOK, "S", "image/png"},
+		{"Text file is an ordinary paste", "/", "file", "main.go", "package main\n", http.StatusOK, "D", ""},
+		{"Binary files are refused rather than truncated", "/", "file", "big.bin", "\x00" + strings.Repeat("x", 100), http.StatusRequestEntityTooLarge, "", ""},
+		{"Text files are truncated like any paste", "/", "file", "big.txt", strings.Repeat("x", 100), http.StatusOK, "D", ""},
+		{"Missing file field", "/", "upload", "pixel.png", pngData, http.StatusBadRequest, "", ""},
+		{"Binary content cannot be encrypted", "/?enc", "file", "pixel.png", pngData, http.StatusBadRequest, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+			mockDB.On("SetSize", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			mockDB.On("DeleteRedirect", mock.Anything, mock.Anything).Return(nil)
+			mockS3.On("PutObjectStream", mock.Anything, mock.Anything).Return(nil)
+
+			r := gin.New()
+			r.Use(sessions.Sessions("xipe_session", cookie.NewStore([]byte("test-secret-key"))))
+			r.POST("/", h.PostHandler)
+
+			body, contentType := multipartBody(tt.field, tt.filename, tt.content)
+			req := httptest.NewRequest("POST", tt.path, body)
+			req.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedStatus != http.StatusOK {
+				if stored != nil {
+					// Stored before the size was known, then rolled back
+					mockDB.AssertCalled(t, "DeleteRedirect", stored.Code, mock.Anything)
+				}
+				return
+			}
+			require.NotNil(t, stored)
+			assert.Equal(t, tt.expectedTyp, stored.Typ)
+			assert.Equal(t, tt.filename, stored.Filename)
+			assert.Equal(t, tt.expectedMime, stored.Mime)
+			if tt.expectedTyp == "S" {
+				mockS3.AssertCalled(t, "PutObjectStream", "S/"+stored.Code+".zst", []byte(tt.content))
+			} else {
+				assert.Equal(t, tt.content[:min(len(tt.content), 64)], stored.Val)
+			}
+		})
+	}
+}
+
+func TestDataHandlerFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"imgf": {Code: "imgf", Typ: "S", Ettl: future, Size: int64(len(pngData)), Filename: "pixel.png", Mime: "image/png"},
+		"zipf": {Code: "zipf", Typ: "S", Ettl: future, Size: 4, Filename: "archive.zip", Mime: "application/zip"},
+		"burn": {Code: "burn", Typ: "S", Ettl: future, Size: 4, Mime: "image/png", Burn: true},
+		"text": {Code: "text", Typ: "D", Val: "hello", Ettl: future},
+	}
+
+	tests := []struct {
+		name                string
+		path                string
+		userAgent           string
+		expectedType        string
+		expectedDisposition string
+		expectedBody        string
+	}{
+		{"Image served inline", "/imgf", "curl/8.0", "image/png", `inline; filename=pixel.png`, pngData},
+		{"Image download", "/imgf?download", "curl/8.0", "application/octet-stream", `attachment; filename=pixel.png`, pngData},
+		{"Other types are only attachments", "/zipf", "curl/8.0", "application/octet-stream", `attachment; filename=archive.zip`, "PK\x03\x04"},
+		{"Image preview page", "/imgf", "Mozilla/5.0 (browser)", "text/html; charset=utf-8", "", `<img src="/imgf?raw"`},
+		{"Download-only page", "/zipf", "Mozilla/5.0 (browser)", "text/html; charset=utf-8", "", `href="/zipf?download"`},
+		{"Burned file is served directly", "/burn?reveal", "Mozilla/5.0 (browser)", "image/png", `inline; filename=burn`, pngData},
+		{"Text paste download", "/text?download", "Mozilla/5.0 (browser)", "text/plain; charset=utf-8", `attachment; filename=text.txt`, "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			burned := *records["burn"]
+			burned.Views = 1
+			mockDB.On("ConsumeRedirect", "burn").Return(&burned, nil)
+			mockS3.On("GetObjectStream", "S/imgf.zst").Return([]byte(pngData), nil)
+			mockS3.On("GetObjectStream", "S/zipf.zst").Return([]byte("PK\x03\x04"), nil)
+			mockS3.On("GetObjectStream", "S/burn.zst").Return([]byte(pngData), nil)
+			mockS3.On("DeleteObject", "S/burn.zst").Return(nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tt.expectedType, w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.expectedDisposition, w.Header().Get("Content-Disposition"))
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forkSource is where a fork's content comes from
+type forkSource struct {
+	parent   string    // Parent code, with @N when the parent had been edited
+	content  io.Reader // The edited body, or the parent's own content
+	filename string    // The parent's file name and language, kept unless the fork gives its own
+	lang     string
+}
+
+// ForkHandler handles POST /:code/fork: a new paste, owned by the caller,
+// that starts from another paste or revision (code@N). The body, or the data
+// field for form input, is the edited content; without one the parent is
+// copied as is. The fork takes the same options as POST / and gets its own
+// code, expiry and delete token.
+func (h *Handlers) ForkHandler(c *gin.Context) {
+	code, rev, ok := splitRevision(c, c.Param("code"))
+	if !ok {
+		c.String(http.StatusBadRequest, "Error: Invalid revision\n")
+		return
+	}
+	if !utils.IsValidCode(code) {
+		c.String(http.StatusBadRequest, "Error: Invalid code format\n")
+		return
+	}
+
+	parent, err := h.DB.GetRedirect(code)
+	if err == nil {
+		parent, err = h.withRevision(parent, rev)
+	}
+	if err != nil {
+		log.Printf("Fork: Failed to look up code %s: %v", code, err)
+		c.String(http.StatusInternalServerError, "Error: Failed to retrieve paste\n")
+		return
+	}
+	if parent == nil {
+		c.String(http.StatusNotFound, "Error: Paste not found or has expired\n")
+		return
+	}
+	if rev != 0 && !parent.HasRevision(rev) {
+		c.String(http.StatusNotFound, "Error: Revision not found\n")
+		return
+	}
+	if parent.Typ == "B" {
+		c.String(http.StatusBadRequest, "Error: Multi-file pastes cannot be forked\n")
+		return
+	}
+	if parent.Typ != "D" && parent.Typ != "S" {
+		c.String(http.StatusBadRequest, "Error: Only pastes can be forked\n")
+		return
+	}
+	if parent.Binary() {
+		c.String(http.StatusBadRequest, "Error: Binary files cannot be forked\n")
+		return
+	}
+	if parent.Enc {
+		// The server can't read the content to copy it
+		c.String(http.StatusBadRequest, "Error: Encrypted pastes cannot be forked\n")
+		return
+	}
+	// Forking would read the content without a password or a counted view
+	if (parent.PassHash != "" || parent.Burn || parent.MaxViews > 0) && !isRecordOwner(c, parent) {
+		c.String(http.StatusForbidden, "Error: Protected pastes can only be forked by their owner\n")
+		return
+	}
+
+	// Name the exact revision, since an edited parent's latest content changes
+	if rev == 0 && parent.Revision() > 1 {
+		rev = parent.Revision()
+	}
+	fork := &forkSource{parent: code, filename: parent.Filename, lang: parent.Lang}
+	if rev != 0 {
+		fork.parent += "@" + strconv.FormatInt(rev, 10)
+	}
+
+	isFormInput := c.Query("input") == "form"
+	if isFormInput {
+		if data := c.PostForm("data"); data != "" {
+			fork.content = strings.NewReader(data)
+		}
+	} else {
+		body := bufio.NewReader(c.Request.Body)
+		if _, err := body.Peek(1); err == nil {
+			fork.content = body
+		} else if !errors.Is(err, io.EOF) {
+			c.String(http.StatusBadRequest, "Error: Failed to read request body\n")
+			return
+		}
+	}
+	if fork.content == nil {
+		if s3Key := revisionBlobKey(parent, rev); s3Key == "" {
+			fork.content = strings.NewReader(parent.Val)
+		} else {
+			stream, ok := h.openBlob(c, s3Key)
+			if !ok {
+				return
+			}
+			defer func() {
+				if err := stream.Close(); err != nil {
+					log.Printf("Failed to close S3 stream for %s: %v", s3Key, err)
+				}
+			}()
+			fork.content = stream
+		}
+	}
+
+	ownerID, err := getOrCreateOwnerID(c)
+	if err != nil {
+		log.Printf("Failed to generate owner ID: %v", err)
+		c.String(http.StatusInternalServerError, "Error: Failed to generate owner ID\n")
+		return
+	}
+
+	record, deleteToken, perr := h.createPaste(c, ownerID, isFormInput, fork)
+	if perr != nil {
+		c.String(perr.status, "Error: %s\n", perr.message)
+		return
+	}
+
+	log.Printf("Fork: Created %s from %s", record.Code, fork.parent)
+	c.Header(deleteTokenHeader, deleteToken)
+	h.respondCreated(c, record.Code, ownerID, isFormInput)
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForkHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 3600, PasteDynamoDBCutoffSize: 16, PasteMaxSize: 1024}
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"abcd": {Code: "abcd", Typ: "D", Val: "original", Ettl: future, Owner: "owner1"},
+		"edit": {
+			Code: "edit", Typ: "S", Ettl: future, Rev: 2, Owner: "owner1",
+			Revs: db.Revisions{{Rev: 1, Created: 1000, Size: 5}},
+		},
+		"link": {Code: "link", Typ: "R", Val: "https://example.com/", Ettl: future},
+		"encr": {Code: "encr", Typ: "D", Val: "ciphertext", Ettl: future, Enc: true},
+		"pass": {Code: "pass", Typ: "D", Val: "secret", Ettl: future, PassHash: "hash", Owner: "owner1"},
+		"file": {Code: "file", Typ: "S", Ettl: future, Filename: "pixel.png", Mime: "image/png"},
+	}
+
+	newRouter := func(h *Handlers) *gin.Engine {
+		r := gin.New()
+		r.Use(sessions.Sessions("xipe_session", cookie.NewStore([]byte("test-secret-key"))))
+		r.POST("/:code/fork", h.ForkHandler)
+		return r
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		formData       string // Sent as form input when set
+		cookie         string
+		expectedStatus int
+		expectedVal    string // Content of the stored fork
+		expectedBlob   string // Content uploaded to the blob store instead
+		expectedParent string
+		expectedError  string
+	}{
+		{"Copy of a paste", "/abcd/fork", "", "", "", http.StatusOK, "original", "", "abcd", ""},
+		{"Edited copy", "/abcd/fork", "changed", "", "", http.StatusOK, "changed", "", "abcd", ""},
+		{"Edited in the form", "/abcd/fork?input=form", "", "from browser", "", http.StatusSeeOther, "from browser", "", "abcd", ""},
+		{"Latest revision of an edited paste", "/edit/fork", "", "", "", http.StatusOK, "", "a large second revision", "edit@2", ""},
+		{"Earlier revision", "/edit@1/fork", "", "", "", http.StatusOK, "first", "", "edit@1", ""},
+		{"Protected paste for its owner", "/pass/fork", "", "", "owner1", http.StatusOK, "secret", "", "pass", ""},
+		{"Missing paste", "/gone/fork", "", "", "", http.StatusNotFound, "", "", "", "Paste not found"},
+		{"Missing revision", "/edit@7/fork", "", "", "", http.StatusNotFound, "", "", "", "Revision not found"},
+		{"Short link", "/link/fork", "", "", "", http.StatusBadRequest, "", "", "", "Only pastes can be forked"},
+		{"Binary file", "/file/fork", "", "", "", http.StatusBadRequest, "", "", "", "Binary files cannot be forked"},
+		{"Encrypted paste", "/encr/fork", "", "", "", http.StatusBadRequest, "", "", "", "Encrypted pastes cannot be forked"},
+		{"Protected paste", "/pass/fork", "", "", "", http.StatusForbidden, "", "", "", "Protected pastes can only be forked by their owner"},
+		{"Fork as a short link", "/abcd/fork?url=https://example.com/", "", "", "", http.StatusBadRequest, "", "", "", "A fork is always a paste"},
+		{"Encrypted fork", "/abcd/fork?enc", "", "", "", http.StatusBadRequest, "", "", "", "Forks cannot be encrypted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+				mockDB.On("GetRedirectFresh", code).Return(record, nil)
+			}
+			mockDB.On("GetRedirect", "gone").Return(nil, nil)
+			mockS3.On("GetObjectStream", "S/edit.zst").Return([]byte("first"), nil)
+			mockS3.On("GetObjectStream", "S/edit@2.zst").Return([]byte("a large second revision"), nil)
+			mockS3.On("PutObjectStream", mock.Anything, mock.Anything).Return(nil)
+			mockDB.On("SetSize", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+
+			var req *http.Request
+			if tt.formData != "" {
+				req = httptest.NewRequest("POST", tt.path, strings.NewReader(url.Values{"data": {tt.formData}}.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "id", Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			newRouter(h).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedError != "" {
+				assert.Contains(t, w.Body.String(), tt.expectedError)
+				mockDB.AssertNotCalled(t, "PutRedirect", mock.Anything)
+				return
+			}
+
+			require.NotNil(t, stored)
+			assert.Equal(t, tt.expectedParent, stored.Parent)
+			assert.NotEqual(t, tt.expectedParent, stored.Code)
+			assert.NotEmpty(t, w.Header().Get("X-Delete-Token"))
+			if tt.expectedBlob != "" {
+				assert.Equal(t, "S", stored.Typ)
+				mockS3.AssertCalled(t, "PutObjectStream", "S/"+stored.Code+".zst", []byte(tt.expectedBlob))
+			} else {
+				assert.Equal(t, "D", stored.Typ)
+				assert.Equal(t, tt.expectedVal, stored.Val)
+			}
+			if tt.cookie == "" {
+				// The fork belongs to whoever made it, not the parent's owner
+				assert.NotEqual(t, "owner1", stored.Owner)
+			}
+		})
+	}
+}
+
+func TestDataHandlerFork(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	mockDB := &db.MockDB{}
+	mockDB.On("GetRedirect", "efgh").Return(&db.RedirectRecord{Code: "efgh", Typ: "D", Val: "changed", Ettl: future, Parent: "abcd@2"}, nil)
+	mockDB.On("GetRedirect", "pass").Return(&db.RedirectRecord{Code: "pass", Typ: "D", Val: "secret", Ettl: future, Burn: true, Owner: "owner1"}, nil)
+	h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+
+	router := gin.New()
+	router.LoadHTMLGlob("../templates/*")
+	router.GET("/:code", h.CatchAllHandler)
+
+	req := httptest.NewRequest("GET", "/efgh", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (browser)")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `Forked from <a href="/abcd@2">abcd@2</a>`)
+	assert.Contains(t, w.Body.String(), `href="/diff/abcd@2/efgh"`)
+	assert.Contains(t, w.Body.String(), `action="/efgh/fork?input=form"`)
+
+	// Only the owner is offered a fork of a protected paste
+	req = httptest.NewRequest("GET", "/pass", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (browser)")
+	req.AddCookie(&http.Cookie{Name: "id", Value: "owner1"})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `action="/pass/fork?input=form"`)
+	assert.NotContains(t, w.Body.String(), "Forked from")
+}
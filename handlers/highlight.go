@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// highlightStyle is the chroma style pastes are highlighted with
+const highlightStyle = "github-dark"
+
+// highlightCSS is the stylesheet for highlighted pastes, served as
+// /highlight.css. The page sets its own background.
+var highlightCSS = func() string {
+	var css strings.Builder
+	formatter := html.New(html.WithClasses(true), html.WithLineNumbers(true), html.WithLinkableLineNumbers(true, "L"))
+	if err := formatter.WriteCSS(&css, styles.Get(highlightStyle)); err != nil {
+		log.Printf("Failed to generate highlight CSS: %v", err)
+	}
+	return css.String()
+}()
+
+// Highlighter renders pastes as highlighted HTML, or rendered Markdown,
+// keeping recent renders in an LRU cache as the DynamoDB client keeps
+// records. A nil highlighter renders every time.
+type Highlighter struct {
+	cache *expirable.LRU[string, template.HTML]
+}
+
+// NewHighlighter keeps up to maxItems renders, each for at most an hour
+func NewHighlighter(maxItems int) *Highlighter {
+	return &Highlighter{cache: expirable.NewLRU[string, template.HTML](maxItems, nil, time.Hour)}
+}
+
+// Highlight renders source like highlight, reusing an earlier render of the
+// same content
+func (h *Highlighter) Highlight(source, lang, anchor string) template.HTML {
+	return h.cached(func() template.HTML { return highlight(source, lang, anchor) }, "highlight", lang, anchor, source)
+}
+
+// Markdown renders source like renderMarkdown, reusing an earlier render of
+// the same content
+func (h *Highlighter) Markdown(source string) template.HTML {
+	return h.cached(func() template.HTML { return renderMarkdown(source) }, "markdown", source)
+}
+
+// ANSI renders source like renderANSI, reusing an earlier render of the
+// same content
+func (h *Highlighter) ANSI(source, anchor string) template.HTML {
+	return h.cached(func() template.HTML { return renderANSI(source, anchor) }, "ansi", anchor, source)
+}
+
+// cached returns the render of parts from the cache, or renders it. Renders
+// are keyed by a hash of everything that goes into them, so an edited or
+// recreated paste can never get a stale one.
+func (h *Highlighter) cached(render func() template.HTML, parts ...string) template.HTML {
+	if h == nil {
+		return render()
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	key := hex.EncodeToString(sum[:])
+	if rendered, ok := h.cache.Get(key); ok {
+		return rendered
+	}
+	rendered := render()
+	h.cache.Add(key, rendered)
+	return rendered
+}
+
+// cacheableRender reports whether renders of record may be cached. Protected
+// pastes are kept out of the cache, just as the DynamoDB client never caches
+// view-limited records.
+func cacheableRender(record *db.RedirectRecord) bool {
+	return !record.Burn && record.MaxViews == 0 && record.PassHash == ""
+}
+
+// How the page of a text paste shows it, as chosen with ?render=
+const (
+	renderModeSource   = "source" // Highlighted as code
+	renderModeMarkdown = "md"     // Rendered Markdown
+	renderModeANSI     = "ansi"   // Terminal output with its colours
+	renderModeData     = "data"   // JSON or YAML as a tree, CSV as a table
+)
+
+// pageRender returns how the page of text shows it: as ?render= asks, or
+// else rendered if it is a Markdown file, as terminal output if it has
+// escape sequences, and as highlighted source otherwise
+func pageRender(c *gin.Context, isMarkdown bool, text string) string {
+	switch mode := c.Query("render"); mode {
+	case renderModeSource, renderModeMarkdown, renderModeANSI, renderModeData:
+		return mode
+	}
+	switch {
+	case isMarkdown:
+		return renderModeMarkdown
+	case utils.HasANSI(text):
+		return renderModeANSI
+	}
+	return renderModeSource
+}
+
+// highlightPaste renders text of record for its page
+func (h *Handlers) highlightPaste(record *db.RedirectRecord, source, lang, anchor string) template.HTML {
+	if !cacheableRender(record) {
+		return highlight(source, lang, anchor)
+	}
+	return h.Render.Highlight(source, lang, anchor)
+}
+
+// highlight renders source as one line per row, each numbered with a link to
+// its own anchor, anchor+"N". The language is detected if lang is empty or
+// unknown, and plain text is the fallback.
+func highlight(source, lang, anchor string) template.HTML {
+	return formatCode(source, lang, html.New(html.WithClasses(true), html.WithLineNumbers(true), html.WithLinkableLineNumbers(true, anchor)))
+}
+
+// highlightBlock renders source like highlight, without line numbers, for
+// code blocks within a rendered page
+func highlightBlock(source, lang string) template.HTML {
+	return formatCode(source, lang, html.New(html.WithClasses(true)))
+}
+
+// formatCode highlights source in lang with formatter
+func formatCode(source, lang string, formatter *html.Formatter) template.HTML {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Analyse(source)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	var out strings.Builder
+	iterator, err := lexer.Tokenise(nil, source)
+	if err == nil {
+		err = formatter.Format(&out, styles.Get(highlightStyle), iterator)
+	}
+	if err != nil {
+		log.Printf("Failed to highlight %d bytes as %s: %v", len(source), lexer.Config().Name, err)
+		return plainHTML(source)
+	}
+	// The formatter escapes all of the source
+	return template.HTML(out.String())
+}
+
+// plainHTML renders source without highlighting or line numbers
+func plainHTML(source string) template.HTML {
+	return template.HTML(`<pre class="chroma"><code>` + template.HTMLEscapeString(source) + `</code></pre>`)
+}
+
+// HighlightCSSHandler serves the stylesheet for highlighted pastes
+func (h *Handlers) HighlightCSSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Header("Expires", time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat))
+	c.Header("Pragma", "")
+	c.Data(http.StatusOK, "text/css; charset=utf-8", []byte(highlightCSS))
+}
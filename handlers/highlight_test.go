@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHighlight(t *testing.T) {
+	out := string(highlight("package main\n\nfunc main() {}\n", "go", "L"))
+	assert.Contains(t, out, `<span class="kn">package</span>`)
+	assert.Contains(t, out, `id="L1"`)
+	assert.Contains(t, out, `<a class="lnlinks" href="#L3">3</a>`)
+	assert.NotContains(t, out, `id="L4"`)
+
+	// Everything from the paste is escaped, whatever the language
+	out = string(highlight("<script>alert(1)</script>", "", "file-a.txt-L"))
+	assert.NotContains(t, out, "<script>")
+	assert.Contains(t, out, "&lt;")
+	assert.Contains(t, out, `id="file-a.txt-L1"`)
+
+	// Unknown languages fall back to detection, then plain text
+	assert.Contains(t, string(highlight("just words", "nosuchlang", "L")), "just words")
+}
+
+func TestLanguagesHaveLexers(t *testing.T) {
+	for _, lang := range languages {
+		assert.NotNil(t, lexers.Get(lang.name), lang.name)
+	}
+}
+
+func TestHighlighterCache(t *testing.T) {
+	h := NewHighlighter(10)
+	first := h.Highlight("x := 1\n", "go", "L")
+	assert.Equal(t, first, h.Highlight("x := 1\n", "go", "L"))
+	assert.Equal(t, 1, h.cache.Len())
+
+	h.Highlight("x := 1\n", "python", "L")
+	h.Highlight("x := 2\n", "go", "L")
+	assert.Equal(t, 3, h.cache.Len(), "each language and content is cached apart")
+
+	var none *Highlighter
+	assert.Equal(t, first, none.Highlight("x := 1\n", "go", "L"))
+}
+
+func TestDataHandlerHighlight(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"open": {Code: "open", Typ: "D", Val: "package main\n", Ettl: future, Lang: "go"},
+		"pass": {Code: "pass", Typ: "D", Val: "package main\n", Ettl: future, Lang: "go", PassHash: "hash", Owner: "owner1"},
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		cookie        string
+		expectedBody  string
+		expectedCache int
+	}{
+		{"Highlighted and cached", "/open", "", `<span class="kn">package</span>`, 1},
+		{"Highlighting off", "/open?noh", "", `class="data-content no-hl"`, 1},
+		{"Protected pastes are not cached", "/pass", "owner1", `<span class="kn">package</span>`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Render: NewHighlighter(10)}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", "Mozilla/5.0 (browser)")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "id", Value: tt.cookie})
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			assert.Contains(t, w.Body.String(), `id="L1"`)
+			assert.NotContains(t, w.Body.String(), "s.xi.pe")
+			assert.Equal(t, tt.expectedCache, h.Render.cache.Len())
+		})
+	}
+}
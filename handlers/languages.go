@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"path"
+	"strings"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+)
+
+// language is a syntax highlighting language a paste can be marked with
+type language struct {
+	name string   // Chroma lexer name, as stored on the paste
+	exts []string // File extensions or whole file names, the first used for downloads
+	typ  string   // Raw Content-Type, text/plain if empty
+}
+
+// languages are the languages a paste can be marked with. Raw content
+// is only ever served as a text type a browser displays: markup, styles and
+// scripts stay text/plain so nothing can be loaded or run from a raw URL.
+var languages = []language{
+	{"bash", []string{"sh", "bash", "zsh"}, "text/x-shellscript"},
+	{"c", []string{"c", "h"}, "text/x-c"},
+	{"cpp", []string{"cpp", "cc", "cxx", "hpp", "hh"}, "text/x-c++"},
+	{"csharp", []string{"cs"}, "text/x-csharp"},
+	{"csv", []string{"csv", "tsv"}, ""},
+	{"css", []string{"css"}, ""},
+	{"diff", []string{"diff", "patch"}, "text/x-diff"},
+	{"go", []string{"go"}, "text/x-go"},
+	{"graphql", []string{"graphql", "gql"}, ""},
+	{"ini", []string{"ini", "toml", "cfg", "conf"}, ""},
+	{"java", []string{"java"}, "text/x-java"},
+	{"javascript", []string{"js", "mjs", "cjs", "jsx"}, ""},
+	{"json", []string{"json"}, "application/json"},
+	{"kotlin", []string{"kt", "kts"}, "text/x-kotlin"},
+	{"lua", []string{"lua"}, "text/x-lua"},
+	{"makefile", []string{"mk", "mak", "makefile", "gnumakefile"}, "text/x-makefile"},
+	{"markdown", []string{"md", "markdown"}, "text/markdown"},
+	{"objectivec", []string{"m", "mm"}, "text/x-objcsrc"},
+	{"perl", []string{"pl", "pm"}, "text/x-perl"},
+	{"php", []string{"php"}, ""},
+	{"plaintext", []string{"txt", "text", "log"}, ""},
+	{"python", []string{"py", "pyw"}, "text/x-python"},
+	{"r", []string{"r"}, "text/x-r"},
+	{"ruby", []string{"rb"}, "text/x-ruby"},
+	{"rust", []string{"rs"}, "text/x-rust"},
+	{"scss", []string{"scss"}, ""},
+	{"sql", []string{"sql"}, "text/x-sql"},
+	{"swift", []string{"swift"}, "text/x-swift"},
+	{"typescript", []string{"ts", "tsx", "mts"}, ""},
+	{"vbnet", []string{"vb"}, "text/x-vb"},
+	{"xml", []string{"xml", "html", "htm", "svg", "xsd", "xsl"}, ""},
+	{"yaml", []string{"yaml", "yml"}, "text/yaml"},
+}
+
+// languageNames and languageExts index languages by name and by extension
+var languageNames, languageExts = func() (map[string]*language, map[string]*language) {
+	names, exts := map[string]*language{}, map[string]*language{}
+	for i := range languages {
+		lang := &languages[i]
+		names[lang.name] = lang
+		for _, ext := range lang.exts {
+			exts[ext] = lang
+		}
+	}
+	return names, exts
+}()
+
+// languageList returns the name of every language, for the paste form
+func languageList() []string {
+	names := make([]string, len(languages))
+	for i, lang := range languages {
+		names[i] = lang.name
+	}
+	return names
+}
+
+// lookupLanguage finds a language by its name or one of its extensions, as
+// given in ?lang
+func lookupLanguage(name string) (*language, bool) {
+	name = strings.ToLower(name)
+	if lang, ok := languageNames[name]; ok {
+		return lang, true
+	}
+	lang, ok := languageExts[name]
+	return lang, ok
+}
+
+// languageForFile returns the language of a file name's extension, or of the
+// whole name for the likes of Makefile, or "" if it has no known one
+func languageForFile(name string) string {
+	name = strings.ToLower(name)
+	if lang, ok := languageExts[strings.TrimPrefix(path.Ext(name), ".")]; ok {
+		return lang.name
+	}
+	if lang, ok := languageExts[name]; ok {
+		return lang.name
+	}
+	return ""
+}
+
+// pasteLanguage returns the language a paste is highlighted as: the one it
+// was given, or else the one its file name implies
+func pasteLanguage(record *db.RedirectRecord) string {
+	if record.Lang != "" {
+		return record.Lang
+	}
+	return languageForFile(record.Filename)
+}
+
+// textContentType returns the raw Content-Type of text in a language
+func textContentType(lang string) string {
+	if l, ok := languageNames[lang]; ok && l.typ != "" {
+		return l.typ + "; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// languageExt returns the file extension a paste in lang is downloaded with
+func languageExt(lang string) string {
+	if l, ok := languageNames[lang]; ok {
+		return "." + l.exts[0]
+	}
+	return ".txt"
+}
+
+// extensionPath splits /:code.py, or /:code@N.py, into the paste and the
+// language its extension names
+func extensionPath(urlPath string) (string, string, bool) {
+	i := strings.LastIndex(urlPath, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	base, ext := urlPath[:i], urlPath[i+1:]
+	if code, _, _ := strings.Cut(base, "@"); !utils.IsValidCode(code) {
+		return "", "", false
+	}
+	lang, ok := languageExts[strings.ToLower(ext)]
+	if !ok {
+		return "", "", false
+	}
+	return base, lang.name, true
+}
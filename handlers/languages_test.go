@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupLanguage(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"go", "go"},
+		{"Python", "python"},
+		{"py", "python"},
+		{"yml", "yaml"},
+		{"cobol", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		lang, ok := lookupLanguage(tt.input)
+		if tt.expected == "" {
+			assert.False(t, ok, tt.input)
+			continue
+		}
+		require.True(t, ok, tt.input)
+		assert.Equal(t, tt.expected, lang.name)
+	}
+}
+
+func TestLanguageForFile(t *testing.T) {
+	assert.Equal(t, "go", languageForFile("main.go"))
+	assert.Equal(t, "python", languageForFile("SCRIPT.PY"))
+	assert.Equal(t, "makefile", languageForFile("Makefile"))
+	assert.Equal(t, "", languageForFile("notes"))
+	assert.Equal(t, "", languageForFile(""))
+}
+
+func TestExtensionPath(t *testing.T) {
+	tests := []struct {
+		path string
+		code string
+		lang string
+		ok   bool
+	}{
+		{"abcd.py", "abcd", "python", true},
+		{"abcd@2.GO", "abcd@2", "go", true},
+		{"abcd.zip", "", "", false},
+		{"abcd", "", "", false},
+		{"ab.py", "", "", false},
+	}
+
+	for _, tt := range tests {
+		code, lang, ok := extensionPath(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.path)
+		assert.Equal(t, tt.code, code, tt.path)
+		assert.Equal(t, tt.lang, lang, tt.path)
+	}
+}
+
+func TestPostHandlerLanguage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 3600, PasteDynamoDBCutoffSize: 1024, PasteMaxSize: 1024}
+
+	tests := []struct {
+		name             string
+		target           string
+		formData         url.Values // Sent as form input when set
+		expectedStatus   int
+		expectedLang     string
+		expectedFilename string
+	}{
+		{"Language by name", "/?lang=go", nil, http.StatusOK, "go", ""},
+		{"Language by extension", "/?lang=py", nil, http.StatusOK, "python", ""},
+		{"File name", "/?filename=src/main.rs", nil, http.StatusOK, "", "main.rs"},
+		{"Form fields", "/?input=form", url.Values{"data": {"content"}, "filename": {"a.sql"}, "lang": {"sql"}}, http.StatusSeeOther, "sql", "a.sql"},
+		{"Unknown language", "/?lang=cobol", nil, http.StatusBadRequest, "", ""},
+		{"Short link", "/?url=https://example.com/&lang=go", nil, http.StatusBadRequest, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+
+			r := gin.New()
+			r.Use(sessions.Sessions("xipe_session", cookie.NewStore([]byte("test-secret-key"))))
+			r.POST("/", h.PostHandler)
+
+			req := httptest.NewRequest("POST", tt.target, strings.NewReader("content"))
+			if tt.formData != nil {
+				req = httptest.NewRequest("POST", tt.target, strings.NewReader(tt.formData.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedStatus == http.StatusBadRequest {
+				mockDB.AssertNotCalled(t, "PutRedirect", mock.Anything)
+				return
+			}
+			require.NotNil(t, stored)
+			assert.Equal(t, tt.expectedLang, stored.Lang)
+			assert.Equal(t, tt.expectedFilename, stored.Filename)
+		})
+	}
+}
+
+func TestDataHandlerLanguage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"lang": {Code: "lang", Typ: "D", Val: "print(1)", Ettl: future, Lang: "python"},
+		"name": {Code: "name", Typ: "D", Val: "a: 1", Ettl: future, Filename: "conf.yml"},
+		"encr": {Code: "encr", Typ: "D", Val: "ciphertext", Ettl: future, Lang: "go", Enc: true},
+		"link": {Code: "link", Typ: "R", Val: "https://example.com/", Ettl: future},
+	}
+
+	tests := []struct {
+		name                string
+		path                string
+		userAgent           string
+		expectedStatus      int
+		expectedType        string
+		expectedBody        string
+		expectedDisposition string
+	}{
+		{"Raw type from the language", "/lang", "curl/8.0", http.StatusOK, "text/x-python; charset=utf-8", "print(1)", ""},
+		{"Raw type from the file name", "/name", "curl/8.0", http.StatusOK, "text/yaml; charset=utf-8", "a: 1", ""},
+		{"Download named after the language", "/lang?download", "curl/8.0", http.StatusOK, "text/x-python; charset=utf-8", "print(1)", "attachment; filename=lang.py"},
+		{"Extension URL", "/lang.go", "curl/8.0", http.StatusOK, "text/x-go; charset=utf-8", "print(1)", ""},
+		{"Highlighted as the language", "/lang", "Mozilla/5.0 (browser)", http.StatusOK, "text/html; charset=utf-8", "<span>python</span>", ""},
+		{"Highlighted as the extension", "/lang.rb", "Mozilla/5.0 (browser)", http.StatusOK, "text/html; charset=utf-8", "<span>ruby</span>", ""},
+		{"Ciphertext stays plain text", "/encr", "curl/8.0", http.StatusOK, "text/plain; charset=utf-8", "ciphertext", ""},
+		{"Extension URL of a short link", "/link.py", "curl/8.0", http.StatusNotFound, "text/plain; charset=utf-8", "Content not found", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.Equal(t, tt.expectedType, w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			assert.Equal(t, tt.expectedDisposition, w.Header().Get("Content-Disposition"))
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/url"
+	"regexp"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdown converts GitHub Flavored Markdown to HTML. Raw HTML in the source
+// is left out, code blocks are highlighted like pastes, and images from
+// other sites become links to them since the page's CSP would block them.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithASTTransformers(util.Prioritized(remoteImages{}, 100))),
+	goldmark.WithRendererOptions(renderer.WithNodeRenderers(util.Prioritized(codeBlockRenderer{}, 100))),
+)
+
+// markdownPolicy is what rendered Markdown may contain. Nothing in it can
+// run script or load from another origin, and the only classes allowed are
+// the ones the highlighter gives code.
+var markdownPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowDataURIImages()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(chroma|line|cl|[a-z]{1,3})$`)).OnElements("pre", "span")
+	// Task list items
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	return p
+}()
+
+// renderMarkdown renders source as sanitized HTML, falling back to the
+// source as plain text if it cannot be converted
+func renderMarkdown(source string) template.HTML {
+	var out bytes.Buffer
+	if err := markdown.Convert([]byte(source), &out); err != nil {
+		log.Printf("Failed to render %d bytes of Markdown: %v", len(source), err)
+		return plainHTML(source)
+	}
+	return template.HTML(markdownPolicy.SanitizeBytes(out.Bytes()))
+}
+
+// markdownPaste renders text of record as Markdown for its page
+func (h *Handlers) markdownPaste(record *db.RedirectRecord, source string) template.HTML {
+	if !cacheableRender(record) {
+		return renderMarkdown(source)
+	}
+	return h.Render.Markdown(source)
+}
+
+// isMarkdownFile reports whether a file name is a Markdown one, such as
+// README.md
+func isMarkdownFile(name string) bool {
+	return languageForFile(name) == "markdown"
+}
+
+// remoteImages turns images that are not on this site into links
+type remoteImages struct{}
+
+func (remoteImages) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var images []*ast.Image
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if image, ok := n.(*ast.Image); ok && entering && !localURL(string(image.Destination)) {
+			images = append(images, image)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, image := range images {
+		link := ast.NewLink()
+		link.Destination, link.Title = image.Destination, image.Title
+		for child := image.FirstChild(); child != nil; {
+			next := child.NextSibling()
+			link.AppendChild(link, child)
+			child = next
+		}
+		image.Parent().ReplaceChild(image.Parent(), image, link)
+	}
+}
+
+// localURL reports whether an image URL loads from this site or is inline
+func localURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Host == "" && (u.Scheme == "" || u.Scheme == "data")
+}
+
+// codeBlockRenderer highlights fenced and indented code blocks
+type codeBlockRenderer struct{}
+
+func (r codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.render)
+	reg.Register(ast.KindCodeBlock, r.render)
+}
+
+func (codeBlockRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	var code bytes.Buffer
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		code.Write(segment.Value(source))
+	}
+	lang := "plaintext"
+	if fenced, ok := node.(*ast.FencedCodeBlock); ok && fenced.Info != nil {
+		if l, ok := lookupLanguage(string(fenced.Language(source))); ok {
+			lang = l.name
+		}
+	}
+	_, err := w.WriteString(string(highlightBlock(code.String(), lang)))
+	return ast.WalkSkipChildren, err
+}
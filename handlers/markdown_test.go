@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		contains    []string
+		notContains []string
+	}{
+		{"Headings and tables", "# Title\n\n| a | b |\n|---|---|\n| 1 | 2 |\n", []string{"<h1>Title</h1>", "<td>1</td>"}, nil},
+		{"Raw HTML is left out", "<script>alert(1)</script>\n\n<img src=x onerror=alert(1)>\n", nil, []string{"<script", "onerror", "alert"}},
+		{"Script links are dropped", "[click](javascript:alert(1))", []string{"click"}, []string{"javascript:"}},
+		{"Remote images become links", "![logo](https://example.com/logo.png)", []string{`<a href="https://example.com/logo.png" rel="nofollow">logo</a>`}, []string{"<img"}},
+		{"Local images stay", "![logo](/android-chrome-192x192.png)", []string{`<img src="/android-chrome-192x192.png" alt="logo">`}, nil},
+		{"Code blocks are highlighted", "```go\nfunc main() {}\n```\n", []string{`<pre class="chroma">`, `<span class="kd">func</span>`}, nil},
+		{"Task lists", "- [x] done\n", []string{`<input checked="" disabled="" type="checkbox">`}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(renderMarkdown(tt.source))
+			for _, s := range tt.contains {
+				assert.Contains(t, out, s)
+			}
+			for _, s := range tt.notContains {
+				assert.NotContains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestDataHandlerMarkdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	require.NoError(t, utils.InitReservedCodes())
+
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"read": {Code: "read", Typ: "D", Val: "# Notes\n\n*hi*\n", Ettl: future, Filename: "README.md"},
+		"text": {Code: "text", Typ: "D", Val: "# Notes\n\n*hi*\n", Ettl: future},
+		"encr": {Code: "encr", Typ: "D", Val: "ciphertext", Ettl: future, Filename: "README.md", Enc: true},
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		userAgent   string
+		contains    []string
+		notContains []string
+	}{
+		{"Rendered by file name", "/read", "Mozilla/5.0 (browser)", []string{`<div class="markdown-body"><h1>Notes</h1>`, "<em>hi</em>", `id="sourceText"`, "View Source"}, []string{`id="L1"`}},
+		{"Source on request", "/read?render=source", "Mozilla/5.0 (browser)", []string{`id="L1"`, "View Rendered"}, []string{`<div class="markdown-body">`}},
+		{"Source without a Markdown name", "/text", "Mozilla/5.0 (browser)", []string{`id="L1"`}, []string{`<div class="markdown-body">`, "View Rendered"}},
+		{"Rendered on request", "/text?render=md", "Mozilla/5.0 (browser)", []string{"<h1>Notes</h1>"}, nil},
+		{"Encrypted pastes are not rendered", "/encr", "Mozilla/5.0 (browser)", []string{"<pre><code>ciphertext"}, []string{`<div class="markdown-body">`, "View Rendered"}},
+		{"Raw clients get the source", "/read?render=md", "curl/8.0", []string{"# Notes"}, []string{"<h1>"}},
+		{"Markdown static page", "/privacy", "Mozilla/5.0 (browser)", []string{"<h1>Privacy Policy</h1>"}, nil},
+		{"Static page source", "/privacy", "curl/8.0", []string{"# Privacy Policy"}, []string{"<h1>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			for _, s := range tt.contains {
+				assert.Contains(t, w.Body.String(), s)
+			}
+			for _, s := range tt.notContains {
+				assert.NotContains(t, w.Body.String(), s)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHeader carries a paste password on create and on read, for clients
+// that would rather not use basic auth
+const passwordHeader = "X-Paste-Password"
+
+// bcrypt only looks at the first 72 bytes, so longer passwords are rejected
+// rather than silently truncated
+const maxPasswordLength = 72
+
+// hashPassword returns a salted bcrypt hash of a paste password
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordLength {
+		return "", errors.New("password must be at most 72 bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// suppliedPassword looks for a read password in the X-Paste-Password header,
+// basic auth (any username) or a "password" form field, in that order
+func suppliedPassword(c *gin.Context) (string, bool) {
+	if password := c.GetHeader(passwordHeader); password != "" {
+		return password, true
+	}
+	if _, password, ok := c.Request.BasicAuth(); ok && password != "" {
+		return password, true
+	}
+	if c.Request.Method == http.MethodPost {
+		if password := c.PostForm("password"); password != "" {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+// GuessLimiter caps wrong password guesses per code in fixed windows of
+// time. Guesses are counted in the database, so the limit holds across every
+// replica and survives restarts. A nil limiter allows every guess.
+type GuessLimiter struct {
+	store  db.DBInterface
+	max    int64
+	window time.Duration
+}
+
+// NewGuessLimiter allows max wrong guesses per code in each window, counted
+// in store. A max or window of 0 turns the limit off.
+func NewGuessLimiter(store db.DBInterface, max int, window time.Duration) *GuessLimiter {
+	if max <= 0 || window < time.Second {
+		return nil
+	}
+	return &GuessLimiter{store: store, max: int64(max), window: window}
+}
+
+// key returns the quota key counting guesses for code in the window holding
+// now, and the time left in that window. Windows are aligned to multiples of
+// their length so every replica agrees on them, and the key can never be a
+// valid code.
+func (l *GuessLimiter) key(code string, now time.Time) (string, time.Duration) {
+	n := now.UnixNano() / int64(l.window)
+	end := time.Unix(0, (n+1)*int64(l.window))
+	return fmt.Sprintf("_guess_%s_%d", code, n), end.Sub(now)
+}
+
+// Take counts a guess for code before it is checked. It returns the key the
+// guess was counted under, for Refund, and when the window's guesses are used
+// up, how long until it ends.
+func (l *GuessLimiter) Take(code string) (key string, wait time.Duration, err error) {
+	if l == nil {
+		return "", 0, nil
+	}
+	key, left := l.key(code, time.Now())
+	ok, err := l.store.TakeQuota(key, l.max, left)
+	if err != nil || ok {
+		return key, 0, err
+	}
+	return key, left, nil
+}
+
+// Refund gives back a guess counted by Take that proved right, so only wrong
+// guesses use up the limit
+func (l *GuessLimiter) Refund(key string) {
+	if l == nil || key == "" {
+		return
+	}
+	if err := l.store.RefundQuota(key); err != nil {
+		log.Printf("Failed to give back password guess %s: %v", key, err)
+	}
+}
+
+// checkPastePassword gates a password-protected paste. It returns true when
+// the right password was supplied; otherwise it has already written a 401
+// (password prompt for browsers) or 429 response.
+func (h *Handlers) checkPastePassword(c *gin.Context, record *db.RedirectRecord, wantHTML bool) bool {
+	// Never let a shared cache keep either the prompt or the content
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("Pragma", "")
+
+	password, supplied := suppliedPassword(c)
+	if supplied {
+		// Counted before it is checked, so concurrent guesses can't all slip
+		// in under the limit
+		key, wait, err := h.Guesses.Take(record.Code)
+		if err != nil {
+			log.Printf("Failed to count password guess for code %s: %v", record.Code, err)
+			respondError(c, http.StatusInternalServerError, "Failed to check password")
+			return false
+		}
+		if wait > 0 {
+			log.Printf("Too many password guesses for code %s", record.Code)
+			c.Header("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+			respondError(c, http.StatusTooManyRequests, "Too many wrong passwords, try again later")
+			return false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(record.PassHash), []byte(password)) == nil {
+			h.Guesses.Refund(key)
+			return true
+		}
+	}
+
+	if wantHTML {
+		c.HTML(http.StatusUnauthorized, "password.html", gin.H{
+			"code":  record.Code,
+			"wrong": supplied,
+		})
+		return false
+	}
+
+	c.Header("WWW-Authenticate", `Basic realm="xi.pe paste", charset="UTF-8"`)
+	message := "password required"
+	if supplied {
+		message = "wrong password"
+	}
+	if isAPIRequest(c) {
+		utils.RespondWithJSONError(c, http.StatusUnauthorized, message)
+	} else {
+		c.String(http.StatusUnauthorized, "Error 401: %s", message)
+	}
+	return false
+}
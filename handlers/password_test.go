@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// guessStore returns a database for counting password guesses, shared the
+// way every replica shares the real one
+func guessStore(t *testing.T) db.DBInterface {
+	store, err := db.NewSQLiteDBClient(&config.Config{SQLitePath: filepath.Join(t.TempDir(), "guesses.db")}, nil)
+	require.NoError(t, err)
+	return store
+}
+
+func TestGuessLimiter(t *testing.T) {
+	store := guessStore(t)
+	limiter := NewGuessLimiter(store, 2, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		_, wait, err := limiter.Take("abcd")
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+	key, wait, err := limiter.Take("abcd")
+	require.NoError(t, err)
+	assert.Positive(t, wait)
+	assert.LessOrEqual(t, wait, time.Hour)
+
+	// Another replica counts against the same window
+	_, wait, err = NewGuessLimiter(store, 2, time.Hour).Take("abcd")
+	require.NoError(t, err)
+	assert.Positive(t, wait)
+
+	// Limits are per code
+	_, wait, err = limiter.Take("efgh")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// A guess given back can be made again
+	limiter.Refund(key)
+	_, wait, err = limiter.Take("abcd")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// A nil limiter never blocks
+	none := NewGuessLimiter(store, 0, time.Hour)
+	assert.Nil(t, none)
+	_, wait, err = none.Take("abcd")
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+	none.Refund("abcd")
+}
+
+func TestGuessLimiterWindows(t *testing.T) {
+	limiter := &GuessLimiter{window: 5 * time.Minute}
+
+	// Windows are aligned, so every replica agrees where one ends
+	key, left := limiter.key("abcd", time.Unix(1000, 0))
+	assert.Equal(t, "_guess_abcd_3", key)
+	assert.Equal(t, 200*time.Second, left)
+	later, left := limiter.key("abcd", time.Unix(1199, 0))
+	assert.Equal(t, key, later)
+	assert.Equal(t, time.Second, left)
+	next, _ := limiter.key("abcd", time.Unix(1200, 0))
+	assert.Equal(t, "_guess_abcd_4", next)
+}
+
+func TestDataHandlerPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	record := &db.RedirectRecord{
+		Code:     "pw12",
+		Typ:      "D",
+		Val:      "protected content",
+		Ettl:     time.Now().Add(time.Hour).Unix(),
+		Created:  time.Now().Unix(),
+		Owner:    "owner1",
+		PassHash: string(hash),
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		userAgent      string
+		setup          func(*http.Request)
+		expectedStatus int
+		expectContent  bool
+	}{
+		{"No password, raw client", "GET", "curl/8.0", func(r *http.Request) {}, http.StatusUnauthorized, false},
+		{"No password, browser gets prompt", "GET", "Mozilla/5.0 (browser)", func(r *http.Request) {}, http.StatusUnauthorized, false},
+		{"Header password", "GET", "curl/8.0", func(r *http.Request) { r.Header.Set("X-Paste-Password", "hunter2") }, http.StatusOK, true},
+		{"Basic auth password", "GET", "curl/8.0", func(r *http.Request) { r.SetBasicAuth("", "hunter2") }, http.StatusOK, true},
+		{"Wrong password", "GET", "curl/8.0", func(r *http.Request) { r.SetBasicAuth("", "nope") }, http.StatusUnauthorized, false},
+		{"Form password", "POST", "Mozilla/5.0 (browser)", func(r *http.Request) {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}, http.StatusOK, true},
+		{"Owner needs no password", "GET", "curl/8.0", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: "id", Value: "owner1"})
+		}, http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := new(db.MockDB)
+			mockDB.On("GetRedirect", "pw12").Return(record, nil)
+			h := &Handlers{DB: mockDB}
+
+			var body *strings.Reader
+			if tt.method == "POST" {
+				body = strings.NewReader(url.Values{"password": {"hunter2"}}.Encode())
+			} else {
+				body = strings.NewReader("")
+			}
+
+			w := httptest.NewRecorder()
+			c, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			req := httptest.NewRequest(tt.method, "/pw12", body)
+			req.Header.Set("User-Agent", tt.userAgent)
+			tt.setup(req)
+			c.Request = req
+			c.Params = gin.Params{{Key: "code", Value: "pw12"}}
+
+			h.DataHandler(c)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectContent, strings.Contains(w.Body.String(), "protected content"))
+			assert.Contains(t, w.Header().Get("Cache-Control"), "private")
+			if tt.expectedStatus == http.StatusUnauthorized && tt.userAgent == "curl/8.0" {
+				assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+			}
+		})
+	}
+
+	t.Run("Guesses are rate limited", func(t *testing.T) {
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "pw12").Return(record, nil)
+		h := &Handlers{DB: mockDB, Guesses: NewGuessLimiter(guessStore(t), 2, time.Hour)}
+
+		var retryAfter string
+		guess := func(password string) int {
+			w := httptest.NewRecorder()
+			defer func() { retryAfter = w.Header().Get("Retry-After") }()
+			c, _ := gin.CreateTestContext(w)
+			req := httptest.NewRequest("GET", "/pw12", nil)
+			req.Header.Set("User-Agent", "curl/8.0")
+			req.SetBasicAuth("", password)
+			c.Request = req
+			c.Params = gin.Params{{Key: "code", Value: "pw12"}}
+			h.DataHandler(c)
+			return w.Code
+		}
+
+		// The right password doesn't count against the limit
+		assert.Equal(t, http.StatusOK, guess("hunter2"))
+		assert.Equal(t, http.StatusUnauthorized, guess("one"))
+		assert.Equal(t, http.StatusOK, guess("hunter2"))
+		assert.Equal(t, http.StatusUnauthorized, guess("two"))
+		assert.Equal(t, http.StatusTooManyRequests, guess("three"))
+		// Until the window ends, which Retry-After counts down to
+		seconds, err := strconv.Atoi(retryAfter)
+		require.NoError(t, err)
+		assert.True(t, seconds >= 1 && seconds <= 3600, retryAfter)
+		// Even the right password is refused until the window passes
+		assert.Equal(t, http.StatusTooManyRequests, guess("hunter2"))
+	})
+}
+
+func TestPostHandlerPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 86400, PasteDynamoDBCutoffSize: 10240, PasteMaxSize: 2097152}
+	mockDB := &db.MockDB{}
+	h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+	var stored *db.RedirectRecord
+	mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+		stored = args.Get(0).(*db.RedirectRecord)
+	}).Return(nil)
+
+	r := gin.New()
+	store := cookie.NewStore([]byte("test-secret-key"))
+	r.Use(sessions.Sessions("xipe_session", store))
+	r.POST("/", h.PostHandler)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("secret stuff"))
+	req.Header.Set("X-Paste-Password", "hunter2")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, stored)
+	assert.NotContains(t, stored.PassHash, "hunter2")
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(stored.PassHash), []byte("hunter2")))
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("secret stuff"))
+	req.Header.Set("X-Paste-Password", strings.Repeat("x", 73))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiPrefix is where the versioned JSON API is mounted. Every error under it
+// is returned as JSON.
+const apiPrefix = "/api/v1/"
+
+// PasteInfo describes a paste or short link in JSON API responses
+type PasteInfo struct {
+	Code        string     `json:"code"`
+	URL         string     `json:"url"`
+	RawURL      string     `json:"raw_url"`
+	Type        string     `json:"type"`             // "paste" or "link"
+	Storage     string     `json:"storage"`          // "inline" (in the metadata record) or "blob"
+	Size        int64      `json:"size,omitempty"`   // Content size in bytes, omitted if unknown
+	SHA256      string     `json:"sha256,omitempty"` // Hex SHA-256 of the content, omitted for links and multi-file pastes or if unknown
+	Created     string     `json:"created"`
+	Expires     string     `json:"expires,omitempty"`
+	Burn        bool       `json:"burn"`
+	MaxViews    int64      `json:"max_views,omitempty"`
+	ViewsLeft   int64      `json:"views_left,omitempty"`
+	Password    bool       `json:"password"`
+	Encrypted   bool       `json:"encrypted"`
+	Direct      int        `json:"direct,omitempty"`       // Redirect status of a direct short link
+	Revision    int64      `json:"revision"`               // Current revision, 1 until the paste is edited
+	Parent      string     `json:"parent,omitempty"`       // Paste this one was forked from
+	Filename    string     `json:"filename,omitempty"`     // Name of an uploaded file, or the one given with ?filename
+	Language    string     `json:"language,omitempty"`     // Syntax highlighting language, given or implied by the file name
+	MimeType    string     `json:"mime_type,omitempty"`    // Detected type of a binary file, omitted for text
+	Files       []FileInfo `json:"files,omitempty"`        // Files of a multi-file paste
+	DeleteToken string     `json:"delete_token,omitempty"` // Only returned on creation
+}
+
+// FileInfo describes one file of a multi-file paste in JSON API responses
+type FileInfo struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`    // Hex SHA-256 of the content
+	Language string `json:"language,omitempty"`  // Syntax highlighting language implied by the name
+	MimeType string `json:"mime_type,omitempty"` // Detected type of a binary file, omitted for text
+}
+
+// isAPIRequest reports whether the request was made to the JSON API
+func isAPIRequest(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, apiPrefix)
+}
+
+// respondError writes an error as JSON for the API, or otherwise as HTML or
+// plain text depending on the client
+func respondError(c *gin.Context, statusCode int, description string) {
+	if isAPIRequest(c) {
+		utils.RespondWithJSONError(c, statusCode, description)
+		return
+	}
+	utils.RespondWithError(c, statusCode, "error", description)
+}
+
+// pasteURL returns the public URL of a code on the host the request came in on
+func pasteURL(c *gin.Context, code string) string {
+	scheme := "https"
+	if c.Request.Header.Get("X-Forwarded-Proto") == "" && c.Request.TLS == nil {
+		scheme = "http"
+	}
+	host := c.Request.Host
+	if host == "" {
+		host = "xi.pe"
+	}
+	return scheme + "://" + host + "/" + code
+}
+
+// pasteInfo builds the API description of record, with content hashes only
+// where hashVisible allows them
+func pasteInfo(c *gin.Context, record *db.RedirectRecord, isOwner bool) PasteInfo {
+	url := pasteURL(c, record.Code)
+	info := PasteInfo{
+		Code:      record.Code,
+		URL:       url,
+		RawURL:    url + "?raw",
+		Type:      "paste",
+		Storage:   "inline",
+		Size:      record.Size,
+		Created:   time.Unix(record.Created, 0).UTC().Format(time.RFC3339),
+		Burn:      record.Burn,
+		MaxViews:  record.MaxViews,
+		Password:  record.PassHash != "",
+		Encrypted: record.Enc,
+		Direct:    record.Redir,
+		Revision:  record.Revision(),
+		Parent:    record.Parent,
+		Filename:  record.Filename,
+		Language:  pasteLanguage(record),
+		MimeType:  record.Mime,
+	}
+	showHash := hashVisible(record, isOwner)
+	if showHash && (record.Typ == "D" || record.Typ == "S") {
+		info.SHA256 = pasteContent(record, 0).hash
+	}
+	if record.MaxViews > 0 {
+		info.ViewsLeft = record.MaxViews - record.Views
+	}
+	if record.Ettl > 0 {
+		info.Expires = time.Unix(record.Ettl, 0).UTC().Format(time.RFC3339)
+	}
+	switch record.Typ {
+	case "R":
+		info.Type = "link"
+	case "S":
+		info.Storage = "blob"
+	case "B":
+		info.Storage = "blob"
+		for _, file := range record.Files {
+			fileInfo := FileInfo{
+				Name:     file.Name,
+				URL:      bundleFileURL(url, file.Name),
+				Size:     file.Size,
+				Language: languageForFile(file.Name),
+				MimeType: file.Mime,
+			}
+			if showHash {
+				fileInfo.SHA256 = file.Hash
+			}
+			info.Files = append(info.Files, fileInfo)
+		}
+	}
+	// Records from before sizes were stored
+	if info.Size == 0 && record.Typ != "S" && record.Typ != "B" {
+		info.Size = int64(len(record.Val))
+	}
+	return info
+}
+
+// lookupPaste validates the :code parameter and loads its record, writing a
+// JSON error and returning nil if that fails
+func (h *Handlers) lookupPaste(c *gin.Context) *db.RedirectRecord {
+	code := c.Param("code")
+	if !utils.IsValidCode(code) {
+		utils.RespondWithJSONError(c, http.StatusBadRequest, "Invalid code format")
+		return nil
+	}
+	record, err := h.DB.GetRedirect(code)
+	if err != nil {
+		log.Printf("API: Failed to look up code %s: %v", code, err)
+		utils.RespondWithJSONError(c, http.StatusInternalServerError, "Failed to retrieve paste")
+		return nil
+	}
+	if record == nil {
+		utils.RespondWithJSONError(c, http.StatusNotFound, "Paste not found or has expired")
+		return nil
+	}
+	return record
+}
+
+// APICreatePaste handles POST /api/v1/pastes. The body is the paste content
+// and the options are the same query parameters as POST /.
+func (h *Handlers) APICreatePaste(c *gin.Context) {
+	ownerID, err := getOrCreateOwnerID(c)
+	if err != nil {
+		log.Printf("Failed to generate owner ID: %v", err)
+		utils.RespondWithJSONError(c, http.StatusInternalServerError, "Failed to generate owner ID")
+		return
+	}
+
+	record, deleteToken, perr := h.createPaste(c, ownerID, false, nil)
+	if perr != nil {
+		utils.RespondWithJSONError(c, perr.status, perr.message)
+		return
+	}
+
+	info := pasteInfo(c, record, true)
+	info.DeleteToken = deleteToken
+	c.Header(deleteTokenHeader, deleteToken)
+	c.Header("Location", apiPrefix+"pastes/"+record.Code)
+	c.JSON(http.StatusCreated, gin.H{
+		"status": "ok",
+		"paste":  info,
+	})
+}
+
+// APIGetPaste handles GET /api/v1/pastes/:code, returning metadata only.
+// It never counts as a view.
+func (h *Handlers) APIGetPaste(c *gin.Context) {
+	record := h.lookupPaste(c)
+	if record == nil {
+		return
+	}
+	ownerCookie, err := c.Cookie("id")
+	isOwner := err == nil && ownerCookie == record.Owner
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"paste":  pasteInfo(c, record, isOwner),
+	})
+}
+
+// APIGetPasteContent handles GET /api/v1/pastes/:code/content. It returns
+// the raw content, or the target of a short link, applying passwords and view
+// limits exactly like GET /:code does for raw clients. ?rev=N returns an
+// earlier revision, and a multi-file paste gives the URL of each file.
+func (h *Handlers) APIGetPasteContent(c *gin.Context) {
+	record := h.lookupPaste(c)
+	if record == nil {
+		return
+	}
+	_, rev, ok := splitRevision(c, record.Code)
+	if !ok {
+		utils.RespondWithJSONError(c, http.StatusBadRequest, "Invalid revision")
+		return
+	}
+	record, err := h.withRevision(record, rev)
+	if err != nil {
+		log.Printf("API: Failed to look up code %s: %v", c.Param("code"), err)
+		utils.RespondWithJSONError(c, http.StatusInternalServerError, "Failed to retrieve paste")
+		return
+	}
+	if record == nil {
+		utils.RespondWithJSONError(c, http.StatusNotFound, "Paste not found or has expired")
+		return
+	}
+	if rev != 0 && !record.HasRevision(rev) {
+		utils.RespondWithJSONError(c, http.StatusNotFound, "Revision not found")
+		return
+	}
+
+	isOwner := false
+	if ownerCookie, err := c.Cookie("id"); err == nil && ownerCookie == record.Owner {
+		isOwner = true
+	}
+	if record.PassHash != "" && !isOwner && !h.checkPastePassword(c, record, false) {
+		return
+	}
+
+	burned := false
+	if (record.Burn || record.MaxViews > 0) && !isOwner {
+		var err error
+		record, burned, err = h.countView(record)
+		if err != nil {
+			utils.RespondWithJSONError(c, http.StatusInternalServerError, "Failed to retrieve paste")
+			return
+		}
+		if record == nil {
+			utils.RespondWithJSONError(c, http.StatusNotFound, "Paste not found or has expired")
+			return
+		}
+	}
+
+	setCacheHeaders(c, record, rev)
+	if record.Enc {
+		c.Header("X-Paste-Encryption", "aes-256-gcm")
+	}
+
+	if rev == 0 {
+		rev = record.Revision()
+	}
+	c.Header(revisionHeader, strconv.FormatInt(rev, 10))
+
+	if burned {
+		defer h.deleteBurnedBlob(record)
+	}
+	if record.Typ == "B" {
+		h.serveBundle(c, record, "", false, isOwner, burned)
+		return
+	}
+	if record.Binary() {
+		h.serveFile(c, record, "", false, isOwner)
+		return
+	}
+	contentType := "text/plain; charset=utf-8"
+	if !record.Enc {
+		contentType = textContentType(pasteLanguage(record))
+	}
+	s3Key := revisionBlobKey(record, rev)
+	if s3Key == "" {
+		c.Data(http.StatusOK, contentType, []byte(record.Val))
+		return
+	}
+	stream, ok := h.openBlob(c, s3Key)
+	if !ok {
+		return
+	}
+	defer func() {
+		if err := stream.Close(); err != nil {
+			log.Printf("Failed to close S3 stream for %s: %v", record.Code, err)
+		}
+	}()
+	c.DataFromReader(http.StatusOK, -1, contentType, stream, nil)
+}
+
+// APIDeletePaste handles DELETE /api/v1/pastes/:code. The caller proves
+// ownership with the paste's delete token or with the owner cookie.
+func (h *Handlers) APIDeletePaste(c *gin.Context) {
+	token := suppliedDeleteToken(c)
+	ownerCookie, _ := c.Cookie("id")
+	if token == "" && ownerCookie == "" {
+		utils.RespondWithJSONError(c, http.StatusUnauthorized, "A delete token is required")
+		return
+	}
+
+	record := h.lookupPaste(c)
+	if record == nil {
+		return
+	}
+
+	var ownerID string
+	switch {
+	case validDeleteToken(record, token):
+		ownerID = record.Owner
+	case token == "" && ownerCookie == record.Owner:
+		ownerID = ownerCookie
+	default:
+		utils.RespondWithJSONError(c, http.StatusForbidden, "You are not authorized to delete this paste")
+		return
+	}
+
+	if err := h.DB.DeleteRedirect(record.Code, ownerID); err != nil {
+		if isDuplicateKeyError(err) {
+			// Deleted by someone else since the lookup
+			utils.RespondWithJSONError(c, http.StatusNotFound, "Paste not found or has expired")
+			return
+		}
+		log.Printf("API: Failed to delete code %s: %v", record.Code, err)
+		utils.RespondWithJSONError(c, http.StatusInternalServerError, "Failed to delete paste")
+		return
+	}
+
+	log.Printf("API: Deleted code %s", record.Code)
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"code":    record.Code,
+		"deleted": true,
+	})
+}
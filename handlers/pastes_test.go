@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// apiRouter mounts the JSON API the way main.go does
+func apiRouter(h *Handlers) *gin.Engine {
+	r := gin.New()
+	v1 := r.Group("/api/v1")
+	v1.POST("/pastes", h.APICreatePaste)
+	v1.GET("/pastes/:code", h.APIGetPaste)
+	v1.GET("/pastes/:code/content", h.APIGetPasteContent)
+	v1.DELETE("/pastes/:code", h.APIDeletePaste)
+	return r
+}
+
+type apiResponse struct {
+	Status     string    `json:"status"`
+	StatusCode int       `json:"status_code"`
+	Message    string    `json:"message"`
+	Paste      PasteInfo `json:"paste"`
+}
+
+func decodeAPIResponse(t *testing.T, w *httptest.ResponseRecorder) apiResponse {
+	var resp apiResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return resp
+}
+
+func TestAPICreatePaste(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 86400, PasteMinTTL: 60, PasteMaxTTL: 86400 * 30, PasteDynamoDBCutoffSize: 16, PasteMaxSize: 1024}
+
+	t.Run("Inline paste", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+		var stored *db.RedirectRecord
+		mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+			stored = args.Get(0).(*db.RedirectRecord)
+		}).Return(nil)
+
+		w := httptest.NewRecorder()
+		apiRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/pastes?ttl=1h&burn", strings.NewReader("hello")))
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		resp := decodeAPIResponse(t, w)
+		require.NotNil(t, stored)
+		assert.Equal(t, "ok", resp.Status)
+		assert.Equal(t, stored.Code, resp.Paste.Code)
+		assert.Equal(t, "http://example.com/"+stored.Code, resp.Paste.URL)
+		assert.Equal(t, "http://example.com/"+stored.Code+"?raw", resp.Paste.RawURL)
+		assert.Equal(t, "paste", resp.Paste.Type)
+		assert.Equal(t, "inline", resp.Paste.Storage)
+		assert.Equal(t, int64(5), resp.Paste.Size)
+		assert.Equal(t, contentHash("hello"), resp.Paste.SHA256)
+		assert.Equal(t, resp.Paste.SHA256, stored.Hash)
+		assert.True(t, resp.Paste.Burn)
+		assert.NotEmpty(t, resp.Paste.Created)
+		assert.NotEmpty(t, resp.Paste.Expires)
+		assert.Equal(t, "/api/v1/pastes/"+stored.Code, w.Header().Get("Location"))
+
+		// Only a hash of the delete token is stored
+		require.NotEmpty(t, resp.Paste.DeleteToken)
+		assert.NotEqual(t, resp.Paste.DeleteToken, stored.DelHash)
+		assert.True(t, validDeleteToken(stored, resp.Paste.DeleteToken))
+		assert.False(t, validDeleteToken(stored, "wrong"))
+	})
+
+	t.Run("Blob paste records its size and hash", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Return(nil)
+		mockS3.On("PutObjectStream", mock.AnythingOfType("string"), mock.Anything).Return(nil)
+		mockDB.On("SetSize", mock.AnythingOfType("string"), int64(100), contentHash(strings.Repeat("x", 100))).Return(nil)
+
+		w := httptest.NewRecorder()
+		apiRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/pastes", strings.NewReader(strings.Repeat("x", 100))))
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		resp := decodeAPIResponse(t, w)
+		assert.Equal(t, "blob", resp.Paste.Storage)
+		assert.Equal(t, int64(100), resp.Paste.Size)
+		assert.Equal(t, contentHash(strings.Repeat("x", 100)), resp.Paste.SHA256)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("Errors are JSON", func(t *testing.T) {
+		h := &Handlers{DB: &db.MockDB{}, S3: &db.MockS3{}, Cfg: cfg}
+
+		w := httptest.NewRecorder()
+		apiRouter(h).ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/pastes?views=0", strings.NewReader("hello")))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		resp := decodeAPIResponse(t, w)
+		assert.Equal(t, "error", resp.Status)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, resp.Message, "views")
+	})
+}
+
+func TestAPIGetPaste(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	mockDB := &db.MockDB{}
+	mockS3 := &db.MockS3{}
+	h := &Handlers{DB: mockDB, S3: mockS3}
+
+	mockDB.On("GetRedirect", "abcd").Return(&db.RedirectRecord{Code: "abcd", Typ: "D", Val: "inline content", Ettl: future, Created: time.Now().Unix()}, nil)
+	mockDB.On("GetRedirect", "big1").Return(&db.RedirectRecord{Code: "big1", Typ: "S", Ettl: future, Size: 21}, nil)
+	mockDB.On("GetRedirect", "lnk1").Return(&db.RedirectRecord{Code: "lnk1", Typ: "R", Val: "https://example.com/", Ettl: future, Redir: http.StatusFound}, nil)
+	mockDB.On("GetRedirect", "lim1").Return(&db.RedirectRecord{Code: "lim1", Typ: "D", Val: "limited", Ettl: future, MaxViews: 3, Views: 1}, nil)
+	mockDB.On("GetRedirect", "pwd1").Return(&db.RedirectRecord{Code: "pwd1", Typ: "D", Val: "guessable", Ettl: future, PassHash: "$2a$10$hash", Owner: "owner1"}, nil)
+	mockDB.On("GetRedirect", "nope").Return(nil, nil)
+	mockDB.On("GetRedirect", "fail").Return(nil, errors.New("db down"))
+	mockS3.On("GetObjectStream", "S/big1.zst").Return([]byte("large content from S3"), nil)
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		check          func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{"Metadata", "/api/v1/pastes/abcd", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			resp := decodeAPIResponse(t, w)
+			assert.Equal(t, "abcd", resp.Paste.Code)
+			assert.Equal(t, int64(len("inline content")), resp.Paste.Size)
+			assert.Equal(t, int64(1), resp.Paste.Revision)
+			assert.Empty(t, resp.Paste.DeleteToken)
+			assert.Equal(t, contentHash("inline content"), resp.Paste.SHA256)
+			assert.NotContains(t, w.Body.String(), "inline content")
+		}},
+		{"Link metadata", "/api/v1/pastes/lnk1", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			resp := decodeAPIResponse(t, w)
+			assert.Equal(t, "link", resp.Paste.Type)
+			assert.Equal(t, http.StatusFound, resp.Paste.Direct)
+		}},
+		{"Metadata does not count a view", "/api/v1/pastes/lim1", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			resp := decodeAPIResponse(t, w)
+			assert.Equal(t, int64(2), resp.Paste.ViewsLeft)
+			assert.Empty(t, resp.Paste.SHA256)
+		}},
+		{"Password-protected paste has no hash", "/api/v1/pastes/pwd1", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			resp := decodeAPIResponse(t, w)
+			assert.True(t, resp.Paste.Password)
+			assert.Empty(t, resp.Paste.SHA256)
+		}},
+		{"Inline content", "/api/v1/pastes/abcd/content", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			assert.Equal(t, "inline content", w.Body.String())
+		}},
+		{"Blob content", "/api/v1/pastes/big1/content", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			assert.Equal(t, "large content from S3", w.Body.String())
+		}},
+		{"Link content is the target", "/api/v1/pastes/lnk1/content", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			assert.Equal(t, "https://example.com/", w.Body.String())
+		}},
+		{"Not found", "/api/v1/pastes/nope", http.StatusNotFound, func(t *testing.T, w *httptest.ResponseRecorder) {
+			assert.Equal(t, "error", decodeAPIResponse(t, w).Status)
+		}},
+		{"Invalid code", "/api/v1/pastes/a!", http.StatusBadRequest, func(t *testing.T, w *httptest.ResponseRecorder) {
+			assert.Equal(t, "error", decodeAPIResponse(t, w).Status)
+		}},
+		{"Database error", "/api/v1/pastes/fail/content", http.StatusInternalServerError, func(t *testing.T, w *httptest.ResponseRecorder) {
+			assert.Equal(t, "error", decodeAPIResponse(t, w).Status)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			apiRouter(h).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			tt.check(t, w)
+		})
+	}
+
+	mockDB.AssertNotCalled(t, "RecordView", "lim1")
+
+	t.Run("The owner gets the hash", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/v1/pastes/pwd1", nil)
+		req.AddCookie(&http.Cookie{Name: "id", Value: "owner1"})
+		apiRouter(h).ServeHTTP(w, req)
+		assert.Equal(t, contentHash("guessable"), decodeAPIResponse(t, w).Paste.SHA256)
+	})
+}
+
+func TestAPIDeletePaste(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	record := &db.RedirectRecord{Code: "abcd", Typ: "D", Val: "content", Owner: "owner1", DelHash: hashDeleteToken("token1")}
+
+	tests := []struct {
+		name           string
+		setup          func(*http.Request)
+		expectDelete   bool
+		expectedStatus int
+	}{
+		{"Delete token header", func(r *http.Request) { r.Header.Set("X-Delete-Token", "token1") }, true, http.StatusOK},
+		{"Bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token1") }, true, http.StatusOK},
+		{"Owner cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: "owner1"}) }, true, http.StatusOK},
+		{"Wrong token", func(r *http.Request) { r.Header.Set("X-Delete-Token", "token2") }, false, http.StatusForbidden},
+		{"Wrong cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: "owner2"}) }, false, http.StatusForbidden},
+		{"No credentials", func(r *http.Request) {}, false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockDB.On("GetRedirect", "abcd").Return(record, nil)
+			mockDB.On("DeleteRedirect", "abcd", "owner1").Return(nil)
+			h := &Handlers{DB: mockDB}
+
+			req := httptest.NewRequest("DELETE", "/api/v1/pastes/abcd", nil)
+			tt.setup(req)
+			w := httptest.NewRecorder()
+			apiRouter(h).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			if tt.expectDelete {
+				mockDB.AssertCalled(t, "DeleteRedirect", "abcd", "owner1")
+				assert.Equal(t, true, body["deleted"])
+			} else {
+				mockDB.AssertNotCalled(t, "DeleteRedirect", mock.Anything, mock.Anything)
+				assert.Equal(t, "error", body["status"])
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxRedirectURLLength caps the length of a shortened URL
+const maxRedirectURLLength = 2048
+
+// blockedSchemes can run code or read local data in the browser, so they are
+// refused even if REDIRECT_SCHEMES lists them
+var blockedSchemes = []string{"javascript", "vbscript", "data", "blob", "file"}
+
+// validateRedirectTarget checks a URL to be shortened against the scheme
+// allow-list and returns it in normalised form
+func validateRedirectTarget(raw string, schemes []string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > maxRedirectURLLength {
+		return "", fmt.Errorf("URL must be at most %d bytes", maxRedirectURLLength)
+	}
+	if strings.IndexFunc(raw, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return "", errors.New("URL must not contain whitespace or control characters")
+	}
+
+	target, err := url.Parse(raw)
+	if err != nil {
+		return "", errors.New("invalid URL")
+	}
+	scheme := strings.ToLower(target.Scheme)
+	if scheme == "" {
+		return "", errors.New("URL must be absolute, e.g. https://example.com/")
+	}
+	if slices.Contains(blockedSchemes, scheme) || !slices.Contains(schemes, scheme) {
+		return "", fmt.Errorf("URL scheme %s is not allowed", scheme)
+	}
+	// Opaque URLs such as mailto: have no host, web URLs always need one
+	if target.Hostname() == "" && (target.Opaque == "" || scheme == "http" || scheme == "https") {
+		return "", errors.New("URL must include a host")
+	}
+	// https://trusted.example@evil.example/ is a classic phishing disguise
+	if target.User != nil {
+		return "", errors.New("URL must not contain a username or password")
+	}
+
+	target.Scheme = scheme
+	return target.String(), nil
+}
+
+// parseRedirectStatus reads the direct parameter of a new short link: absent
+// for the interstitial page, empty or 302 for a temporary redirect and 301 for
+// a permanent one
+func parseRedirectStatus(value string, present bool) (int, error) {
+	switch {
+	case !present:
+		return 0, nil
+	case value == "" || value == "302":
+		return http.StatusFound, nil
+	case value == "301":
+		return http.StatusMovedPermanently, nil
+	}
+	return 0, errors.New("direct must be 301 or 302")
+}
+
+// serveRedirect answers a read of a type "R" record. Links created in direct
+// mode redirect straight away; everything else, and any ?preview request, gets
+// the interstitial page (or the bare target for raw clients) so nobody is sent
+// somewhere they haven't seen first.
+func (h *Handlers) serveRedirect(c *gin.Context, record *db.RedirectRecord, fullURL string, wantHTML, isOwner bool) {
+	preview := c.Request.URL.Query().Has("preview")
+	fromSuccess := c.Query("from") == "success"
+
+	setCacheHeaders(c, record, 0)
+
+	// The creator still gets the info page right after making the link
+	if record.Redir != 0 && !preview && !fromSuccess {
+		c.Redirect(record.Redir, record.Val)
+		return
+	}
+
+	if !wantHTML {
+		c.String(http.StatusOK, record.Val)
+		return
+	}
+
+	host := ""
+	if target, err := url.Parse(record.Val); err == nil {
+		host = target.Hostname()
+	}
+	c.HTML(http.StatusOK, "redirect.html", gin.H{
+		"code":        record.Code,
+		"url":         fullURL,
+		"target":      template.URL(record.Val), // Scheme already checked against the allow-list on creation
+		"targetText":  record.Val,
+		"host":        host,
+		"direct":      record.Redir,
+		"fromSuccess": fromSuccess,
+		"created":     record.Created,
+		"expires":     record.Ettl,
+		"showDelete":  isOwner,
+	})
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRedirectTarget(t *testing.T) {
+	schemes := []string{"http", "https", "mailto", "javascript"}
+
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"https://example.com/path?q=1#frag", "https://example.com/path?q=1#frag", true},
+		{"  HTTP://example.com  ", "http://example.com", true},
+		{"mailto:someone@example.com", "mailto:someone@example.com", true},
+		{"example.com", "", false},
+		{"/relative/path", "", false},
+		{"ftp://example.com/", "", false},
+		{"javascript:alert(1)", "", false}, // Blocked even when configured
+		{"https://", "", false},
+		{"https:example.com", "", false},
+		{"https://trusted.example@evil.example/", "", false},
+		{"https://example.com/a b", "", false},
+		{"https://example.com/\x00", "", false},
+		{"https://example.com/" + strings.Repeat("a", 2048), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := validateRedirectTarget(tt.input, schemes)
+			if tt.ok {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPostHandlerRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteTTL: 86400, PasteDynamoDBCutoffSize: 10240, PasteMaxSize: 2097152, RedirectSchemes: []string{"http", "https"}}
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		form           bool
+		expectedStatus int
+		expectedVal    string
+		expectedRedir  int
+	}{
+		{"URL in query", "/?url=https://example.com/", "", false, http.StatusOK, "https://example.com/", 0},
+		{"URL in body", "/?url", "https://example.com/body\n", false, http.StatusOK, "https://example.com/body", 0},
+		{"Direct defaults to 302", "/?url=https://example.com/&direct", "", false, http.StatusOK, "https://example.com/", http.StatusFound},
+		{"Direct 301", "/?url=https://example.com/&direct=301", "", false, http.StatusOK, "https://example.com/", http.StatusMovedPermanently},
+		{"Form input", "/?input=form", "url=https%3A%2F%2Fexample.com%2Fform&direct=302", true, http.StatusSeeOther, "https://example.com/form", http.StatusFound},
+		{"Bad direct status", "/?url=https://example.com/&direct=307", "", false, http.StatusBadRequest, "", 0},
+		{"Direct without a URL", "/?direct", "some paste", false, http.StatusBadRequest, "", 0},
+		{"Disallowed scheme", "/?url", "javascript:alert(1)", false, http.StatusBadRequest, "", 0},
+		{"Not a URL", "/?url", "just some text", false, http.StatusBadRequest, "", 0},
+		{"Encrypted link", "/?url=https://example.com/&enc", "", false, http.StatusBadRequest, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}, Cfg: cfg}
+
+			var stored *db.RedirectRecord
+			mockDB.On("PutRedirect", mock.AnythingOfType("*db.RedirectRecord")).Run(func(args mock.Arguments) {
+				stored = args.Get(0).(*db.RedirectRecord)
+			}).Return(nil)
+
+			r := gin.New()
+			r.Use(sessions.Sessions("xipe_session", cookie.NewStore([]byte("test-secret-key"))))
+			r.POST("/", h.PostHandler)
+
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			if tt.form {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.expectedStatus >= 400 {
+				assert.Nil(t, stored)
+				return
+			}
+			require.NotNil(t, stored)
+			assert.Equal(t, "R", stored.Typ)
+			assert.Equal(t, tt.expectedVal, stored.Val)
+			assert.Equal(t, tt.expectedRedir, stored.Redir)
+		})
+	}
+}
+
+func TestDataHandlerRedirect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	interstitial := &db.RedirectRecord{Code: "lnk1", Typ: "R", Val: "https://example.com/target", Ettl: future, Owner: "owner1"}
+	direct := &db.RedirectRecord{Code: "lnk2", Typ: "R", Val: "https://example.com/target", Ettl: future, Owner: "owner1", Redir: http.StatusMovedPermanently}
+
+	tests := []struct {
+		name             string
+		record           *db.RedirectRecord
+		query            string
+		userAgent        string
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{"Interstitial page for browsers", interstitial, "", "Mozilla/5.0 (browser)", http.StatusOK, "", "Continue to example.com"},
+		{"Bare target for raw clients", interstitial, "", "curl/8.0", http.StatusOK, "", "https://example.com/target"},
+		{"Direct mode redirects", direct, "", "Mozilla/5.0 (browser)", http.StatusMovedPermanently, "https://example.com/target", ""},
+		{"Direct mode redirects raw clients", direct, "", "curl/8.0", http.StatusMovedPermanently, "https://example.com/target", ""},
+		{"Preview never follows", direct, "?preview", "Mozilla/5.0 (browser)", http.StatusOK, "", "Continue to example.com"},
+		{"Raw preview", direct, "?preview", "curl/8.0", http.StatusOK, "", "https://example.com/target"},
+		{"Creator sees the info page", direct, "?from=success", "Mozilla/5.0 (browser)", http.StatusOK, "", "Short Link Created"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := new(db.MockDB)
+			mockDB.On("GetRedirect", tt.record.Code).Return(tt.record, nil)
+			h := &Handlers{DB: mockDB}
+
+			w := httptest.NewRecorder()
+			c, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			req := httptest.NewRequest("GET", "/"+tt.record.Code+tt.query, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			c.Request = req
+			c.Params = gin.Params{{Key: "code", Value: tt.record.Code}}
+
+			h.DataHandler(c)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedLocation, w.Header().Get("Location"))
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			assert.Contains(t, w.Header().Get("Cache-Control"), "public")
+		})
+	}
+
+	t.Run("Preview does not use up a view", func(t *testing.T) {
+		limited := &db.RedirectRecord{Code: "lnk3", Typ: "R", Val: "https://example.com/", Ettl: future, Redir: http.StatusFound, MaxViews: 1}
+		mockDB := new(db.MockDB)
+		mockDB.On("GetRedirect", "lnk3").Return(limited, nil)
+		h := &Handlers{DB: mockDB}
+
+		w := httptest.NewRecorder()
+		c, router := gin.CreateTestContext(w)
+		router.LoadHTMLGlob("../templates/*")
+		c.Request = httptest.NewRequest("GET", "/lnk3?preview", nil)
+		c.Request.Header.Set("User-Agent", "curl/8.0")
+		c.Params = gin.Params{{Key: "code", Value: "lnk3"}}
+
+		h.DataHandler(c)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "https://example.com/")
+		mockDB.AssertNotCalled(t, "RecordView", "lnk3")
+	})
+}
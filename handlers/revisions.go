@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// revisionHeader tells raw clients which revision they were served
+const revisionHeader = "X-Paste-Revision"
+
+// revisionLink is one entry in the revision history shown on data.html
+type revisionLink struct {
+	Rev     int64
+	Created int64
+	Size    int64
+	Latest  bool
+	Viewing bool
+}
+
+// splitRevision separates a code@N path parameter into the code and the
+// revision number, falling back to ?rev=N. rev is 0 when no revision was
+// asked for, and ok is false if the revision is not a positive number.
+func splitRevision(c *gin.Context, param string) (code string, rev int64, ok bool) {
+	if strings.Contains(param, "@") {
+		return cutRevision(param)
+	}
+	if revParam := c.Query("rev"); revParam != "" {
+		return cutRevision(param + "@" + revParam)
+	}
+	return param, 0, true
+}
+
+// cutRevision separates code@N into the code and revision number, returning
+// rev 0 for a bare code
+func cutRevision(param string) (code string, rev int64, ok bool) {
+	code, revParam, found := strings.Cut(param, "@")
+	if !found {
+		return code, 0, true
+	}
+	rev, err := strconv.ParseInt(revParam, 10, 64)
+	if err != nil || rev < 1 {
+		return code, 0, false
+	}
+	return code, rev, true
+}
+
+// revisionBlobKey returns the blob holding revision rev of record, or "" if
+// that content is inline in the record. rev 0 means the current revision.
+func revisionBlobKey(record *db.RedirectRecord, rev int64) string {
+	if rev != 0 && rev != record.Revision() {
+		// Earlier revisions are always kept in the blob store
+		for _, earlier := range record.Revs {
+			if earlier.Rev == rev {
+				return db.EditBlobKey(record.Code, rev, earlier.BlobTag)
+			}
+		}
+		return db.RevisionBlobKey(record.Code, rev)
+	}
+	if record.Typ == "S" {
+		return db.EditBlobKey(record.Code, record.Revision(), record.BlobTag)
+	}
+	return ""
+}
+
+// newBlobTag returns a random tag for the blob of one edit
+func newBlobTag() (string, error) {
+	tag := make([]byte, 8)
+	if _, err := rand.Read(tag); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tag), nil
+}
+
+// revisionLinks lists every revision of an edited paste, oldest first, for
+// the history on data.html. It returns nil for a paste never edited.
+func revisionLinks(record *db.RedirectRecord, viewing int64) []revisionLink {
+	if len(record.Revs) == 0 {
+		return nil
+	}
+	links := make([]revisionLink, 0, len(record.Revs)+1)
+	for _, rev := range record.Revs {
+		links = append(links, revisionLink{Rev: rev.Rev, Created: rev.Created, Size: rev.Size, Viewing: rev.Rev == viewing})
+	}
+	return append(links, revisionLink{
+		Rev:     record.Revision(),
+		Created: record.Updated,
+		Size:    record.Size,
+		Latest:  true,
+		Viewing: record.Revision() == viewing,
+	})
+}
+
+// editable reports whether record is a paste whose content the owner can
+// replace with UpdateHandler
+func editable(record *db.RedirectRecord) bool {
+	return (record.Typ == "D" || record.Typ == "S") && !record.Binary()
+}
+
+// withRevision makes sure record knows about revision rev before a caller
+// decides it doesn't exist. A copy cached on this replica before an edit made
+// on another one lacks the newer revisions, so it is read again from the store.
+func (h *Handlers) withRevision(record *db.RedirectRecord, rev int64) (*db.RedirectRecord, error) {
+	if record == nil || rev == 0 || record.HasRevision(rev) {
+		return record, nil
+	}
+	return h.DB.GetRedirectFresh(record.Code)
+}
+
+// isRecordOwner reports whether the request proves ownership of record with
+// the owner cookie or the paste's delete token
+func isRecordOwner(c *gin.Context, record *db.RedirectRecord) bool {
+	if ownerCookie, err := c.Cookie("id"); err == nil && ownerCookie != "" && ownerCookie == record.Owner {
+		return true
+	}
+	return validDeleteToken(record, suppliedDeleteToken(c))
+}
+
+// UpdateHandler handles PUT and PATCH /:code: the owner replaces the content
+// of a paste while keeping its code. The previous content stays readable as
+// an earlier revision at /:code@N, and the response is the URL of the new one.
+func (h *Handlers) UpdateHandler(c *gin.Context) {
+	code := c.Param("code")
+	if !utils.IsValidCode(code) {
+		respondError(c, http.StatusBadRequest, "Invalid code format")
+		return
+	}
+
+	record, err := h.DB.GetRedirect(code)
+	if err != nil {
+		log.Printf("Update: Failed to look up code %s: %v", code, err)
+		respondError(c, http.StatusInternalServerError, "Failed to retrieve paste")
+		return
+	}
+	if record == nil {
+		respondError(c, http.StatusNotFound, "Short URL not found or has expired")
+		return
+	}
+	if !isRecordOwner(c, record) {
+		log.Printf("Update request without valid owner ID cookie or delete token for code: %s", code)
+		respondError(c, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if record.Typ == "B" {
+		respondError(c, http.StatusBadRequest, "Multi-file pastes cannot be edited")
+		return
+	}
+	if record.Typ != "D" && record.Typ != "S" {
+		respondError(c, http.StatusBadRequest, "Only pastes can be edited")
+		return
+	}
+	if record.Binary() {
+		respondError(c, http.StatusBadRequest, "Binary files cannot be edited")
+		return
+	}
+	if h.Cfg.PasteMaxRevisions > 0 && record.Revision() >= h.Cfg.PasteMaxRevisions {
+		respondError(c, http.StatusConflict, "Paste already has the maximum number of revisions")
+		return
+	}
+
+	// Same size and UTF-8 rules as a new paste
+	content := utils.NewUTF8LimitReader(c.Request.Body, int64(h.Cfg.PasteMaxSize))
+	head, err := io.ReadAll(io.LimitReader(content, int64(h.Cfg.PasteDynamoDBCutoffSize)+1))
+	if errors.Is(err, utils.ErrInvalidUTF8) {
+		respondError(c, http.StatusBadRequest, "Input text must be UTF-8")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	if len(head) == 0 {
+		respondError(c, http.StatusBadRequest, "Cannot store empty content")
+		return
+	}
+	// Truncating ciphertext would make it undecryptable, so refuse instead
+	if record.Enc && content.Truncated {
+		respondError(c, http.StatusRequestEntityTooLarge, "Encrypted content exceeds the maximum size")
+		return
+	}
+
+	// The current content becomes an earlier revision, which always lives in
+	// the blob store so the metadata record stays small
+	prev := db.Revision{Rev: record.Revision(), Created: record.Updated, Size: record.Size, Hash: record.Hash, BlobTag: record.BlobTag}
+	if prev.Created == 0 {
+		prev.Created = record.Created
+	}
+	if record.Typ == "D" {
+		if prev.Size == 0 {
+			prev.Size = int64(len(record.Val))
+		}
+		if prev.Hash == "" {
+			prev.Hash = contentHash(record.Val)
+		}
+		// Every edit based on this revision archives the same content here
+		if err := h.S3.PutObject(db.RevisionBlobKey(code, prev.Rev), []byte(record.Val)); err != nil {
+			log.Printf("Update: Failed to archive revision %d of code %s: %v", prev.Rev, code, err)
+			respondError(c, http.StatusInternalServerError, "Failed to store data")
+			return
+		}
+	}
+
+	revised := *record
+	revised.Rev = prev.Rev + 1
+	revised.Updated = time.Now().Unix()
+	revised.Revs = append(slices.Clone(record.Revs), prev)
+
+	if len(head) <= h.Cfg.PasteDynamoDBCutoffSize {
+		revised.Typ = "D"
+		revised.Val = string(head)
+		revised.Size = int64(len(head))
+		revised.Hash = contentHash(revised.Val)
+		revised.BlobTag = ""
+	} else {
+		// Uploaded before the metadata points at it, so readers never see a
+		// revision without content. The key is this attempt's own: an edit
+		// racing for the same revision can't overwrite it, and whichever
+		// loses the update below removes its blob.
+		revised.Typ = "S"
+		revised.Val = ""
+		if revised.BlobTag, err = newBlobTag(); err != nil {
+			log.Printf("Update: Failed to generate blob tag: %v", err)
+			respondError(c, http.StatusInternalServerError, "Failed to store data")
+			return
+		}
+		s3Key := db.EditBlobKey(code, revised.Rev, revised.BlobTag)
+		digest := sha256.New()
+		size, err := h.S3.PutObjectStream(s3Key, io.TeeReader(io.MultiReader(bytes.NewReader(head), content), digest))
+		if err != nil {
+			log.Printf("Update: Failed to store %s: %v", s3Key, err)
+			if errors.Is(err, utils.ErrInvalidUTF8) {
+				respondError(c, http.StatusBadRequest, "Input text must be UTF-8")
+			} else {
+				respondError(c, http.StatusInternalServerError, "Failed to store data")
+			}
+			return
+		}
+		if record.Enc && content.Truncated {
+			// Only known once the stream ends
+			if err := h.S3.DeleteObject(s3Key); err != nil {
+				log.Printf("Update: Failed to remove truncated encrypted blob %s: %v", s3Key, err)
+			}
+			respondError(c, http.StatusRequestEntityTooLarge, "Encrypted content exceeds the maximum size")
+			return
+		}
+		revised.Size = size
+		revised.Hash = hex.EncodeToString(digest.Sum(nil))
+	}
+	if content.Truncated {
+		log.Printf("Truncated input to %d bytes", revised.Size)
+	}
+
+	if err := h.DB.ReviseRedirect(&revised, record.Owner); err != nil {
+		if revised.Typ == "S" {
+			s3Key := db.EditBlobKey(code, revised.Rev, revised.BlobTag)
+			if err := h.S3.DeleteObject(s3Key); err != nil {
+				log.Printf("Update: Failed to remove unused blob %s, leaving it for GC: %v", s3Key, err)
+			}
+		}
+		if isDuplicateKeyError(err) {
+			// Deleted, expired or edited by someone else since the lookup
+			respondError(c, http.StatusConflict, "Paste changed while it was being updated, try again")
+			return
+		}
+		log.Printf("Update: Failed to store revision %d of code %s: %v", revised.Rev, code, err)
+		respondError(c, http.StatusInternalServerError, "Failed to store data")
+		return
+	}
+
+	log.Printf("Update: Stored revision %d of code %s (%d bytes)", revised.Rev, code, revised.Size)
+	rev := strconv.FormatInt(revised.Rev, 10)
+	c.Header(revisionHeader, rev)
+	c.String(http.StatusOK, pasteURL(c, code)+"@"+rev+"\n")
+}
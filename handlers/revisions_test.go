@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/config"
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitRevision(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		param string
+		query string
+		code  string
+		rev   int64
+		ok    bool
+	}{
+		{"abcd", "", "abcd", 0, true},
+		{"abcd@3", "", "abcd", 3, true},
+		{"abcd", "rev=2", "abcd", 2, true},
+		{"abcd@3", "rev=2", "abcd", 3, true}, // The path wins
+		{"abcd@", "", "abcd", 0, false},
+		{"abcd@0", "", "abcd", 0, false},
+		{"abcd@x", "", "abcd", 0, false},
+		{"abcd", "rev=-1", "abcd", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.param+"?"+tt.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/"+tt.param+"?"+tt.query, nil)
+			code, rev, ok := splitRevision(c, tt.param)
+			assert.Equal(t, tt.code, code)
+			assert.Equal(t, tt.rev, rev)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+func TestUpdateHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{PasteDynamoDBCutoffSize: 16, PasteMaxSize: 1024, PasteMaxRevisions: 3}
+	future := time.Now().Add(time.Hour).Unix()
+	original := func() *db.RedirectRecord {
+		return &db.RedirectRecord{Code: "abcd", Typ: "D", Val: "first", Ettl: future, Created: 1234, Owner: "owner1", DelHash: hashDeleteToken("token1")}
+	}
+
+	newRouter := func(h *Handlers) *gin.Engine {
+		r := gin.New()
+		r.PUT("/:code", h.UpdateHandler)
+		r.PATCH("/:code", h.UpdateHandler)
+		return r
+	}
+
+	t.Run("Owner replaces inline content", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		var revised *db.RedirectRecord
+		mockDB.On("GetRedirect", "abcd").Return(original(), nil)
+		mockS3.On("PutObject", "S/abcd.zst", []byte("first")).Return(nil)
+		mockDB.On("ReviseRedirect", mock.AnythingOfType("*db.RedirectRecord"), "owner1").Run(func(args mock.Arguments) {
+			revised = args.Get(0).(*db.RedirectRecord)
+		}).Return(nil)
+
+		req := httptest.NewRequest("PUT", "/abcd", strings.NewReader("second"))
+		req.AddCookie(&http.Cookie{Name: "id", Value: "owner1"})
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "http://example.com/abcd@2\n", w.Body.String())
+		assert.Equal(t, "2", w.Header().Get("X-Paste-Revision"))
+		require.NotNil(t, revised)
+		assert.Equal(t, "D", revised.Typ)
+		assert.Equal(t, "second", revised.Val)
+		assert.Equal(t, int64(6), revised.Size)
+		assert.Equal(t, contentHash("second"), revised.Hash)
+		assert.Equal(t, int64(2), revised.Rev)
+		assert.NotZero(t, revised.Updated)
+		assert.Equal(t, db.Revisions{{Rev: 1, Created: 1234, Size: 5, Hash: contentHash("first")}}, revised.Revs)
+		// Everything but the content is untouched
+		assert.Equal(t, future, revised.Ettl)
+		assert.Equal(t, hashDeleteToken("token1"), revised.DelHash)
+		mockS3.AssertExpectations(t)
+	})
+
+	t.Run("Large content goes to a per-revision blob", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		edited := original()
+		edited.Rev = 2
+		edited.Revs = db.Revisions{{Rev: 1, Created: 1234, Size: 5}}
+		big := strings.Repeat("x", 100)
+
+		var revised *db.RedirectRecord
+		var uploadedKey string
+		mockDB.On("GetRedirect", "abcd").Return(edited, nil)
+		mockS3.On("PutObject", "S/abcd@2.zst", []byte("first")).Return(nil)
+		mockS3.On("PutObjectStream", mock.AnythingOfType("string"), []byte(big)).Run(func(args mock.Arguments) {
+			uploadedKey = args.String(0)
+		}).Return(nil)
+		mockDB.On("ReviseRedirect", mock.AnythingOfType("*db.RedirectRecord"), "owner1").Run(func(args mock.Arguments) {
+			revised = args.Get(0).(*db.RedirectRecord)
+		}).Return(nil)
+
+		req := httptest.NewRequest("PATCH", "/abcd", strings.NewReader(big))
+		req.Header.Set("X-Delete-Token", "token1")
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NotNil(t, revised)
+		assert.Equal(t, "S", revised.Typ)
+		assert.Empty(t, revised.Val)
+		assert.Equal(t, int64(100), revised.Size)
+		assert.Equal(t, int64(3), revised.Rev)
+		assert.Len(t, revised.Revs, 2)
+		assert.Len(t, edited.Revs, 1, "the looked-up record is not modified")
+		// Each attempt uploads to a key of its own, which the record names
+		require.NotEmpty(t, revised.BlobTag)
+		assert.Equal(t, "S/abcd@3-"+revised.BlobTag+".zst", uploadedKey)
+		assert.Equal(t, uploadedKey, revisionBlobKey(revised, 0))
+		mockS3.AssertExpectations(t)
+	})
+
+	t.Run("An edit that loses the race removes its blob", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockS3 := &db.MockS3{}
+		h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+		big := strings.Repeat("y", 100)
+		var uploadedKey string
+		mockDB.On("GetRedirect", "abcd").Return(original(), nil)
+		mockS3.On("PutObject", "S/abcd.zst", []byte("first")).Return(nil)
+		mockS3.On("PutObjectStream", mock.AnythingOfType("string"), []byte(big)).Run(func(args mock.Arguments) {
+			uploadedKey = args.String(0)
+		}).Return(nil)
+		mockDB.On("ReviseRedirect", mock.AnythingOfType("*db.RedirectRecord"), "owner1").Return(&types.ConditionalCheckFailedException{})
+		mockS3.On("DeleteObject", mock.AnythingOfType("string")).Return(nil)
+
+		req := httptest.NewRequest("PUT", "/abcd", strings.NewReader(big))
+		req.AddCookie(&http.Cookie{Name: "id", Value: "owner1"})
+		w := httptest.NewRecorder()
+		newRouter(h).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.NotEqual(t, "S/abcd@2.zst", uploadedKey, "the winner's key is never written")
+		mockS3.AssertCalled(t, "DeleteObject", uploadedKey)
+		mockS3.AssertNotCalled(t, "DeleteObject", "S/abcd.zst")
+	})
+
+	tests := []struct {
+		name           string
+		record         *db.RedirectRecord
+		setup          func(*http.Request)
+		reviseErr      error
+		expectedStatus int
+	}{
+		{"No credentials", original(), func(r *http.Request) {}, nil, http.StatusUnauthorized},
+		{"Wrong owner", original(), func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: "owner2"}) }, nil, http.StatusUnauthorized},
+		{"Wrong token", original(), func(r *http.Request) { r.Header.Set("X-Delete-Token", "token2") }, nil, http.StatusUnauthorized},
+		{"Not found", nil, func(r *http.Request) { r.Header.Set("X-Delete-Token", "token1") }, nil, http.StatusNotFound},
+		{"Short links cannot be edited", &db.RedirectRecord{Code: "abcd", Typ: "R", Val: "https://example.com/", Owner: "owner1"},
+			func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: "owner1"}) }, nil, http.StatusBadRequest},
+		{"Revision limit", &db.RedirectRecord{Code: "abcd", Typ: "D", Val: "x", Owner: "owner1", Rev: 3},
+			func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: "owner1"}) }, nil, http.StatusConflict},
+		{"Concurrent edit", original(), func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id", Value: "owner1"}) },
+			&types.ConditionalCheckFailedException{}, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			h := &Handlers{DB: mockDB, S3: mockS3, Cfg: cfg}
+
+			if tt.record == nil {
+				mockDB.On("GetRedirect", "abcd").Return(nil, nil)
+			} else {
+				mockDB.On("GetRedirect", "abcd").Return(tt.record, nil)
+			}
+			mockS3.On("PutObject", mock.Anything, mock.Anything).Return(nil)
+			mockDB.On("ReviseRedirect", mock.Anything, mock.Anything).Return(tt.reviseErr)
+
+			req := httptest.NewRequest("PUT", "/abcd", strings.NewReader("second"))
+			tt.setup(req)
+			w := httptest.NewRecorder()
+			newRouter(h).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			if tt.reviseErr == nil {
+				mockDB.AssertNotCalled(t, "ReviseRedirect", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestDataHandlerRevision(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	record := &db.RedirectRecord{
+		Code: "abcd", Typ: "D", Val: "third", Ettl: future, Created: 1000, Updated: 3000, Size: 5, Rev: 3,
+		Revs: db.Revisions{{Rev: 1, Created: 1000, Size: 5}, {Rev: 2, Created: 2000, Size: 6}},
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		userAgent      string
+		expectedStatus int
+		expectedBody   string
+		expectedRev    string
+	}{
+		{"Latest", "/abcd", "curl/8.0", http.StatusOK, "third", "3"},
+		{"Earlier revision in the path", "/abcd@2", "curl/8.0", http.StatusOK, "second", "2"},
+		{"Earlier revision as a query", "/abcd?rev=1", "curl/8.0", http.StatusOK, "first", "1"},
+		{"Latest by number", "/abcd@3", "curl/8.0", http.StatusOK, "third", "3"},
+		{"Unknown revision", "/abcd@9", "curl/8.0", http.StatusNotFound, "Revision not found", ""},
+		{"Invalid revision", "/abcd@x", "curl/8.0", http.StatusBadRequest, "Invalid revision", ""},
+		{"History in the page", "/abcd@2", "Mozilla/5.0 (browser)", http.StatusOK, `href="/abcd@1"`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			mockS3 := &db.MockS3{}
+			mockDB.On("GetRedirect", "abcd").Return(record, nil)
+			mockDB.On("GetRedirectFresh", "abcd").Return(record, nil)
+			mockS3.On("GetObjectStream", "S/abcd.zst").Return([]byte("first"), nil)
+			mockS3.On("GetObjectStream", "S/abcd@2.zst").Return([]byte("second"), nil)
+			h := &Handlers{DB: mockDB, S3: mockS3}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			assert.Equal(t, tt.expectedRev, w.Header().Get("X-Paste-Revision"))
+		})
+	}
+}
+
+func TestDataHandlerRevisionFromAnotherReplica(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// This replica cached the paste before it was edited on another one
+	future := time.Now().Add(time.Hour).Unix()
+	stale := &db.RedirectRecord{Code: "abcd", Typ: "D", Val: "first", Ettl: future, Created: 1000, Size: 5}
+	fresh := &db.RedirectRecord{Code: "abcd", Typ: "D", Val: "second", Ettl: future, Created: 1000, Updated: 2000, Size: 6, Rev: 2,
+		Revs: db.Revisions{{Rev: 1, Created: 1000, Size: 5}}}
+
+	serve := func(mockDB *db.MockDB, path string) *httptest.ResponseRecorder {
+		h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+		w := httptest.NewRecorder()
+		_, router := gin.CreateTestContext(w)
+		router.GET("/:code", h.CatchAllHandler)
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("The new revision is read from the store", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockDB.On("GetRedirect", "abcd").Return(stale, nil)
+		mockDB.On("GetRedirectFresh", "abcd").Return(fresh, nil)
+
+		w := serve(mockDB, "/abcd@2")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "second", w.Body.String())
+		assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("The current revision must be revalidated", func(t *testing.T) {
+		mockDB := &db.MockDB{}
+		mockDB.On("GetRedirect", "abcd").Return(stale, nil)
+
+		w := serve(mockDB, "/abcd")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "public, no-cache", w.Header().Get("Cache-Control"))
+		mockDB.AssertNotCalled(t, "GetRedirectFresh", "abcd")
+	})
+}
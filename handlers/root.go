@@ -13,7 +13,8 @@ func (h *Handlers) RootHandler(c *gin.Context) {
 	c.Header("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
 
 	c.HTML(http.StatusOK, "index.html", gin.H{
-		"title": "xi.pe pastebin service",
+		"title":     "xi.pe pastebin service",
+		"languages": languageList(),
 	})
 }
 
@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Structured formats a text paste can be viewed and normalized as
+const (
+	dataJSON = "json"
+	dataYAML = "yaml"
+	dataCSV  = "csv"
+	dataTSV  = "tsv"
+)
+
+// maxDataNodes bounds the values of a tree, so YAML aliases can't expand a
+// small paste into a huge page
+const maxDataNodes = 100000
+
+// dataNode is one value of a JSON or YAML document, keeping the order of
+// object keys as written
+type dataNode struct {
+	kind     string // object, array, string, number, bool or null
+	value    string // JSON encoding of a scalar
+	keys     []string
+	children []*dataNode
+}
+
+// dataError is a parse error at a line of the paste
+type dataError struct {
+	Line int
+	Msg  string
+}
+
+func (e *dataError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// dataKind returns the structured format of a text paste: JSON or YAML by
+// its language, CSV or TSV by its language and file name, and JSON as well
+// for text without a language that is valid JSON. It returns "" otherwise.
+func dataKind(lang, filename, text string) string {
+	switch lang {
+	case "json":
+		return dataJSON
+	case "yaml":
+		return dataYAML
+	case "csv":
+		firstLine, _, _ := strings.Cut(text, "\n")
+		if strings.EqualFold(path.Ext(filename), ".tsv") || (strings.Contains(firstLine, "\t") && !strings.Contains(firstLine, ",")) {
+			return dataTSV
+		}
+		return dataCSV
+	case "":
+		trimmed := strings.TrimSpace(text)
+		if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+			return dataJSON
+		}
+	}
+	return ""
+}
+
+// dataLabel is how the page names a structured format
+func dataLabel(kind string) string {
+	return strings.ToUpper(kind)
+}
+
+// parseData parses text as kind into a tree. CSV and TSV become an array of
+// rows, each an array of fields.
+func parseData(kind, text string) (*dataNode, error) {
+	switch kind {
+	case dataJSON:
+		return parseJSON(text)
+	case dataYAML:
+		return parseYAML(text)
+	}
+	rows, err := parseTable(kind, text)
+	if err != nil {
+		return nil, err
+	}
+	table := &dataNode{kind: "array"}
+	for _, row := range rows {
+		fields := &dataNode{kind: "array"}
+		for _, field := range row {
+			fields.children = append(fields.children, &dataNode{kind: "string", value: jsonString(field)})
+		}
+		table.children = append(table.children, fields)
+	}
+	return table, nil
+}
+
+// parseJSON parses a single JSON value
+func parseJSON(text string) (*dataNode, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	count := 0
+	node, err := parseJSONValue(dec, &count)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF {
+			err = errors.New("unexpected data after the top-level value")
+		}
+	}
+	if err != nil {
+		offset := dec.InputOffset()
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			offset = syntaxErr.Offset
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("unexpected end of input")
+		}
+		return nil, &dataError{Line: lineAt(text, offset), Msg: strings.TrimPrefix(err.Error(), "json: ")}
+	}
+	return node, nil
+}
+
+func parseJSONValue(dec *json.Decoder, count *int) (*dataNode, error) {
+	if *count++; *count > maxDataNodes {
+		return nil, errTooManyNodes
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		node := &dataNode{kind: "array"}
+		if v == '{' {
+			node.kind = "object"
+		}
+		for dec.More() {
+			if node.kind == "object" {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			child, err := parseJSONValue(dec, count)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, child)
+		}
+		// The closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &dataNode{kind: "string", value: jsonString(v)}, nil
+	case json.Number:
+		return &dataNode{kind: "number", value: v.String()}, nil
+	case bool:
+		return &dataNode{kind: "bool", value: strconv.FormatBool(v)}, nil
+	}
+	return &dataNode{kind: "null", value: "null"}, nil
+}
+
+var errTooManyNodes = fmt.Errorf("more than %d values, too many to show", maxDataNodes)
+
+// yamlErrorLine finds the line number in a yaml.v3 error message
+var yamlErrorLine = regexp.MustCompile(`line (\d+): `)
+
+// parseYAML parses a YAML stream. A stream of several documents becomes an
+// array of them.
+func parseYAML(text string) (*dataNode, error) {
+	dec := yaml.NewDecoder(strings.NewReader(text))
+	var docs []*dataNode
+	count := 0
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			msg := strings.TrimPrefix(err.Error(), "yaml: ")
+			line := 1
+			if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+				line, _ = strconv.Atoi(m[1])
+				msg = strings.Replace(msg, m[0], "", 1)
+			}
+			return nil, &dataError{Line: line, Msg: msg}
+		}
+		node, err := yamlValue(&doc, &count)
+		if err != nil {
+			return nil, &dataError{Line: doc.Line, Msg: err.Error()}
+		}
+		docs = append(docs, node)
+	}
+	switch len(docs) {
+	case 0:
+		return &dataNode{kind: "null", value: "null"}, nil
+	case 1:
+		return docs[0], nil
+	}
+	return &dataNode{kind: "array", children: docs}, nil
+}
+
+func yamlValue(n *yaml.Node, count *int) (*dataNode, error) {
+	if *count++; *count > maxDataNodes {
+		return nil, errTooManyNodes
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return &dataNode{kind: "null", value: "null"}, nil
+		}
+		return yamlValue(n.Content[0], count)
+	case yaml.AliasNode:
+		return yamlValue(n.Alias, count)
+	case yaml.SequenceNode:
+		node := &dataNode{kind: "array"}
+		for _, item := range n.Content {
+			child, err := yamlValue(item, count)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, child)
+		}
+		return node, nil
+	case yaml.MappingNode:
+		node := &dataNode{kind: "object"}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			child, err := yamlValue(n.Content[i+1], count)
+			if err != nil {
+				return nil, err
+			}
+			node.keys = append(node.keys, n.Content[i].Value)
+			node.children = append(node.children, child)
+		}
+		return node, nil
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return &dataNode{kind: "null", value: "null"}, nil
+	case "!!bool", "!!int", "!!float":
+		// Written as JSON, so 0x1F becomes 31; .inf and .nan have no JSON
+		// form and stay strings
+		var v any
+		if err := n.Decode(&v); err == nil {
+			if encoded, err := json.Marshal(v); err == nil {
+				kind := "number"
+				if n.ShortTag() == "!!bool" {
+					kind = "bool"
+				}
+				return &dataNode{kind: kind, value: string(encoded)}, nil
+			}
+		}
+	}
+	return &dataNode{kind: "string", value: jsonString(n.Value)}, nil
+}
+
+// parseTable parses CSV, or TSV, into rows. Every row must have as many
+// fields as the first.
+func parseTable(kind, text string) ([][]string, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	if kind == dataTSV {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &dataError{Line: parseErr.Line, Msg: parseErr.Err.Error()}
+		}
+		return nil, &dataError{Line: 1, Msg: err.Error()}
+	}
+	return rows, nil
+}
+
+// jsonString encodes s as a JSON string, leaving <, > and & as they are
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// lineAt returns the line number of a byte offset in text
+func lineAt(text string, offset int64) int {
+	if offset > int64(len(text)) {
+		offset = int64(len(text))
+	}
+	return strings.Count(text[:offset], "\n") + 1
+}
+
+// writeJSON writes the node as JSON, indented by indent per level, or
+// compact if indent is empty
+func (n *dataNode) writeJSON(out *bytes.Buffer, indent string, depth int) {
+	if n.kind != "object" && n.kind != "array" {
+		out.WriteString(n.value)
+		return
+	}
+	open, closing := "[", "]"
+	if n.kind == "object" {
+		open, closing = "{", "}"
+	}
+	out.WriteString(open)
+	for i, child := range n.children {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if indent != "" {
+			out.WriteString("\n" + strings.Repeat(indent, depth+1))
+		}
+		if n.kind == "object" {
+			out.WriteString(jsonString(n.keys[i]) + ":")
+			if indent != "" {
+				out.WriteByte(' ')
+			}
+		}
+		child.writeJSON(out, indent, depth+1)
+	}
+	if indent != "" && len(n.children) > 0 {
+		out.WriteString("\n" + strings.Repeat(indent, depth))
+	}
+	out.WriteString(closing)
+}
+
+// formatData returns text of kind in a normalized form, as asked for with
+// ?format=json-pretty or ?format=json-min
+func formatData(kind, text, format string) ([]byte, error) {
+	node, err := parseData(kind, text)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	indent := ""
+	if format == "json-pretty" {
+		indent = "  "
+	}
+	node.writeJSON(&out, indent, 0)
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// dataFormats are the values ?format accepts
+var dataFormats = map[string]bool{"json-pretty": true, "json-min": true}
+
+// renderData renders text of kind as a collapsible tree, or a table for CSV
+// and TSV. The tree is made of details elements, so it works without script.
+func renderData(kind, text string) (template.HTML, error) {
+	if kind == dataCSV || kind == dataTSV {
+		rows, err := parseTable(kind, text)
+		if err != nil {
+			return "", err
+		}
+		return renderTable(rows), nil
+	}
+	node, err := parseData(kind, text)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	out.WriteString(`<ul class="data-tree">`)
+	writeTree(&out, "", node, 0)
+	out.WriteString(`</ul>`)
+	// Keys and values are all escaped
+	return template.HTML(out.String()), nil
+}
+
+// writeTree writes one value as a list item, its children in a details
+// element open for the first few levels
+func writeTree(out *strings.Builder, label string, n *dataNode, depth int) {
+	out.WriteString("<li>")
+	if n.kind != "object" && n.kind != "array" {
+		out.WriteString(label + `<span class="data-` + n.kind + `">` + template.HTMLEscapeString(n.value) + "</span></li>")
+		return
+	}
+	open, closing, unit := "[", "]", "item"
+	if n.kind == "object" {
+		open, closing, unit = "{", "}", "key"
+	}
+	if len(n.children) != 1 {
+		unit += "s"
+	}
+	if len(n.children) == 0 {
+		out.WriteString(label + open + closing + "</li>")
+		return
+	}
+	out.WriteString("<details")
+	if depth < 3 {
+		out.WriteString(" open")
+	}
+	fmt.Fprintf(out, `><summary>%s%s <span class="data-count">%d %s</span></summary><ul>`, label, open, len(n.children), unit)
+	for i, child := range n.children {
+		childLabel := `<span class="data-index">` + strconv.Itoa(i) + "</span>: "
+		if n.kind == "object" {
+			childLabel = `<span class="data-key">` + template.HTMLEscapeString(jsonString(n.keys[i])) + "</span>: "
+		}
+		writeTree(out, childLabel, child, depth+1)
+	}
+	out.WriteString("</ul>" + closing + "</details></li>")
+}
+
+// renderTable renders rows as a table headed by the first row
+func renderTable(rows [][]string) template.HTML {
+	var out strings.Builder
+	out.WriteString(`<table class="data-table">`)
+	for i, row := range rows {
+		cell := "td"
+		if i == 0 {
+			cell = "th"
+			out.WriteString("<thead>")
+		}
+		out.WriteString("<tr>")
+		for _, field := range row {
+			out.WriteString("<" + cell + ">" + template.HTMLEscapeString(field) + "</" + cell + ">")
+		}
+		out.WriteString("</tr>")
+		if i == 0 {
+			out.WriteString("</thead><tbody>")
+		}
+	}
+	if len(rows) > 0 {
+		out.WriteString("</tbody>")
+	}
+	out.WriteString("</table>")
+	return template.HTML(out.String())
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drewstreib/xipe-go/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataKind(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		filename string
+		text     string
+		expected string
+	}{
+		{"JSON language", "json", "", "not json", dataJSON},
+		{"YAML language", "yaml", "", "a: 1", dataYAML},
+		{"CSV", "csv", "data.csv", "a,b\n1,2\n", dataCSV},
+		{"TSV by name", "csv", "data.tsv", "a\tb\n", dataTSV},
+		{"TSV by content", "csv", "", "a\tb\n1\t2\n", dataTSV},
+		{"JSON without a language", "", "", " {\"a\": 1}\n", dataJSON},
+		{"Invalid JSON without a language", "", "", "{\"a\": ", ""},
+		{"Plain text", "", "", "hello", ""},
+		{"Other language", "go", "", "{}", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, dataKind(tt.lang, tt.filename, tt.text))
+		})
+	}
+}
+
+func TestParseDataErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		kind string
+		text string
+		line int
+	}{
+		{"JSON syntax", dataJSON, "{\n  \"a\": 1,\n  \"b\": ]\n}\n", 3},
+		{"JSON cut off", dataJSON, "{\n  \"a\": [1,\n", 3},
+		{"JSON trailing data", dataJSON, "{}\n{}\n", 2},
+		{"YAML mapping", dataYAML, "a: 1\nb: 2\nc: d: e\n", 3},
+		{"CSV field count", dataCSV, "a,b\n1,2\n3\n", 3},
+		{"CSV quote", dataCSV, "a,b\n\"1,2\n", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseData(tt.kind, tt.text)
+			var dataErr *dataError
+			require.True(t, errors.As(err, &dataErr), "expected a dataError, got %v", err)
+			assert.Equal(t, tt.line, dataErr.Line)
+			assert.NotEmpty(t, dataErr.Msg)
+		})
+	}
+}
+
+func TestFormatData(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		text     string
+		format   string
+		expected string
+	}{
+		{"Pretty keeps key order", dataJSON, `{"b":1,"a":[true,null,"x"],"c":{}}`, "json-pretty", "{\n  \"b\": 1,\n  \"a\": [\n    true,\n    null,\n    \"x\"\n  ],\n  \"c\": {}\n}\n"},
+		{"Minified", dataJSON, "{\n  \"a\": 1.50,\n  \"b\": \"<&>\"\n}", "json-min", "{\"a\":1.50,\"b\":\"<&>\"}\n"},
+		{"YAML scalars", dataYAML, "hex: 0x1F\non: true\nname: bob\nnone: ~\ninf: .inf\n", "json-min", "{\"hex\":31,\"on\":true,\"name\":\"bob\",\"none\":null,\"inf\":\".inf\"}\n"},
+		{"YAML aliases", dataYAML, "base: &b {x: 1}\ncopy: *b\n", "json-min", "{\"base\":{\"x\":1},\"copy\":{\"x\":1}}\n"},
+		{"YAML documents", dataYAML, "a: 1\n---\nb: 2\n", "json-min", "[{\"a\":1},{\"b\":2}]\n"},
+		{"CSV rows", dataCSV, "name,n\n\"x, y\",2\n", "json-min", "[[\"name\",\"n\"],[\"x, y\",\"2\"]]\n"},
+		{"TSV rows", dataTSV, "a\tb\n1\t2\n", "json-min", "[[\"a\",\"b\"],[\"1\",\"2\"]]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := formatData(tt.kind, tt.text, tt.format)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(out))
+		})
+	}
+}
+
+func TestRenderData(t *testing.T) {
+	tests := []struct {
+		name        string
+		kind        string
+		text        string
+		contains    []string
+		notContains []string
+	}{
+		{"Tree", dataJSON, `{"name":"x","list":[1,2]}`, []string{`<ul class="data-tree">`, `<span class="data-key">&#34;name&#34;</span>: <span class="data-string">&#34;x&#34;</span>`, `<span class="data-count">2 items</span>`, `<span class="data-index">1</span>: <span class="data-number">2</span>`}, nil},
+		{"Tree is escaped", dataJSON, `{"<b>":"<script>"}`, []string{"&lt;b&gt;", "&lt;script&gt;"}, []string{"<script>", "<b>"}},
+		{"Deep levels start closed", dataYAML, "a: {b: {c: {d: 1}}}\n", []string{"<details open>", "<details><summary>"}, nil},
+		{"Table", dataCSV, "name,n\nx,2\n", []string{`<table class="data-table"><thead><tr><th>name</th><th>n</th></tr></thead><tbody><tr><td>x</td><td>2</td></tr></tbody></table>`}, nil},
+		{"Table is escaped", dataCSV, "<th>\n<img>\n", []string{"<th>&lt;th&gt;</th>", "<td>&lt;img&gt;</td>"}, []string{"<img>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renderData(tt.kind, tt.text)
+			require.NoError(t, err)
+			for _, s := range tt.contains {
+				assert.Contains(t, string(out), s)
+			}
+			for _, s := range tt.notContains {
+				assert.NotContains(t, string(out), s)
+			}
+		})
+	}
+}
+
+func TestDataHandlerStructured(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	future := time.Now().Add(time.Hour).Unix()
+	records := map[string]*db.RedirectRecord{
+		"json": {Code: "json", Typ: "D", Val: `{"b":1,"a":2}`, Ettl: future, Lang: "json"},
+		"bad1": {Code: "bad1", Typ: "D", Val: "{\n  \"a\": ]\n}\n", Ettl: future, Lang: "json"},
+		"tabl": {Code: "tabl", Typ: "D", Val: "name,n\nx,2\n", Ettl: future, Filename: "data.csv"},
+		"text": {Code: "text", Typ: "D", Val: "hello", Ettl: future},
+		"link": {Code: "link", Typ: "R", Val: "https://example.com", Ettl: future},
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		userAgent    string
+		expectedCode int
+		contains     []string
+		notContains  []string
+	}{
+		{"Source offers the tree", "/json", "Mozilla/5.0 (browser)", http.StatusOK, []string{`id="L1"`, "Tree View"}, []string{`<ul class="data-tree">`}},
+		{"Tree on request", "/json?render=data", "Mozilla/5.0 (browser)", http.StatusOK, []string{`<ul class="data-tree">`, `id="sourceText"`, "View Source"}, []string{`id="L1"`}},
+		{"CSV offers the table", "/tabl", "Mozilla/5.0 (browser)", http.StatusOK, []string{"Table View"}, nil},
+		{"Table on request", "/tabl?render=data", "Mozilla/5.0 (browser)", http.StatusOK, []string{`<table class="data-table">`}, nil},
+		{"Errors point at their line", "/bad1", "Mozilla/5.0 (browser)", http.StatusOK, []string{"Invalid JSON", `<a href="#L2">line 2</a>`, `id="L2"`}, nil},
+		{"Invalid data falls back to source", "/bad1?render=data", "Mozilla/5.0 (browser)", http.StatusOK, []string{"Invalid JSON", `id="L2"`}, []string{`<ul class="data-tree">`}},
+		{"Plain text has no structured view", "/text", "Mozilla/5.0 (browser)", http.StatusOK, nil, []string{"Tree View", "Table View"}},
+		{"Pretty JSON", "/json?format=json-pretty", "curl/8.0", http.StatusOK, []string{"{\n  \"b\": 1,\n  \"a\": 2\n}\n"}, nil},
+		{"Minified CSV", "/tabl?format=json-min", "curl/8.0", http.StatusOK, []string{`[["name","n"],["x","2"]]`}, nil},
+		{"Browsers get the format too", "/json?format=json-min", "Mozilla/5.0 (browser)", http.StatusOK, []string{`{"b":1,"a":2}`}, []string{"<html"}},
+		{"Invalid data", "/bad1?format=json-min", "curl/8.0", http.StatusUnprocessableEntity, []string{"Invalid JSON at line 2"}, nil},
+		{"Not structured", "/text?format=json-min", "curl/8.0", http.StatusBadRequest, []string{"format only applies"}, nil},
+		{"Not a paste", "/link?format=json-min", "curl/8.0", http.StatusBadRequest, []string{"format only applies"}, nil},
+		{"Unknown format", "/json?format=xml", "curl/8.0", http.StatusBadRequest, []string{"Unknown format xml"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &db.MockDB{}
+			for code, record := range records {
+				mockDB.On("GetRedirect", code).Return(record, nil)
+			}
+			h := &Handlers{DB: mockDB, S3: &db.MockS3{}}
+
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.LoadHTMLGlob("../templates/*")
+			router.GET("/:code", h.CatchAllHandler)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			for _, s := range tt.contains {
+				assert.Contains(t, w.Body.String(), s)
+			}
+			for _, s := range tt.notContains {
+				assert.NotContains(t, w.Body.String(), s)
+			}
+		})
+	}
+}
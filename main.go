@@ -3,15 +3,18 @@ package main
 import (
 	"embed"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 	"reflect"
 	"time"
 
 	"github.com/drewstreib/xipe-go/config"
 	"github.com/drewstreib/xipe-go/db"
+	"github.com/drewstreib/xipe-go/gc"
 	"github.com/drewstreib/xipe-go/handlers"
 	"github.com/drewstreib/xipe-go/utils"
 
@@ -36,20 +39,30 @@ func main() {
 		log.Fatal("Failed to initialize reserved codes:", err)
 	}
 
-	dbClient, err := db.NewDynamoDBClient(cfg)
-	if err != nil {
-		log.Fatal("Failed to create DynamoDB client:", err)
+	dbClient, s3Client := newStorage(cfg)
+
+	// "xipe gc" runs a single garbage collection pass and exits
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		runGC(cfg, dbClient, s3Client, os.Args[2:])
+		return
 	}
 
-	s3Client, err := db.NewS3Client()
-	if err != nil {
-		log.Fatal("Failed to create S3 client:", err)
+	if cfg.GCInterval > 0 {
+		collector := &gc.Collector{
+			DB:          dbClient,
+			S3:          s3Client,
+			GracePeriod: time.Duration(cfg.GCGracePeriod) * time.Second,
+		}
+		collector.Start(time.Duration(cfg.GCInterval) * time.Second)
+		log.Printf("Blob garbage collector running every %ds", cfg.GCInterval)
 	}
 
 	h := &handlers.Handlers{
-		DB:  dbClient,
-		S3:  s3Client,
-		Cfg: cfg,
+		DB:      dbClient,
+		S3:      s3Client,
+		Cfg:     cfg,
+		Guesses: handlers.NewGuessLimiter(dbClient, cfg.PasswordMaxGuesses, time.Duration(cfg.PasswordGuessWindow)*time.Second),
+		Render:  handlers.NewHighlighter(cfg.RenderCacheMaxItems),
 	}
 
 	r := gin.Default()
@@ -142,11 +155,12 @@ func main() {
 	// Security headers middleware
 	r.Use(func(c *gin.Context) {
 		// Content Security Policy - prevent XSS and script injection
-		// Allow highlight.js from s.xi.pe, inline styles for templates, and self for everything else
+		// Pastes are highlighted server-side, so only the templates' own inline
+		// scripts and styles are allowed besides self
 		c.Header("Content-Security-Policy",
 			"default-src 'self'; "+
-				"script-src 'self' 'unsafe-inline' https://s.xi.pe; "+
-				"style-src 'self' 'unsafe-inline' https://s.xi.pe; "+
+				"script-src 'self' 'unsafe-inline'; "+
+				"style-src 'self' 'unsafe-inline'; "+
 				"font-src 'self'; "+
 				"img-src 'self' data:; "+
 				"connect-src 'self'; "+
@@ -190,12 +204,22 @@ func main() {
 	r.GET("/", h.RootHandler)
 	r.POST("/", h.PostHandler)
 	r.DELETE("/:code", h.DeleteHandler)
+	r.PUT("/:code", h.UpdateHandler)
+	r.PATCH("/:code", h.UpdateHandler)
 	r.GET("/challenge-check", h.HandleChallengeCheck)
 	r.GET("/cloudflare-test", h.HandleCloudflareTest)
+	r.GET("/diff/:a/:b", h.DiffHandler)
 
 	api := r.Group("/api")
 	{
 		api.GET("/stats", h.StatsHandler)
+
+		// Versioned JSON API; errors under /api/v1 are JSON too
+		v1 := api.Group("/v1")
+		v1.POST("/pastes", h.APICreatePaste)
+		v1.GET("/pastes/:code", h.APIGetPaste)
+		v1.GET("/pastes/:code/content", h.APIGetPasteContent)
+		v1.DELETE("/pastes/:code", h.APIDeletePaste)
 	}
 
 	// Helper function to serve static files with 1-day cache headers
@@ -207,6 +231,9 @@ func main() {
 		c.FileFromFS(filePath, http.FS(staticFS))
 	}
 
+	// Stylesheet for highlighted pastes, generated from the chroma style
+	r.GET("/highlight.css", h.HighlightCSSHandler)
+
 	// Serve static files
 	r.GET("/favicon.ico", func(c *gin.Context) {
 		serveStaticWithCache(c, "static/favicon.ico")
@@ -243,9 +270,77 @@ func main() {
 	})
 
 	r.GET("/:code", h.CatchAllHandler)
+	r.POST("/:code", h.DataHandler) // Password form for protected pastes
+	r.POST("/:code/fork", h.ForkHandler)
+	r.GET("/:code/:filename", h.DataHandler) // One file of a multi-file paste
 
 	log.Println("Server starting on :8080")
 	if err := r.Run(":8080"); err != nil {
 		log.Fatal("Failed to start server:", err)
 	}
 }
+
+// newStorage creates the metadata and blob stores selected by the config.
+// The blob store is created first so metadata deletes can clean up blobs.
+func newStorage(cfg *config.Config) (db.DBInterface, db.S3Interface) {
+	var s3Client db.S3Interface
+	var err error
+	switch cfg.BlobBackend {
+	case "local":
+		s3Client, err = db.NewLocalS3Client(cfg)
+		if err != nil {
+			log.Fatal("Failed to create local blob store:", err)
+		}
+	default:
+		s3Client, err = db.NewS3Client(cfg)
+		if err != nil {
+			log.Fatal("Failed to create S3 client:", err)
+		}
+	}
+
+	var dbClient db.DBInterface
+	switch cfg.DBBackend {
+	case "local":
+		dbClient, err = db.NewLocalDBClient(cfg, s3Client)
+		if err != nil {
+			log.Fatal("Failed to create local metadata store:", err)
+		}
+	case "sqlite":
+		dbClient, err = db.NewSQLiteDBClient(cfg, s3Client)
+		if err != nil {
+			log.Fatal("Failed to create SQLite metadata store:", err)
+		}
+	default:
+		dbClient, err = db.NewDynamoDBClient(cfg, s3Client)
+		if err != nil {
+			log.Fatal("Failed to create DynamoDB client:", err)
+		}
+	}
+
+	return dbClient, s3Client
+}
+
+// runGC implements the "gc" command: one collection pass with a JSON report on stdout
+func runGC(cfg *config.Config, dbClient db.DBInterface, s3Client db.S3Interface, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report orphaned blobs without deleting them")
+	grace := fs.Int64("grace", cfg.GCGracePeriod, "skip blobs modified within this many seconds")
+	_ = fs.Parse(args)
+
+	collector := &gc.Collector{
+		DB:          dbClient,
+		S3:          s3Client,
+		GracePeriod: time.Duration(*grace) * time.Second,
+		DryRun:      *dryRun,
+	}
+	report, err := collector.Run()
+	if err != nil {
+		log.Fatal("Garbage collection failed:", err)
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatal("Failed to encode GC report:", err)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"io"
+	"strings"
+)
+
+// ANSI escape sequences, as terminals and CI logs emit them: CSI sequences
+// (ESC [ params final) for colours and cursor movement, OSC sequences
+// (ESC ] ... BEL or ESC \) for titles and hyperlinks, and two-byte escapes.
+const (
+	ansiText         = iota
+	ansiEscape       // After ESC
+	ansiCSI          // Inside ESC [, up to a final byte in @ to ~
+	ansiOSC          // Inside ESC ], up to BEL or ST
+	ansiOSCEscape    // ESC inside an OSC sequence, the start of ST
+	ansiIntermediate // After ESC and an intermediate byte such as ( or #
+)
+
+// HasANSI reports whether text contains ANSI escape sequences
+func HasANSI(text string) bool {
+	return strings.Contains(text, "\x1b[") || strings.Contains(text, "\x1b]")
+}
+
+// ansiStripper removes escape sequences from text fed to it in chunks,
+// remembering a sequence cut off at the end of a chunk
+type ansiStripper struct {
+	state int
+}
+
+// strip appends the text of src outside escape sequences to dst
+func (s *ansiStripper) strip(dst, src []byte) []byte {
+	for _, b := range src {
+		switch s.state {
+		case ansiText:
+			if b == 0x1b {
+				s.state = ansiEscape
+			} else {
+				dst = append(dst, b)
+			}
+		case ansiEscape:
+			switch {
+			case b == '[':
+				s.state = ansiCSI
+			case b == ']':
+				s.state = ansiOSC
+			case b >= 0x20 && b <= 0x2f:
+				s.state = ansiIntermediate
+			default:
+				s.state = ansiText
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiOSC:
+			if b == 0x07 {
+				s.state = ansiText
+			} else if b == 0x1b {
+				s.state = ansiOSCEscape
+			}
+		case ansiOSCEscape:
+			if b == '\\' {
+				s.state = ansiText
+			} else {
+				s.state = ansiOSC
+			}
+		case ansiIntermediate:
+			if b < 0x20 || b > 0x2f {
+				s.state = ansiText
+			}
+		}
+	}
+	return dst
+}
+
+// StripANSI removes ANSI escape sequences from text
+func StripANSI(text string) string {
+	var s ansiStripper
+	return string(s.strip(make([]byte, 0, len(text)), []byte(text)))
+}
+
+// ANSIStripReader removes ANSI escape sequences from a stream
+type ANSIStripReader struct {
+	r        io.Reader
+	buf      []byte
+	out      []byte
+	stripper ansiStripper
+	err      error
+}
+
+// NewANSIStripReader wraps r, emitting its text without escape sequences
+func NewANSIStripReader(r io.Reader) *ANSIStripReader {
+	return &ANSIStripReader{r: r, buf: make([]byte, 32*1024)}
+}
+
+func (a *ANSIStripReader) Read(p []byte) (int, error) {
+	for len(a.out) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		n, err := a.r.Read(a.buf)
+		a.out = a.stripper.strip(a.out[:0], a.buf[:n])
+		a.err = err
+	}
+	n := copy(p, a.out)
+	a.out = a.out[n:]
+	return n, nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"Plain text", "ok  \tpkg\t0.01s\n", "ok  \tpkg\t0.01s\n"},
+		{"Colours", "\x1b[1;31mFAIL\x1b[0m pkg\n", "FAIL pkg\n"},
+		{"256 and 24-bit colours", "\x1b[38;5;208mwarn\x1b[48;2;0;0;0m!\x1b[m", "warn!"},
+		{"Cursor movement", "50%\x1b[2K\x1b[1G100%", "50%100%"},
+		{"Hyperlink", "\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x07", "link"},
+		{"Charset", "\x1b(Bbox", "box"},
+		{"Unicode is kept", "\x1b[32m✓\x1b[0m done", "✓ done"},
+		{"Cut off sequence", "text\x1b[31", "text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, StripANSI(tt.input))
+
+			// OneByteReader splits every sequence across reads
+			out, err := io.ReadAll(NewANSIStripReader(iotest.OneByteReader(strings.NewReader(tt.input))))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, string(out))
+		})
+	}
+}
+
+func TestHasANSI(t *testing.T) {
+	assert.True(t, HasANSI("\x1b[31mred"))
+	assert.True(t, HasANSI("\x1b]0;title\x07"))
+	assert.False(t, HasANSI("plain [31m text"))
+}
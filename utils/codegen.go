@@ -3,11 +3,22 @@ package utils
 import (
 	"crypto/rand"
 	"math/big"
+	"regexp"
 )
 
 // Character set excludes ambiguous characters: 0, O, 1, I, l, o, B, 8
 const charset = "2345679CDEFGHJKLMNPQRSTUVWXYZacdefghijkmnpqrstuvwxyz"
 
+// codePattern is the grammar for every code: generated 4-5 character codes
+// and vanity codes of up to 64 characters that may also use - and _. A code
+// always starts with a letter or digit, so internal keys can use other prefixes.
+var codePattern = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_-]{3,63}$")
+
+// IsValidCode reports whether code matches the code grammar
+func IsValidCode(code string) bool {
+	return codePattern.MatchString(code)
+}
+
 // GenerateCode generates a random alphanumeric code of specified length
 func GenerateCode(length int) (string, error) {
 	b := make([]byte, length)
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,3 +41,15 @@ func TestGenerateCode(t *testing.T) {
 		}
 	})
 }
+
+func TestIsValidCode(t *testing.T) {
+	valid := []string{"Ab3d", "XyZ9k", "my-release-notes", "build_42", strings.Repeat("a", 64)}
+	invalid := []string{"abc", "-abc", "_abc", "has space", "dots.txt", "slash/es", strings.Repeat("a", 65), ""}
+
+	for _, code := range valid {
+		assert.True(t, IsValidCode(code), code)
+	}
+	for _, code := range invalid {
+		assert.False(t, IsValidCode(code), code)
+	}
+}
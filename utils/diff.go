@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffEdits bounds the work of a line diff. Myers' algorithm keeps a copy
+// of its frontier for every edit, so texts further apart than this are shown
+// as a full replacement instead of being compared line by line.
+const maxDiffEdits = 1000
+
+// DiffKind says whether a diff line is in both texts, only the old one or
+// only the new one
+type DiffKind int
+
+const (
+	DiffEqual DiffKind = iota
+	DiffDelete
+	DiffInsert
+)
+
+// DiffLine is one line of a line diff
+type DiffLine struct {
+	Kind    DiffKind
+	Text    string
+	OldLine int // 1-based line number in the old text, 0 for inserted lines
+	NewLine int // 1-based line number in the new text, 0 for deleted lines
+}
+
+// DiffHunk is a run of changes with the context around it, as in a unified diff
+type DiffHunk struct {
+	OldStart, OldCount int
+	NewStart, NewCount int
+	Lines              []DiffLine
+}
+
+// SplitLines splits text into lines. A trailing newline does not start an
+// extra empty line.
+func SplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// DiffLines computes a shortest line diff turning a into b, or a full
+// replacement if they are more than maxDiffEdits lines apart
+func DiffLines(a, b []string) []DiffLine {
+	// Common prefixes and suffixes are cheap to strip and are most of a
+	// typical before/after paste
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	kinds, ok := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if !ok {
+		kinds = kinds[:0]
+		for range a[prefix : len(a)-suffix] {
+			kinds = append(kinds, DiffDelete)
+		}
+		for range b[prefix : len(b)-suffix] {
+			kinds = append(kinds, DiffInsert)
+		}
+	}
+
+	lines := make([]DiffLine, 0, prefix+len(kinds)+suffix)
+	x, y := 0, 0
+	emit := func(kind DiffKind) {
+		switch kind {
+		case DiffEqual:
+			lines = append(lines, DiffLine{Kind: DiffEqual, Text: a[x], OldLine: x + 1, NewLine: y + 1})
+			x++
+			y++
+		case DiffDelete:
+			lines = append(lines, DiffLine{Kind: DiffDelete, Text: a[x], OldLine: x + 1})
+			x++
+		case DiffInsert:
+			lines = append(lines, DiffLine{Kind: DiffInsert, Text: b[y], NewLine: y + 1})
+			y++
+		}
+	}
+	for i := 0; i < prefix; i++ {
+		emit(DiffEqual)
+	}
+	for _, kind := range kinds {
+		emit(kind)
+	}
+	for i := 0; i < suffix; i++ {
+		emit(DiffEqual)
+	}
+	return lines
+}
+
+// myersDiff returns the edit script from a to b found by Myers' O(ND)
+// algorithm, or false if it needs more than maxDiffEdits edits
+func myersDiff(a, b []string) ([]DiffKind, bool) {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+
+	// v[offset+k] is the furthest x reached on diagonal k = x - y. trace[d]
+	// holds diagonals -d-1..d+1 of v as it was before step d.
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Down: insert from b
+			} else {
+				x = v[offset+k-1] + 1 // Right: delete from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(trace, n, m), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// myersBacktrack walks the saved frontiers back from (n, m) to recover the
+// edit script
+func myersBacktrack(trace [][]int, n, m int) []DiffKind {
+	var kinds []DiffKind
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			kinds = append(kinds, DiffEqual)
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				kinds = append(kinds, DiffInsert)
+			} else {
+				kinds = append(kinds, DiffDelete)
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(kinds)-1; i < j; i, j = i+1, j-1 {
+		kinds[i], kinds[j] = kinds[j], kinds[i]
+	}
+	return kinds
+}
+
+// DiffHunks groups the changes in a line diff into hunks with up to context
+// unchanged lines around them. Identical texts have no hunks.
+func DiffHunks(lines []DiffLine, context int) []DiffHunk {
+	var hunks []DiffHunk
+	for i := 0; i < len(lines); {
+		if lines[i].Kind == DiffEqual {
+			i++
+			continue
+		}
+
+		// Extend the hunk while the next change is within two contexts
+		start := max(i-context, 0)
+		end := i
+		for end < len(lines) {
+			if lines[end].Kind != DiffEqual {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].Kind == DiffEqual {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		end = min(end+context, len(lines))
+
+		hunk := DiffHunk{Lines: lines[start:end]}
+		oldBefore, newBefore := linesBefore(lines, start)
+		for _, line := range hunk.Lines {
+			if line.Kind != DiffInsert {
+				hunk.OldCount++
+			}
+			if line.Kind != DiffDelete {
+				hunk.NewCount++
+			}
+		}
+		// An empty side is numbered by the line it follows, as diff -u does
+		hunk.OldStart, hunk.NewStart = oldBefore, newBefore
+		if hunk.OldCount > 0 {
+			hunk.OldStart++
+		}
+		if hunk.NewCount > 0 {
+			hunk.NewStart++
+		}
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+// linesBefore counts the old and new lines that come before lines[i]
+func linesBefore(lines []DiffLine, i int) (int, int) {
+	oldCount, newCount := 0, 0
+	for _, line := range lines[:i] {
+		if line.Kind != DiffInsert {
+			oldCount++
+		}
+		if line.Kind != DiffDelete {
+			newCount++
+		}
+	}
+	return oldCount, newCount
+}
+
+// UnifiedDiff formats hunks as a unified diff between oldName and newName.
+// It is empty when there are no hunks, like diff -u on identical files.
+func UnifiedDiff(oldName, newName string, hunks []DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		sb.WriteString(hunk.Header())
+		sb.WriteByte('\n')
+		for _, line := range hunk.Lines {
+			switch line.Kind {
+			case DiffEqual:
+				sb.WriteByte(' ')
+			case DiffDelete:
+				sb.WriteByte('-')
+			case DiffInsert:
+				sb.WriteByte('+')
+			}
+			sb.WriteString(line.Text)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// Header formats the @@ line that starts the hunk in a unified diff
+func (h DiffHunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.OldStart, h.OldCount), hunkRange(h.NewStart, h.NewCount))
+}
+
+// hunkRange formats one side of a hunk header, leaving out a count of 1
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitLines(t *testing.T) {
+	assert.Nil(t, SplitLines(""))
+	assert.Equal(t, []string{"a", "b"}, SplitLines("a\nb"))
+	assert.Equal(t, []string{"a", "b"}, SplitLines("a\nb\n"))
+	assert.Equal(t, []string{"a", ""}, SplitLines("a\n\n"))
+}
+
+func TestDiffLines(t *testing.T) {
+	lines := DiffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	assert.Equal(t, []DiffLine{
+		{Kind: DiffEqual, Text: "a", OldLine: 1, NewLine: 1},
+		{Kind: DiffDelete, Text: "b", OldLine: 2},
+		{Kind: DiffInsert, Text: "x", NewLine: 2},
+		{Kind: DiffEqual, Text: "c", OldLine: 3, NewLine: 3},
+		{Kind: DiffInsert, Text: "d", NewLine: 4},
+	}, lines)
+
+	// Texts too far apart become a full replacement rather than a slow diff
+	var a, b []string
+	for i := 0; i < maxDiffEdits; i++ {
+		a = append(a, "old "+strconv.Itoa(i))
+		b = append(b, "new "+strconv.Itoa(i))
+	}
+	lines = DiffLines(append([]string{"same"}, a...), append([]string{"same"}, b...))
+	assert.Len(t, lines, 2*maxDiffEdits+1)
+	assert.Equal(t, DiffEqual, lines[0].Kind)
+	assert.Equal(t, DiffDelete, lines[1].Kind)
+	assert.Equal(t, DiffInsert, lines[len(lines)-1].Kind)
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      string
+		new      string
+		expected string
+	}{
+		{"Identical", "a\nb\n", "a\nb\n", ""},
+		{"Changed line", "a\nb\nc\n", "a\nB\nc\n", "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"From empty", "", "a\n", "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n"},
+		{"To empty", "a\nb\n", "", "--- old\n+++ new\n@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{
+			"Distant changes are separate hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+			"--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			"Nearby changes share a hunk",
+			"1\n2\n3\n4\n5\n6\n7\n",
+			"one\n2\n3\n4\n5\n6\nseven\n",
+			"--- old\n+++ new\n@@ -1,7 +1,7 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n-7\n+seven\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks := DiffHunks(DiffLines(SplitLines(tt.old), SplitLines(tt.new)), 3)
+			assert.Equal(t, tt.expected, UnifiedDiff("old", "new", hunks))
+		})
+	}
+}
+
+func TestDiffLinesLargeInput(t *testing.T) {
+	// A small change in a large paste is cheap thanks to prefix and suffix trimming
+	a := strings.Split(strings.Repeat("line\n", 100000), "\n")
+	b := append([]string{}, a...)
+	b[50000] = "changed"
+	hunks := DiffHunks(DiffLines(a, b), 3)
+	assert.Len(t, hunks, 1)
+	assert.Equal(t, 50001, hunks[0].OldStart+3)
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{"3600", time.Hour, false},
+		{"1h", time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"", 0, true},
+		{"soon", 0, true},
+		{"xd", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseTTL(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	want := time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, input := range []string{"2026-12-01T00:00:00Z", "2026-12-01T00:00Z", "2026-12-01T00:00", "2026-12-01"} {
+		got, err := ParseExpiry(input)
+		assert.NoError(t, err, input)
+		assert.True(t, want.Equal(got), input)
+	}
+
+	got, err := ParseExpiry("2026-12-01T02:00+02:00")
+	assert.NoError(t, err)
+	assert.True(t, want.Equal(got))
+
+	_, err = ParseExpiry("next tuesday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LineRange selects lines of text by number, counting from 1, as ?lines=10-20,
+// ?head=N and ?tail=N ask for
+type LineRange struct {
+	First, Last int // Lines First to Last, or to the end when Last is 0
+	Tail        int // The last Tail lines instead, when set
+}
+
+// ParseLineRange reads the line range asked for in query, returning nil when
+// there is none. ?lines takes N, N-M or N-, each number optionally written
+// as in a #L10-L20 link.
+func ParseLineRange(query url.Values) (*LineRange, error) {
+	asked := 0
+	for _, name := range []string{"lines", "head", "tail"} {
+		if query.Has(name) {
+			asked++
+		}
+	}
+	switch {
+	case asked == 0:
+		return nil, nil
+	case asked > 1:
+		return nil, errors.New("only one of lines, head and tail can be given")
+	}
+
+	if query.Has("head") {
+		n, ok := lineNumber(query.Get("head"))
+		if !ok {
+			return nil, errors.New("head must be a positive number of lines")
+		}
+		return &LineRange{First: 1, Last: n}, nil
+	}
+	if query.Has("tail") {
+		n, ok := lineNumber(query.Get("tail"))
+		if !ok {
+			return nil, errors.New("tail must be a positive number of lines")
+		}
+		return &LineRange{Tail: n}, nil
+	}
+
+	invalid := errors.New("lines must be N, N-M or N- with 1 <= N <= M")
+	first, last, isRange := strings.Cut(query.Get("lines"), "-")
+	r := &LineRange{}
+	var ok bool
+	if r.First, ok = lineNumber(first); !ok {
+		return nil, invalid
+	}
+	switch {
+	case !isRange:
+		r.Last = r.First
+	case last != "":
+		if r.Last, ok = lineNumber(last); !ok || r.Last < r.First {
+			return nil, invalid
+		}
+	}
+	return r, nil
+}
+
+// lineNumber parses a line number of at least 1, with or without an L
+func lineNumber(s string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "L"))
+	return n, err == nil && n >= 1
+}
+
+// Slice returns the lines of text in the range
+func (r *LineRange) Slice(text string) string {
+	var out strings.Builder
+	_, _ = io.Copy(&out, r.Reader(strings.NewReader(text)))
+	return out.String()
+}
+
+// Reader returns the lines of src in the range. Reading stops once the last
+// line has been read, so the head of a large stream is cheap; a tail has to
+// read it all, keeping only the lines it returns.
+func (r *LineRange) Reader(src io.Reader) io.Reader {
+	return &lineRangeReader{r: r, src: bufio.NewReaderSize(src, 32*1024)}
+}
+
+type lineRangeReader struct {
+	r    *LineRange
+	src  *bufio.Reader
+	line int    // Complete lines read so far
+	out  []byte // Selected bytes waiting to be returned
+	err  error  // Returned once out is empty
+}
+
+func (l *lineRangeReader) Read(p []byte) (int, error) {
+	for len(l.out) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		if l.r.Tail > 0 {
+			l.readTail()
+		} else {
+			l.readLine()
+		}
+	}
+	n := copy(p, l.out)
+	l.out = l.out[n:]
+	return n, nil
+}
+
+// readLine reads the next piece of a line, keeping it if it's in the range.
+// Lines longer than the buffer come in several pieces.
+func (l *lineRangeReader) readLine() {
+	chunk, err := l.src.ReadSlice('\n')
+	if n := l.line + 1; n >= l.r.First && (l.r.Last == 0 || n <= l.r.Last) {
+		// Only valid until the next read, which waits until out is empty
+		l.out = chunk
+	}
+	switch {
+	case err == nil:
+		l.line++
+		if l.r.Last != 0 && l.line >= l.r.Last {
+			l.err = io.EOF
+		}
+	case errors.Is(err, bufio.ErrBufferFull):
+	default:
+		l.err = err
+	}
+}
+
+// readTail reads the whole stream, keeping its last Tail lines
+func (l *lineRangeReader) readTail() {
+	var lines [][]byte
+	for {
+		line, err := l.src.ReadBytes('\n')
+		if len(line) > 0 {
+			lines = append(lines, line)
+			if len(lines) > l.r.Tail {
+				lines = lines[1:]
+			}
+		}
+		if err != nil {
+			l.err = err
+			break
+		}
+	}
+	for _, line := range lines {
+		l.out = append(l.out, line...)
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLineRange(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected *LineRange
+		valid    bool
+	}{
+		{"", nil, true},
+		{"lines=10-20", &LineRange{First: 10, Last: 20}, true},
+		{"lines=L10-L20", &LineRange{First: 10, Last: 20}, true},
+		{"lines=7", &LineRange{First: 7, Last: 7}, true},
+		{"lines=7-", &LineRange{First: 7}, true},
+		{"head=5", &LineRange{First: 1, Last: 5}, true},
+		{"tail=5", &LineRange{Tail: 5}, true},
+		{"lines=20-10", nil, false},
+		{"lines=0-3", nil, false},
+		{"lines=-3", nil, false},
+		{"lines=a-b", nil, false},
+		{"lines", nil, false},
+		{"head=0", nil, false},
+		{"tail=x", nil, false},
+		{"head=1&tail=1", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			r, err := ParseLineRange(query)
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, r)
+		})
+	}
+}
+
+func TestLineRangeReader(t *testing.T) {
+	long := strings.Repeat("x", 100*1024) + "\n"
+	text := "one\ntwo\n" + long + "four\nfive"
+
+	tests := []struct {
+		name     string
+		r        LineRange
+		expected string
+	}{
+		{"Middle", LineRange{First: 2, Last: 2}, "two\n"},
+		{"Across a long line", LineRange{First: 3, Last: 4}, long + "four\n"},
+		{"To the end", LineRange{First: 4}, "four\nfive"},
+		{"Past the end", LineRange{First: 9, Last: 10}, ""},
+		{"Tail", LineRange{Tail: 2}, "four\nfive"},
+		{"Tail longer than the text", LineRange{Tail: 10}, text},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.r.Slice(text))
+
+			out, err := io.ReadAll(tt.r.Reader(iotest.OneByteReader(strings.NewReader(text))))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, string(out))
+		})
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"strings"
 )
 
-//go:embed pages/*.txt
+// Pages are plain text, or Markdown if named .md
+//
+//go:embed pages
 var pagesFS embed.FS
 
 // ReservedCodes maintains a list of reserved codes that cannot be used for URL shortening
@@ -22,10 +24,14 @@ func InitReservedCodes() error {
 
 	// Add each filename (without extension) as a reserved code
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".txt") {
-			// Remove .txt extension to get the code
-			code := strings.TrimSuffix(entry.Name(), ".txt")
-			ReservedCodes[code] = true
+		if entry.IsDir() {
+			continue
+		}
+		// Remove the .txt or .md extension to get the code
+		for _, ext := range []string{".txt", ".md"} {
+			if code, ok := strings.CutSuffix(entry.Name(), ext); ok {
+				ReservedCodes[code] = true
+			}
 		}
 	}
 
@@ -37,12 +43,34 @@ func IsReservedCode(code string) bool {
 	return ReservedCodes[code]
 }
 
-// GetPageContent reads the content of an embedded page file
-func GetPageContent(code string) (string, error) {
-	filePath := fmt.Sprintf("pages/%s.txt", code)
-	content, err := pagesFS.ReadFile(filePath)
+// reservedSlugs are top-level paths served by routes of their own, which a
+// vanity code would otherwise shadow or be shadowed by
+var reservedSlugs = map[string]bool{
+	"api":             true,
+	"challenge-check": true,
+	"cloudflare-test": true,
+	"diff":            true,
+	"static":          true,
+	"swagger":         true,
+}
+
+// IsReservedSlug checks whether a requested vanity code is unavailable
+// because it names a static page or a route. The check ignores case so a
+// slug can't impersonate one by capitalisation.
+func IsReservedSlug(slug string) bool {
+	lower := strings.ToLower(slug)
+	return reservedSlugs[lower] || IsReservedCode(lower)
+}
+
+// GetPageContent reads the content of an embedded page file, and whether it
+// is written in Markdown
+func GetPageContent(code string) (string, bool, error) {
+	if content, err := pagesFS.ReadFile(fmt.Sprintf("pages/%s.md", code)); err == nil {
+		return string(content), true, nil
+	}
+	content, err := pagesFS.ReadFile(fmt.Sprintf("pages/%s.txt", code))
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
-	return string(content), nil
+	return string(content), false, nil
 }
@@ -61,3 +61,51 @@ func RespondWithError(c *gin.Context, statusCode int, status, description string
 		c.String(statusCode, "Error %d: %s", statusCode, description)
 	}
 }
+
+// RespondWithJSONError sends the error body used by the versioned JSON API
+func RespondWithJSONError(c *gin.Context, statusCode int, description string) {
+	c.JSON(statusCode, gin.H{
+		"status":      "error",
+		"status_code": statusCode,
+		"message":     description,
+	})
+}
+
+// previewBots are User-Agent fragments of link-unfurling crawlers that fetch
+// a URL as soon as it is posted in chat, before any human has clicked it
+var previewBots = []string{
+	"slackbot",
+	"slack-imgproxy",
+	"facebookexternalhit",
+	"facebookcatalog",
+	"twitterbot",
+	"discordbot",
+	"telegrambot",
+	"whatsapp",
+	"linkedinbot",
+	"skypeuripreview",
+	"microsoftpreview",
+	"teams",
+	"mattermost",
+	"googlebot",
+	"bingbot",
+	"applebot",
+	"embedly",
+	"iframely",
+	"redditbot",
+	"crawler",
+	"spider",
+	"preview",
+}
+
+// IsPreviewBot reports whether the request comes from a link preview or crawler.
+// These must never consume a burn-after-reading paste.
+func IsPreviewBot(c *gin.Context) bool {
+	userAgent := strings.ToLower(c.GetHeader("User-Agent"))
+	for _, bot := range previewBots {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// ErrInvalidUTF8 is returned by UTF8LimitReader when the input is not valid UTF-8
+var ErrInvalidUTF8 = errors.New("input is not valid UTF-8")
+
+// UTF8LimitReader validates a stream as UTF-8 and truncates it to at most
+// Max bytes without splitting a multi-byte character. Incomplete characters
+// at chunk boundaries are held back until the rest of their bytes arrive.
+type UTF8LimitReader struct {
+	Max       int64 // Maximum number of bytes to emit
+	Written   int64 // Bytes emitted so far
+	Truncated bool  // Set once input beyond Max was discarded
+
+	r       io.Reader
+	buf     []byte
+	pending []byte // Trailing bytes of an incomplete character
+	out     []byte // Validated bytes waiting to be returned
+	err     error
+}
+
+// NewUTF8LimitReader wraps r, emitting at most max bytes of validated UTF-8
+func NewUTF8LimitReader(r io.Reader, max int64) *UTF8LimitReader {
+	return &UTF8LimitReader{Max: max, r: r, buf: make([]byte, 32*1024)}
+}
+
+func (u *UTF8LimitReader) Read(p []byte) (int, error) {
+	for len(u.out) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		u.fill()
+	}
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	u.Written += int64(n)
+	return n, nil
+}
+
+// fill reads the next chunk from the underlying reader into u.out
+func (u *UTF8LimitReader) fill() {
+	n, readErr := u.r.Read(u.buf)
+	data := append(u.pending, u.buf[:n]...)
+	u.pending = nil
+
+	// Hold back a trailing partial character unless the input has ended
+	cut := len(data)
+	if readErr == nil {
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					cut = i
+				}
+				break
+			}
+		}
+	}
+
+	if !utf8.Valid(data[:cut]) {
+		u.err = ErrInvalidUTF8
+		return
+	}
+
+	// Written only counts bytes already handed out, so include anything still queued
+	emitted := u.Written + int64(len(u.out))
+	if emitted+int64(cut) > u.Max {
+		cut = int(u.Max - emitted)
+		for cut > 0 && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		u.out = append(u.out, data[:cut]...)
+		u.Truncated = true
+		u.err = io.EOF
+		return
+	}
+
+	u.out = append(u.out, data[:cut]...)
+	u.pending = append(u.pending, data[cut:]...)
+
+	if readErr != nil {
+		u.err = readErr
+	}
+}
+
+// ErrTooLarge is returned by MaxSizeReader once its input goes past the limit
+var ErrTooLarge = errors.New("input exceeds the maximum size")
+
+// MaxSizeReader passes a stream through unchanged but fails with ErrTooLarge,
+// rather than truncating, once it is longer than max bytes. Binary files are
+// useless cut short, unlike text.
+type MaxSizeReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+// NewMaxSizeReader wraps r, allowing at most max bytes through
+func NewMaxSizeReader(r io.Reader, max int64) *MaxSizeReader {
+	return &MaxSizeReader{r: r, max: max}
+}
+
+func (m *MaxSizeReader) Read(p []byte) (int, error) {
+	if m.n > m.max {
+		return 0, ErrTooLarge
+	}
+	// Reading one byte past the limit is enough to tell it was exceeded
+	if left := m.max - m.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.max {
+		return n - int(m.n-m.max), ErrTooLarge
+	}
+	return n, err
+}
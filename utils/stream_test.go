@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUTF8LimitReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		max       int64
+		expected  string
+		truncated bool
+		err       error
+	}{
+		{"Under limit", "hello", 10, "hello", false, nil},
+		{"Exactly at limit", "hello", 5, "hello", false, nil},
+		{"ASCII truncation", "hello world", 5, "hello", true, nil},
+		{"Does not split multi-byte character", "ab€cd", 4, "ab", true, nil},
+		{"Keeps character that fits", "ab€cd", 5, "ab€", true, nil},
+		{"Invalid UTF-8", "ab\xffcd", 10, "", false, ErrInvalidUTF8},
+		{"Incomplete character at end", "ab\xe2\x82", 10, "", false, ErrInvalidUTF8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// OneByteReader forces every multi-byte character across a chunk boundary
+			r := NewUTF8LimitReader(iotest.OneByteReader(strings.NewReader(tt.input)), tt.max)
+			out, err := io.ReadAll(r)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, string(out))
+			assert.Equal(t, tt.truncated, r.Truncated)
+			assert.Equal(t, int64(len(tt.expected)), r.Written)
+		})
+	}
+}
+
+func TestMaxSizeReader(t *testing.T) {
+	out, err := io.ReadAll(NewMaxSizeReader(strings.NewReader("\x00\xff\x01"), 3))
+	assert.NoError(t, err)
+	assert.Equal(t, "\x00\xff\x01", string(out))
+
+	out, err = io.ReadAll(NewMaxSizeReader(iotest.OneByteReader(strings.NewReader("\x00\xff\x01\x02")), 3))
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.Equal(t, "\x00\xff\x01", string(out))
+
+	// Reads after the limit keep failing
+	r := NewMaxSizeReader(strings.NewReader("\x00\xff\x01\x02"), 3)
+	_, _ = io.ReadAll(r)
+	n, err := r.Read(make([]byte, 4))
+	assert.ErrorIs(t, err, ErrTooLarge)
+	assert.Equal(t, 0, n)
+}